@@ -0,0 +1,116 @@
+// Package acl implements allow and deny lists of CIDR ranges.
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// LAN can be used in place of a CIDR range to match all loopback, private
+// and link-local addresses.
+const LAN = "lan"
+
+type rule struct {
+	lan bool
+	net *net.IPNet
+}
+
+func (r rule) match(ip net.IP) bool {
+	if r.lan {
+		return isLAN(ip)
+	}
+	return r.net.Contains(ip)
+}
+
+// ACL decides which addresses are allowed. Deny rules take precedence and an
+// empty allow list allows everything that is not denied.
+// A nil *ACL allows everything.
+type ACL struct {
+	allow []rule
+	deny  []rule
+}
+
+func parse(list []string) ([]rule, error) {
+	rules := make([]rule, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if strings.ToLower(s) == LAN {
+			rules = append(rules, rule{lan: true})
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address '%s'", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR range '%s'", s)
+		}
+		rules = append(rules, rule{net: n})
+	}
+
+	return rules, nil
+}
+
+// New parses CIDR ranges, single addresses or LAN.
+func New(allow, deny []string) (*ACL, error) {
+	a := &ACL{}
+	var err error
+	if a.allow, err = parse(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parse(deny); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// None returns an ACL that denies every address.
+func None() *ACL {
+	a, err := New(nil, []string{"0.0.0.0/0", "::/0"})
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func (a *ACL) AllowedIP(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	for _, r := range a.deny {
+		if r.match(ip) {
+			return false
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return true
+	}
+
+	for _, r := range a.allow {
+		if r.match(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *ACL) Allowed(addr net.Addr) bool { return a.AllowedIP(IP(addr)) }
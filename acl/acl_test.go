@@ -0,0 +1,68 @@
+package acl
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	tests := []struct {
+		allow, deny []string
+		allowed     []string
+		denied      []string
+	}{
+		{nil, nil, []string{"1.2.3.4", "::1"}, nil},
+		{[]string{"lan"}, nil, []string{"127.0.0.1", "192.168.1.5", "10.1.2.3", "fe80::1", "::1"}, []string{"8.8.8.8", "2001:db8::1"}},
+		{[]string{"LAN"}, []string{"192.168.1.0/24"}, []string{"192.168.2.1"}, []string{"192.168.1.5", "1.1.1.1"}},
+		{[]string{" 8.8.8.8 ", "2001:db8::/32"}, nil, []string{"8.8.8.8", "2001:db8::5"}, []string{"8.8.4.4", "2001:db9::1"}},
+		{nil, []string{"8.8.8.8"}, []string{"8.8.4.4"}, []string{"8.8.8.8"}},
+	}
+
+	for _, test := range tests {
+		a, err := New(test.allow, test.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ip := range test.allowed {
+			if !a.AllowedIP(net.ParseIP(ip)) {
+				t.Errorf("allow %v deny %v: %s denied", test.allow, test.deny, ip)
+			}
+		}
+		for _, ip := range test.denied {
+			if a.AllowedIP(net.ParseIP(ip)) {
+				t.Errorf("allow %v deny %v: %s allowed", test.allow, test.deny, ip)
+			}
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, s := range []string{"", "lan2", "1.2.3", "1.2.3.4/33", "example.com"} {
+		if _, err := New([]string{s}, nil); err == nil {
+			t.Errorf("allow '%s': expected error", s)
+		}
+		if _, err := New(nil, []string{s}); err == nil {
+			t.Errorf("deny '%s': expected error", s)
+		}
+	}
+}
+
+func TestNilAndNone(t *testing.T) {
+	var a *ACL
+	if !a.AllowedIP(net.ParseIP("8.8.8.8")) {
+		t.Error("nil ACL denied")
+	}
+
+	for _, ip := range []string{"127.0.0.1", "8.8.8.8", "::1", "2001:db8::1"} {
+		if None().AllowedIP(net.ParseIP(ip)) {
+			t.Errorf("None allowed %s", ip)
+		}
+	}
+
+	if None().Allowed(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}) {
+		t.Error("None allowed a TCP address")
+	}
+	if (&ACL{}).AllowedIP(nil) {
+		t.Error("nil ip allowed")
+	}
+}
@@ -0,0 +1,209 @@
+// Package audit implements an append-only JSON-lines log of connections,
+// rotated by size.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// OutcomeRejected means the address was refused by an ACL.
+	OutcomeRejected = "rejected"
+	// OutcomeNegotiationFailed means no common protocol version or
+	// capabilities were found, or the peer is not a homecam client.
+	OutcomeNegotiationFailed = "negotiation-failed"
+	// OutcomeFull means the maximum number of peers was reached.
+	OutcomeFull = "full"
+	// OutcomeDenied means authentication failed.
+	OutcomeDenied = "denied"
+	// OutcomeHandshakeFailed means the handshake did not complete.
+	OutcomeHandshakeFailed = "handshake-failed"
+	// OutcomeAccepted means the client authenticated and was streamed to.
+	OutcomeAccepted = "accepted"
+)
+
+// Entry is a single connection attempt.
+type Entry struct {
+	Time        time.Time
+	Remote      string
+	Auth        string `json:",omitempty"`
+	Device      string `json:",omitempty"`
+	Fingerprint string `json:",omitempty"`
+	Outcome     string
+	// Duration of the session in seconds.
+	Duration float64
+	Bytes    uint64
+	Reason   string `json:",omitempty"`
+}
+
+func (e Entry) String() string {
+	who := e.Auth
+	if e.Device != "" || e.Fingerprint != "" {
+		who = fmt.Sprintf("device '%s' (%s)", e.Device, e.Fingerprint)
+	}
+	if who == "" {
+		who = "-"
+	}
+
+	return fmt.Sprintf(
+		"%s %-21s %-18s %-30s %7.1fs %8.1fkB %s",
+		e.Time.Format("2006-01-02 15:04:05"),
+		e.Remote,
+		e.Outcome,
+		who,
+		e.Duration,
+		float64(e.Bytes)/1024,
+		e.Reason,
+	)
+}
+
+// Log is an append-only log file which is rotated to file.1, file.2, ...
+// once it exceeds maxSize.
+type Log struct {
+	sem     sync.Mutex
+	file    string
+	maxSize int64
+	keep    int
+
+	f    *os.File
+	size int64
+}
+
+func Open(file string, maxSize int64, keep int) (*Log, error) {
+	if keep < 1 {
+		keep = 1
+	}
+
+	l := &Log{file: file, maxSize: maxSize, keep: keep}
+	return l, l.open()
+}
+
+func (l *Log) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.file), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f = f
+	l.size = st.Size()
+	return nil
+}
+
+func (l *Log) rotated(n int) string { return fmt.Sprintf("%s.%d", l.file, n) }
+
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(l.rotated(l.keep))
+	for i := l.keep - 1; i > 0; i-- {
+		os.Rename(l.rotated(i), l.rotated(i+1))
+	}
+
+	if err := os.Rename(l.file, l.rotated(1)); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+func (l *Log) Write(e Entry) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	d = append(d, '\n')
+
+	l.sem.Lock()
+	defer l.sem.Unlock()
+	if l.f == nil {
+		return os.ErrClosed
+	}
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(d)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(d)
+	l.size += int64(n)
+	return err
+}
+
+// Recent returns the last n entries, oldest first.
+func (l *Log) Recent(n int) ([]Entry, error) {
+	l.sem.Lock()
+	defer l.sem.Unlock()
+	return Recent(l.file, n)
+}
+
+func (l *Log) Close() error {
+	l.sem.Lock()
+	defer l.sem.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Recent reads the last n entries from the log file, including the most
+// recently rotated one, oldest first.
+func Recent(file string, n int) ([]Entry, error) {
+	var entries []Entry
+	for _, f := range []string{file + ".1", file} {
+		e, err := read(f)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e...)
+	}
+
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+
+	return entries, nil
+}
+
+func read(file string) ([]Entry, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			// A partial line from a crash, skip it.
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, s.Err()
+}
@@ -2,12 +2,19 @@ package client
 
 import (
 	"bytes"
-	"encoding/binary"
-	"io"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/frizinak/inbetween-go-homecam/crypto"
+	"github.com/frizinak/inbetween-go-homecam/device"
 	"github.com/frizinak/inbetween-go-homecam/protocol"
 	"github.com/frizinak/inbetween-go-homecam/vars"
 )
@@ -20,128 +27,735 @@ const (
 	InfoConnected
 	InfoHandshakeFail
 	InfoError
+	InfoUpgradeRequired
+	InfoTOTPRequired
+	InfoTOTPFail
+	// InfoDeviceDenied means the server no longer accepts our device key,
+	// the client falls back to asking for the password.
+	InfoDeviceDenied
+	// InfoCertificateChanged means the server's TLS certificate no longer
+	// matches the pinned one, Connect returns a *CertificateChangedError.
+	InfoCertificateChanged
+)
+
+var (
+	ErrNotConnected = errors.New("Not connected")
+	ErrClosed       = errors.New("Client closed")
+	ErrRunning      = errors.New("Client is already running")
 )
 
 type Client struct {
-	l    *log.Logger
-	addr string
-	pass chan []byte
+	l *log.Logger
+	// addr is the first address, it identifies the server in known hosts.
+	addr        string
+	credentials Credentials
+	onInfo      func(Info)
+	onStatus    func(string)
+
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	rtt               protocol.RTT
+	rttSince          time.Time
 
-	w    []byte
-	ping []byte
+	proto  *protocol.Protocol
+	status chan string
+	totp   chan string
 
-	proto *protocol.Protocol
-	info  chan Info
+	sem       sync.Mutex
+	conn      net.Conn
+	ch        *protocol.Channel
+	replies   chan protocol.ControlReply
+	identity  *device.Identity
+	known     *KnownHosts
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	addrs     []string
+	current   string
+	switching bool
+	lastErr   *Error
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closed    bool
 }
 
-func New(l *log.Logger, addr string, pass chan []byte) (*Client, <-chan Info) {
-	info := make(chan Info, 1)
-	return &Client{
-		l,
-		addr,
-		pass,
-		[]byte{0},
-		[]byte{10},
-		protocol.New(
+// NewClient creates a client, see Run.
+func NewClient(o Options) (*Client, error) {
+	if len(o.Addresses) == 0 {
+		return nil, errors.New("No server address")
+	}
+
+	l := o.Logger
+	if l == nil {
+		l = log.New(ioutil.Discard, "", 0)
+	}
+
+	c := &Client{
+		l:                 l,
+		addr:              o.Addresses[0],
+		addrs:             append([]string{}, o.Addresses...),
+		credentials:       o.Credentials,
+		onInfo:            o.OnInfo,
+		onStatus:          o.OnStatus,
+		identity:          o.Identity,
+		known:             o.KnownHosts,
+		dial:              o.Dial,
+		keepaliveInterval: vars.KeepaliveInterval,
+		keepaliveTimeout:  vars.KeepaliveTimeout,
+		proto: protocol.New(
 			vars.HandshakeCost,
 			vars.EncryptCost,
 			vars.HandshakeLen,
 			vars.HandshakeHashLen,
+			protocol.Local(vars.MaxFrameSize),
 		),
-		info,
-	}, info
+		replies: make(chan protocol.ControlReply, 1),
+	}
+
+	if c.credentials == nil {
+		c.credentials = noCredentials{}
+	}
+	if c.onInfo == nil {
+		c.onInfo = func(Info) {}
+	}
+	if c.onStatus == nil {
+		c.onStatus = func(string) {}
+	}
+
+	return c, nil
 }
 
-func (c *Client) connErr(err error) error {
-	switch {
-	case err == io.EOF:
-	case err == protocol.ErrDenied:
-		c.info <- InfoHandshakeFail
-	default:
-		c.info <- InfoError
-		c.l.Println(err)
+// New creates a client for the server reachable at addrs, in order of
+// preference. addrs must not be empty. Passwords are read from pass and
+// one-time passwords from TOTP(), state changes are sent on the returned
+// channel which must be drained.
+func New(l *log.Logger, addrs []string, pass chan []byte) (*Client, <-chan Info) {
+	info := make(chan Info, 1)
+	status := make(chan string, 1)
+	totp := make(chan string)
+	c, _ := NewClient(Options{
+		Addresses:   addrs,
+		Credentials: chanCredentials{pass, totp},
+		Logger:      l,
+		OnInfo:      func(i Info) { info <- i },
+		OnStatus: func(msg string) {
+			select {
+			case status <- msg:
+			default:
+			}
+		},
+	})
+	c.status, c.totp = status, totp
+
+	return c, info
+}
+
+// TOTP returns the channel one-time passwords should be sent on after
+// receiving InfoTOTPRequired or InfoTOTPFail. Only for clients created
+// with New.
+func (c *Client) TOTP() chan<- string { return c.totp }
+
+// SetIdentity makes the client authenticate as an enrolled device instead
+// of asking for the password.
+func (c *Client) SetIdentity(i *device.Identity) {
+	c.sem.Lock()
+	c.identity = i
+	c.sem.Unlock()
+}
+
+func (c *Client) Identity() *device.Identity {
+	c.sem.Lock()
+	i := c.identity
+	c.sem.Unlock()
+	return i
+}
+
+// Enroll generates a new device key and enrolls it with the server, which
+// is only allowed when connected using the password. The returned identity
+// is used for subsequent connections and should be persisted by the caller.
+func (c *Client) Enroll(name string, timeout time.Duration) (*device.Identity, error) {
+	i, err := device.NewIdentity(name)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	var e protocol.Enrollment
+	cmd := protocol.Control{
+		Command: "enroll",
+		Args:    []string{name, base64.StdEncoding.EncodeToString(i.PublicKey())},
+	}
+	if err := c.ControlJSON(cmd, timeout, &e); err != nil {
+		return nil, err
+	}
+	if err := e.Verify(i.PublicKey()); err != nil {
+		return nil, err
+	}
+
+	i.ServerKey = e.ServerKey
+	c.SetIdentity(i)
+	return i, nil
 }
 
+// Status returns a channel of status messages sent by the server. Only for
+// clients created with New.
+func (c *Client) Status() <-chan string { return c.status }
+
 type Data struct {
 	*bytes.Buffer
-	created time.Time
+	created  time.Time
+	received time.Time
+	meta     protocol.FrameMeta
+	rtt      time.Duration
 }
 
+// Created is the time the frame was captured, or received if the server
+// did not send metadata.
 func (d *Data) Created() time.Time { return d.created }
 
-func (c *Client) Connect(data chan<- *Data) error {
-	var conn net.Conn
-	var connErr error
-	pass := <-c.pass
+func (d *Data) Received() time.Time { return d.received }
+
+func (d *Data) Latency() time.Duration { return d.received.Sub(d.created) }
+
+func (d *Data) Meta() protocol.FrameMeta { return d.meta }
+
+func (d *Data) FPS() int { return int(d.meta.FPS) }
+
+// RTT is the smoothed round-trip time at the time the frame was received.
+func (d *Data) RTT() time.Duration { return d.rtt }
+
+func (d *Data) String() string {
+	if d.meta.Sequence == 0 {
+		return fmt.Sprintf("rtt: %dms", d.rtt/time.Millisecond)
+	}
+
+	return fmt.Sprintf(
+		"%s %dms (rtt: %dms)",
+		d.meta,
+		d.Latency()/time.Millisecond,
+		d.rtt/time.Millisecond,
+	)
+}
+
+// RTT returns the smoothed round-trip time to the server.
+func (c *Client) RTT() time.Duration {
+	c.sem.Lock()
+	rtt := c.rtt.Smoothed()
+	c.sem.Unlock()
+	return rtt
+}
+
+func (c *Client) addRTT(k protocol.Keepalive) {
+	c.sem.Lock()
+	if time.Unix(0, k.Echo).After(c.rttSince) {
+		c.rtt.Add(k.RTT())
+	}
+	c.sem.Unlock()
+}
 
+func (c *Client) keepalive(quit <-chan struct{}) {
+	ticker := time.NewTicker(c.keepaliveInterval)
+	defer ticker.Stop()
 	for {
-		if conn != nil {
-			conn.Close()
-			if connErr != nil {
-				return connErr
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			if err := c.write(protocol.MessageKeepalive, protocol.Ping()); err != nil {
+				return
 			}
+		}
+	}
+}
+
+// Control sends a command to the server and waits for its reply.
+func (c *Client) Control(cmd protocol.Control, timeout time.Duration) (protocol.ControlReply, error) {
+	var r protocol.ControlReply
+	c.sem.Lock()
+	conn, ch := c.conn, c.ch
+	if conn == nil {
+		c.sem.Unlock()
+		return r, ErrNotConnected
+	}
+	err := protocol.WriteControl(conn, ch, cmd)
+	c.sem.Unlock()
+	if err != nil {
+		return r, err
+	}
+
+	select {
+	case r = <-c.replies:
+	case <-time.After(timeout):
+		return r, fmt.Errorf("No reply to '%s' within %s", cmd.Command, timeout)
+	}
+
+	if r.Error != "" {
+		return r, errors.New(r.Error)
+	}
+
+	return r, nil
+}
+
+// ControlJSON is Control but decodes the reply body into v.
+func (c *Client) ControlJSON(cmd protocol.Control, timeout time.Duration, v interface{}) error {
+	r, err := c.Control(cmd, timeout)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(r.Body, v)
+}
+
+func (c *Client) setConn(conn net.Conn, ch *protocol.Channel) {
+	c.sem.Lock()
+	c.conn, c.ch = conn, ch
+	c.sem.Unlock()
+}
+
+func (c *Client) write(t protocol.MessageType, payload []byte) error {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	if t.Sealed() {
+		payload = c.ch.Seal(t, payload)
+	}
+	return protocol.WriteMessage(c.conn, t, payload)
+}
 
-			time.Sleep(time.Second)
-			c.info <- InfoReconnecting
-			time.Sleep(time.Second)
+// errRetry means authentication should be retried right away, with the
+// password after the device was denied or with a new password.
+var errRetry = errors.New("Retry")
+
+// Connect streams frames to data, see Run.
+func (c *Client) Connect(data chan<- *Data) error {
+	return c.Run(context.Background(), func(d *Data) error {
+		data <- d
+		return nil
+	})
+}
+
+// Run connects and calls fn with each frame, reconnecting with a jittered
+// exponential backoff. It returns when ctx is done, Close is called or fn
+// or the Credentials return an error, or if retrying is pointless, i.e. the
+// server certificate changed or an upgrade is required.
+func (c *Client) Run(ctx context.Context, fn func(*Data) error) error {
+	c.sem.Lock()
+	if c.closed {
+		c.sem.Unlock()
+		return ErrClosed
+	}
+	if c.cancel != nil {
+		c.sem.Unlock()
+		return ErrRunning
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel, c.done = cancel, make(chan struct{})
+	done := c.done
+	c.sem.Unlock()
+
+	defer func() {
+		cancel()
+		c.sem.Lock()
+		c.cancel = nil
+		c.sem.Unlock()
+		close(done)
+	}()
+
+	err := c.run(ctx, fn)
+	if ctx.Err() != nil {
+		c.sem.Lock()
+		closed := c.closed
+		c.sem.Unlock()
+		if closed {
+			return ErrClosed
+		}
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// Close stops Run and waits for it to return.
+func (c *Client) Close() error {
+	c.sem.Lock()
+	c.closed = true
+	cancel, done := c.cancel, c.done
+	c.sem.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+
+	return nil
+}
+
+func (c *Client) run(ctx context.Context, fn func(*Data) error) error {
+	var pass []byte
+	var b backoff
+
+	for attempt := 0; ; attempt++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt != 0 {
+			c.onInfo(InfoReconnecting)
 		}
 
-		var err error
-		c.info <- InfoConnecting
-		conn, err = net.Dial("tcp", c.addr)
+		c.onInfo(InfoConnecting)
+		r, crypter, err := c.authenticate(ctx, &pass)
+		if err == errRetry {
+			continue
+		}
 		if err != nil {
-			time.Sleep(time.Second)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if _, ok := err.(*credentialsError); ok {
+				return err
+			}
+			if e, ok := err.(*Error); ok && e.Kind == ErrorVersion {
+				c.fail(e)
+				c.onInfo(InfoUpgradeRequired)
+				return e
+			}
+			if _, ok := err.(*CertificateChangedError); ok {
+				c.onInfo(InfoCertificateChanged)
+				return err
+			}
+
+			c.fail(classify("", err))
+			if err := sleep(ctx, b.next()); err != nil {
+				return err
+			}
 			continue
 		}
 
-		common := make([]byte, len(vars.CommonSecret))
-		copy(common, vars.CommonSecret)
-		common = append(common, pass...)
+		c.sem.Lock()
+		c.conn, c.ch = r.conn, r.ch
+		c.current = r.addr
+		c.lastErr = nil
+		c.rtt = protocol.RTT{}
+		c.rttSince = time.Now()
+		c.sem.Unlock()
+		c.onInfo(InfoConnected)
+
+		connected := time.Now()
+		sctx, stop := context.WithCancel(ctx)
+		go c.probe(sctx, r)
+		closed := closeOnDone(sctx, r.conn)
+		err = c.stream(sctx, r.conn, r.n, crypter, r.ch, fn)
+		closed()
+		stop()
+		// Reset after stop, the probe can no longer set it.
+		moved := c.switched()
+		c.setConn(nil, nil)
+		r.conn.Close()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch err.(type) {
+		case *callbackError:
+			return err.(*callbackError).err
+		case *credentialsError:
+			return err
+		}
+
+		if time.Since(connected) > backoffReset {
+			b.reset()
+		}
+		if moved {
+			// Moving to a better address.
+			b.reset()
+			continue
+		}
+
+		c.fail(classify(r.addr, err))
+		if err := sleep(ctx, b.next()); err != nil {
+			return err
+		}
+	}
+}
+
+// LastError returns why the last attempt to connect or the last connection
+// failed, nil while connected.
+func (c *Client) LastError() *Error {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	return c.lastErr
+}
+
+// fail records err and reports it as InfoHandshakeFail if the password was
+// denied or InfoError otherwise.
+func (c *Client) fail(err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = classify("", err).(*Error)
+	}
 
-		crypter, err := c.proto.HandshakeClient(common, conn)
+	c.sem.Lock()
+	c.lastErr = e
+	c.sem.Unlock()
+
+	switch e.Kind {
+	case ErrorClosed:
+	case ErrorDenied:
+		c.onInfo(InfoHandshakeFail)
+	default:
+		c.onInfo(InfoError)
+		c.l.Println(e)
+	}
+}
+
+// authenticate races all addresses and authenticates on the fastest one,
+// falling back to the next if that fails for reasons other than being
+// denied. If all fail the error of the most preferred address is returned.
+func (c *Client) authenticate(ctx context.Context, pass *[]byte) (candidate, *crypto.ImmutableKeyDecrypter, error) {
+	stop := make(chan struct{})
+	results := c.race(ctx, c.Addresses(), stop)
+	defer func() {
+		close(stop)
+		go drain(results)
+	}()
+
+	var err error
+	rank := -1
+	failed := func(r candidate, e error) {
+		if rank == -1 || r.rank < rank {
+			rank, err = r.rank, classify(r.addr, e)
+		}
+	}
+
+	for r := range results {
+		switch r.err.(type) {
+		case nil:
+		case *CertificateChangedError:
+			return r, nil, r.err
+		default:
+			if e, ok := classify(r.addr, r.err).(*Error); ok && e.Kind == ErrorVersion {
+				return r, nil, e
+			}
+			failed(r, r.err)
+			continue
+		}
+
+		identity := c.Identity()
+		if !r.n.Has(protocol.FeatureDeviceAuth) {
+			identity = nil
+		}
+
+		var crypter *crypto.ImmutableKeyDecrypter
+		var herr error
+		if identity != nil {
+			crypter, r.ch, herr = c.handshakeDevice(ctx, r.conn, identity)
+			if herr == protocol.ErrDenied || herr == protocol.ErrServerKey {
+				r.conn.Close()
+				c.l.Println(herr)
+				c.SetIdentity(nil)
+				c.onInfo(InfoDeviceDenied)
+				return r, nil, errRetry
+			}
+		} else {
+			if *pass == nil {
+				p, err := c.password(ctx, false)
+				if err != nil {
+					r.conn.Close()
+					return r, nil, err
+				}
+				*pass = p
+			}
+
+			crypter, r.ch, herr = c.handshakePassword(ctx, r.n, r.conn, *pass)
+			if herr == protocol.ErrDenied {
+				r.conn.Close()
+				c.fail(classify(r.addr, herr))
+				p, err := c.password(ctx, true)
+				if err != nil {
+					return r, nil, err
+				}
+				*pass = p
+				return r, nil, errRetry
+			}
+		}
+
+		if herr == nil {
+			return r, crypter, nil
+		}
+
+		r.conn.Close()
+		c.l.Printf("Authenticating with %s failed: %s", r.addr, herr)
+		failed(r, herr)
+	}
+
+	if err == nil {
+		err = errUnreachable
+	}
+	return candidate{}, nil, err
+}
+
+func (c *Client) handshakePassword(
+	ctx context.Context,
+	n protocol.Negotiated,
+	conn net.Conn,
+	pass []byte,
+) (*crypto.ImmutableKeyDecrypter, *protocol.Channel, error) {
+	defer closeOnDone(ctx, conn)()
+
+	if n.Has(protocol.FeatureDeviceAuth) {
+		if err := protocol.WriteAuthMethod(conn, protocol.AuthPassword); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	common := make([]byte, len(vars.CommonSecret))
+	copy(common, vars.CommonSecret)
+	common = append(common, pass...)
+
+	return c.proto.HandshakeClient(common, conn)
+}
+
+func (c *Client) handshakeDevice(
+	ctx context.Context,
+	conn net.Conn,
+	i *device.Identity,
+) (*crypto.ImmutableKeyDecrypter, *protocol.Channel, error) {
+	defer closeOnDone(ctx, conn)()
+
+	if err := protocol.WriteAuthMethod(conn, protocol.AuthDevice); err != nil {
+		return nil, nil, err
+	}
+
+	return c.proto.HandshakeDeviceClient(i.PrivateKey, i.ServerKey, conn)
+}
+
+func (c *Client) stream(
+	ctx context.Context,
+	conn net.Conn,
+	n protocol.Negotiated,
+	crypter *crypto.ImmutableKeyDecrypter,
+	ch *protocol.Channel,
+	fn func(*Data) error,
+) error {
+	quit := make(chan struct{})
+	defer close(quit)
+	go c.keepalive(quit)
+
+	push := n.Has(protocol.FeaturePush)
+	if !push {
+		if err := c.write(protocol.MessagePoll, nil); err != nil {
+			return err
+		}
+	}
+
+	first := true
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(c.keepaliveTimeout))
+		if err != nil {
+			return err
+		}
+
+		m, err := protocol.ReadMessage(conn, n.MaxFrameSize)
 		if err != nil {
-			connErr = c.connErr(err)
-			if err == protocol.ErrDenied {
-				conn.Close()
-				conn = nil
-				pass = <-c.pass
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				err = &Error{
+					Kind: ErrorTimeout,
+					Err:  fmt.Errorf("Server timed out, no keepalive within %s", c.keepaliveTimeout),
+				}
 			}
+			return err
+		}
 
-			continue
+		if m.Type.Sealed() {
+			if m.Payload, err = ch.Open(m); err != nil {
+				return fmt.Errorf("%s message: %s", m.Type, err)
+			}
 		}
 
-		c.info <- InfoConnected
-		for {
-			if _, err = conn.Write(c.w); err != nil {
-				connErr = c.connErr(err)
+		poll := false
+		switch m.Type {
+		case protocol.MessageKeepalive:
+			var k protocol.Keepalive
+			if k, err = protocol.ParseKeepalive(m.Payload); err != nil {
+				break
+			}
+			if k.IsPong() {
+				c.addRTT(k)
+				break
+			}
+			err = c.write(protocol.MessageKeepalive, k.Pong())
+		case protocol.MessageTOTPRequest:
+			c.onInfo(InfoTOTPRequired)
+			err = c.writeTOTP(ctx, false)
+		case protocol.MessageTOTPResult:
+			if len(m.Payload) == 1 && m.Payload[0] == 1 {
 				break
 			}
-			var ln uint64
-			if err = binary.Read(conn, binary.LittleEndian, &ln); err != nil {
-				connErr = c.connErr(err)
+			c.onInfo(InfoTOTPFail)
+			err = c.writeTOTP(ctx, true)
+		case protocol.MessageStatus:
+			c.onStatus(string(m.Payload))
+		case protocol.MessageError:
+			err = &protocol.RemoteError{Message: string(m.Payload)}
+		case protocol.MessageControlReply:
+			var r protocol.ControlReply
+			if err = json.Unmarshal(m.Payload, &r); err != nil {
+				break
+			}
+			select {
+			case c.replies <- r:
+			default:
+			}
+		case protocol.MessageFrame:
+			received := time.Now()
+			var meta protocol.FrameMeta
+			var ciphertext []byte
+			meta, ciphertext, err = protocol.ParseFrame(n, m.Payload)
+			if err != nil {
 				break
 			}
 
-			d := make([]byte, ln)
-			if _, err = io.ReadFull(conn, d); err != nil {
-				connErr = c.connErr(err)
+			out := bytes.NewBuffer(make([]byte, 0, len(ciphertext)))
+			if err = crypter.Decrypt(bytes.NewBuffer(ciphertext), out); err != nil {
+				err = &Error{Kind: ErrorDecrypt, Err: err}
 				break
 			}
 
-			if len(d) == 3 {
-				continue
+			if first {
+				// Decrypting the first frame derives the key which stalls
+				// reading, ignore pings sent until now.
+				first = false
+				c.sem.Lock()
+				c.rtt = protocol.RTT{}
+				c.rttSince = time.Now()
+				c.sem.Unlock()
 			}
 
-			out := bytes.NewBuffer(make([]byte, 0, len(d)))
-			if err = crypter.Decrypt(bytes.NewBuffer(d), out); err != nil {
-				connErr = c.connErr(err)
-				break
+			created := received
+			if meta.Sequence != 0 {
+				created = meta.CapturedAt()
 			}
 
-			data <- &Data{Buffer: out, created: time.Now()}
+			poll = !push
+			d := &Data{
+				Buffer:   out,
+				created:  created,
+				received: received,
+				meta:     meta,
+				rtt:      c.RTT(),
+			}
+			if cerr := fn(d); cerr != nil {
+				return &callbackError{cerr}
+			}
+		default:
+			err = fmt.Errorf("Unexpected %s message", m.Type)
+		}
+
+		if err == nil && poll {
+			err = c.write(protocol.MessagePoll, nil)
+		}
+
+		if err != nil {
+			return err
 		}
 	}
 }
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/protocol"
+)
+
+// ErrorKind classifies why connecting or streaming failed.
+type ErrorKind int
+
+const (
+	ErrorUnknown ErrorKind = iota
+	// ErrorDNS means the hostname could not be resolved.
+	ErrorDNS
+	// ErrorRefused means nothing is listening on the address.
+	ErrorRefused
+	// ErrorTimeout means the server did not respond in time.
+	ErrorTimeout
+	// ErrorClosed means the server closed the connection.
+	ErrorClosed
+	// ErrorDenied means the password or device key was rejected.
+	ErrorDenied
+	// ErrorVersion means client and server have no protocol version in
+	// common.
+	ErrorVersion
+	// ErrorServerFull means the server reached its maximum number of
+	// clients.
+	ErrorServerFull
+	// ErrorDecrypt means a frame could not be decrypted.
+	ErrorDecrypt
+	// ErrorRemote is any other error reported by the server.
+	ErrorRemote
+)
+
+// Error is a connection failure, Reason describes it for humans.
+type Error struct {
+	Kind ErrorKind
+	Addr string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Addr == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Addr, e.Err)
+}
+
+// Reason is a short description suitable for showing to users.
+func (e *Error) Reason() string {
+	switch e.Kind {
+	case ErrorDNS:
+		host, _, _ := net.SplitHostPort(e.Addr)
+		return fmt.Sprintf("Could not find %s", host)
+	case ErrorRefused:
+		return "Connection refused, is the server running?"
+	case ErrorTimeout:
+		return "Server is not responding"
+	case ErrorClosed:
+		return "Server closed the connection"
+	case ErrorDenied:
+		return "Access denied"
+	case ErrorVersion:
+		return "Upgrade required"
+	case ErrorServerFull:
+		return "Server is full, try again later"
+	case ErrorDecrypt:
+		return "Could not decrypt the stream"
+	case ErrorRemote:
+		return e.Err.Error()
+	}
+
+	return "Something went wrong!"
+}
+
+// classify wraps err in an *Error, it returns err if it already is one.
+func classify(addr string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+
+	e := &Error{Addr: addr, Err: err}
+	var dnsErr *net.DNSError
+	var versionErr *protocol.VersionError
+	var remoteErr *protocol.RemoteError
+	var netErr net.Error
+	var errno syscall.Errno
+	errors.As(err, &errno)
+	switch {
+	case errors.As(err, &dnsErr):
+		e.Kind = ErrorDNS
+	case errors.As(err, &versionErr):
+		e.Kind = ErrorVersion
+	case errors.As(err, &remoteErr):
+		e.Kind = ErrorRemote
+	case err == protocol.ErrDenied || err == protocol.ErrServerKey:
+		e.Kind = ErrorDenied
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		e.Kind = ErrorClosed
+	case errno == syscall.ECONNREFUSED:
+		e.Kind = ErrorRefused
+	case errno == syscall.ECONNRESET || errno == syscall.EPIPE:
+		e.Kind = ErrorClosed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		e.Kind = ErrorTimeout
+	}
+
+	return e
+}
+
+const (
+	backoffMin = time.Millisecond * 500
+	backoffMax = time.Second * 30
+	// backoffReset is how long a connection must have lasted for the next
+	// reconnect to start over at backoffMin.
+	backoffReset = time.Second * 30
+)
+
+// backoff is a jittered exponential backoff.
+type backoff struct {
+	attempt uint
+}
+
+// next returns a random delay between half and all of the current step and
+// doubles the step up to backoffMax.
+func (b *backoff) next() time.Duration {
+	d := backoffMax
+	if b.attempt < 16 {
+		if step := backoffMin << b.attempt; step < backoffMax {
+			d = step
+		}
+	}
+	b.attempt++
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (b *backoff) reset() { b.attempt = 0 }
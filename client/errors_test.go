@@ -0,0 +1,132 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/protocol"
+)
+
+func refused(t *testing.T) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = net.Dial("tcp", addr)
+	if err == nil {
+		t.Fatal("dial succeeded")
+	}
+	return err
+}
+
+func timedOut(t *testing.T) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now())
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("read succeeded")
+	}
+	return err
+}
+
+func TestClassify(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: err}}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		kind ErrorKind
+	}{
+		{"dns", &net.DNSError{Err: "no such host", Name: "cam.invalid"}, ErrorDNS},
+		{"dns dial", &net.OpError{Op: "dial", Err: &net.DNSError{Name: "cam.invalid"}}, ErrorDNS},
+		{"refused", refused(t), ErrorRefused},
+		{"refused errno", opErr(syscall.ECONNREFUSED), ErrorRefused},
+		{"refused text", fmt.Errorf("proxy: connection refused"), ErrorUnknown},
+		{"reset", opErr(syscall.ECONNRESET), ErrorClosed},
+		{"pipe", opErr(syscall.EPIPE), ErrorClosed},
+		{"timeout", timedOut(t), ErrorTimeout},
+		{"timeout errno", opErr(syscall.ETIMEDOUT), ErrorTimeout},
+		{"eof", io.EOF, ErrorClosed},
+		{"unexpected eof", io.ErrUnexpectedEOF, ErrorClosed},
+		{"remote", &protocol.RemoteError{Message: "Server full"}, ErrorRemote},
+		{"wrapped remote", fmt.Errorf("handshake: %w", &protocol.RemoteError{}), ErrorRemote},
+		{"version", &protocol.VersionError{LocalMin: 1, LocalMax: 2, RemoteMin: 3, RemoteMax: 4}, ErrorVersion},
+		{"denied", protocol.ErrDenied, ErrorDenied},
+		{"server key", protocol.ErrServerKey, ErrorDenied},
+		{"unknown", fmt.Errorf("something"), ErrorUnknown},
+	}
+
+	for _, test := range tests {
+		err := classify("cam:1234", test.err)
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s: not an *Error: %v", test.name, err)
+			continue
+		}
+		if e.Kind != test.kind {
+			t.Errorf("%s: kind %d, want %d (%v)", test.name, e.Kind, test.kind, test.err)
+		}
+		if e.Addr != "cam:1234" || e.Err != test.err {
+			t.Errorf("%s: wrapped as %+v", test.name, e)
+		}
+	}
+
+	if classify("cam:1234", nil) != nil {
+		t.Error("nil error classified")
+	}
+	e := &Error{Kind: ErrorDecrypt}
+	if classify("cam:1234", e) != e {
+		t.Error("*Error wrapped again")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var b backoff
+	step := backoffMin
+	for i := 0; i < 100; i++ {
+		d := b.next()
+		if d < step/2 || d > step {
+			t.Fatalf("attempt %d: %s not within [%s, %s]", i, d, step/2, step)
+		}
+		if step *= 2; step > backoffMax {
+			step = backoffMax
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d < backoffMin/2 || d > backoffMin {
+		t.Errorf("after reset %s not within [%s, %s]", d, backoffMin/2, backoffMin)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		b := backoff{attempt: 5}
+		seen[b.next()] = true
+	}
+	if len(seen) < 2 {
+		t.Error("no jitter")
+	}
+}
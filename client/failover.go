@@ -0,0 +1,306 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/protocol"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// dialStagger is the head start an address gets over the next one
+	// before that one is dialed in parallel (RFC 8305).
+	dialStagger = time.Millisecond * 250
+	// dialTimeout bounds dialing and negotiating with a single address.
+	dialTimeout = time.Second * 10
+	// probeInterval is how often better addresses are probed while
+	// connected to a worse one.
+	probeInterval = time.Second * 30
+)
+
+var (
+	errUnreachable = errors.New("No address is reachable")
+	errUnverified  = errors.New("Nothing pinned or enrolled to verify the server with")
+)
+
+// candidate is the result of dialing and negotiating with one address.
+type candidate struct {
+	addr string
+	// rank is the index of addr in the address list.
+	rank int
+	conn net.Conn
+	n    protocol.Negotiated
+	// ch is set once authenticated.
+	ch  *protocol.Channel
+	err error
+}
+
+// PreferAddress moves addr to the front of the address list, e.g. a LAN
+// address found by discovery. Known hosts and identities remain keyed by
+// the first address passed to New.
+func (c *Client) PreferAddress(addr string) {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	addrs := []string{addr}
+	for _, a := range c.addrs {
+		if a != addr {
+			addrs = append(addrs, a)
+		}
+	}
+	c.addrs = addrs
+}
+
+// VerifyAddress checks that the server at addr, e.g. found by discovery, is
+// the one at the configured address before it is passed to PreferAddress.
+// Its certificate must match the one pinned for the configured address or
+// it must prove to own the server key of the identity. Nothing is pinned
+// and no session is started.
+func (c *Client) VerifyAddress(ctx context.Context, addr string) error {
+	var serverKey ed25519.PublicKey
+	if i := c.Identity(); i != nil {
+		serverKey = i.ServerKey
+	}
+	if c.known == nil && len(serverKey) == 0 {
+		return errUnverified
+	}
+
+	var pinned bool
+	var pin func(string) error
+	if c.known != nil {
+		pin = func(fingerprint string) error {
+			p, err := c.known.Pinned(c.addr)
+			if err != nil {
+				return err
+			}
+			if p == "" {
+				return nil
+			}
+			if p != fingerprint {
+				return &CertificateChangedError{addr, p, fingerprint, c.known.file}
+			}
+			pinned = true
+			return nil
+		}
+	}
+
+	conn, err := c.dialPin(ctx, addr, pin)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if pinned {
+		return nil
+	}
+	if len(serverKey) == 0 {
+		return errUnverified
+	}
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	n, err := c.proto.NegotiateClient(conn)
+	if err != nil {
+		return err
+	}
+	if !n.Has(protocol.FeatureDeviceAuth) {
+		return errUnverified
+	}
+	if n.Has(protocol.FeatureAdmission) {
+		if err := protocol.ReadAdmission(conn, n.MaxFrameSize); err != nil {
+			return err
+		}
+	}
+	if err := protocol.WriteAuthMethod(conn, protocol.AuthDevice); err != nil {
+		return err
+	}
+
+	return c.proto.VerifyServerKey(serverKey, conn)
+}
+
+// Addresses returns the addresses in order of preference.
+func (c *Client) Addresses() []string {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	return append([]string{}, c.addrs...)
+}
+
+// Address returns the address of the current connection.
+func (c *Client) Address() string {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	return c.current
+}
+
+func (c *Client) dialNegotiate(ctx context.Context, addr string) (net.Conn, protocol.Negotiated, error) {
+	var n protocol.Negotiated
+	conn, err := c.dialAddr(ctx, addr)
+	if err != nil {
+		return nil, n, err
+	}
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	if n, err = c.proto.NegotiateClient(conn); err != nil {
+		conn.Close()
+		return nil, n, err
+	}
+	if n.Has(protocol.FeatureAdmission) {
+		if err = protocol.ReadAdmission(conn, n.MaxFrameSize); err != nil {
+			conn.Close()
+			if _, ok := err.(*protocol.RemoteError); ok {
+				err = &Error{Kind: ErrorServerFull, Addr: addr, Err: err}
+			}
+			return nil, n, err
+		}
+	}
+
+	return conn, n, conn.SetDeadline(time.Time{})
+}
+
+// race dials addrs happy eyeballs style, each address is dialed once the
+// previous one failed or had dialStagger to connect. All results are sent
+// on the returned channel which is closed once every dial finished.
+// No new dials are started after stop is closed, ctx aborts them.
+func (c *Client) race(ctx context.Context, addrs []string, stop <-chan struct{}) <-chan candidate {
+	results := make(chan candidate, len(addrs))
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		for i, addr := range addrs {
+			failed := make(chan struct{})
+			wg.Add(1)
+			go func(i int, addr string) {
+				defer wg.Done()
+				r := candidate{addr: addr, rank: i}
+				r.conn, r.n, r.err = c.dialNegotiate(ctx, addr)
+				if r.err != nil {
+					close(failed)
+				}
+				results <- r
+			}(i, addr)
+
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-failed:
+			case <-time.After(dialStagger):
+			}
+		}
+	}()
+
+	return results
+}
+
+// drain closes the connections of results nobody is interested in.
+func drain(results <-chan candidate) {
+	for r := range results {
+		if r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+// fastest returns the first address to connect and negotiate. Certificate
+// and version errors are returned immediately as trying another address of
+// the same server is pointless.
+func (c *Client) fastest(ctx context.Context) (candidate, error) {
+	stop := make(chan struct{})
+	results := c.race(ctx, c.Addresses(), stop)
+	defer func() {
+		close(stop)
+		go drain(results)
+	}()
+
+	err := errUnreachable
+	for r := range results {
+		switch r.err.(type) {
+		case nil:
+			return r, nil
+		case *CertificateChangedError, *protocol.VersionError:
+			return r, r.err
+		}
+		err = classify(r.addr, r.err)
+	}
+
+	return candidate{}, err
+}
+
+// probe periodically checks whether an address better than the current
+// one became reachable and if so closes conn so Run reconnects.
+func (c *Client) probe(ctx context.Context, current candidate) {
+	if current.rank == 0 {
+		return
+	}
+
+	t := time.NewTicker(probeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		addrs := c.Addresses()
+		for i, a := range addrs {
+			if a == current.addr {
+				addrs = addrs[:i]
+				break
+			}
+		}
+		if len(addrs) == 0 {
+			return
+		}
+
+		for _, addr := range addrs {
+			if err := c.reachable(ctx, addr); err != nil {
+				continue
+			}
+
+			c.sem.Lock()
+			if ctx.Err() != nil {
+				c.sem.Unlock()
+				return
+			}
+			c.switching = true
+			c.sem.Unlock()
+			c.l.Printf("%s is reachable, moving from %s", addr, current.addr)
+			current.conn.Close()
+			return
+		}
+	}
+}
+
+// reachable dials addr and reads the server's capabilities, closing the
+// connection before negotiating so the probe neither takes a peer slot
+// nor shows up as a session on the server.
+func (c *Client) reachable(ctx context.Context, addr string) error {
+	conn, err := c.dialAddr(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	return c.proto.Probe(conn)
+}
+
+// switched reports whether the connection was closed to move to a better
+// address and resets it.
+func (c *Client) switched() bool {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	s := c.switching
+	c.switching = false
+	return s
+}
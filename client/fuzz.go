@@ -0,0 +1,53 @@
+// +build gofuzz
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/crypto"
+	"github.com/frizinak/inbetween-go-homecam/protocol"
+)
+
+type fuzzConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (f *fuzzConn) Read(b []byte) (int, error)         { return f.r.Read(b) }
+func (f *fuzzConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (f *fuzzConn) Close() error                       { return nil }
+func (f *fuzzConn) SetReadDeadline(t time.Time) error  { return nil }
+func (f *fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Fuzz feeds arbitrary server messages to the client's frame reader.
+//
+//	go-fuzz-build && go-fuzz
+func Fuzz(data []byte) int {
+	c, err := NewClient(Options{Addresses: []string{"fuzz"}})
+	if err != nil {
+		panic(err)
+	}
+
+	conn := &fuzzConn{r: bytes.NewReader(data)}
+	ch, err := protocol.NewChannel([]byte("fuzz"), false)
+	if err != nil {
+		panic(err)
+	}
+	c.setConn(conn, ch)
+	n := protocol.Negotiated{
+		Features:     protocol.FeaturePush | protocol.FeatureMetadata,
+		MaxFrameSize: 1 << 16,
+	}
+	crypter := crypto.NewImmutableKeyDecrypter([]byte("fuzz")).Limit(crypto.MinCost, 64)
+
+	score := 0
+	c.stream(context.Background(), conn, n, crypter, ch, func(*Data) error {
+		score = 1
+		return nil
+	})
+	return score
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/device"
+	"github.com/frizinak/inbetween-go-homecam/protocol"
+)
+
+// Options configures a client created with NewClient.
+type Options struct {
+	// Addresses of the server in order of preference, see PreferAddress.
+	Addresses []string
+	// Credentials is asked for the password when there is no Identity or
+	// the server no longer accepts it.
+	Credentials Credentials
+	// Identity authenticates as an enrolled device, see SetIdentity.
+	Identity *device.Identity
+	// KnownHosts enables TLS, see UseTLS.
+	KnownHosts *KnownHosts
+	// Logger defaults to discarding everything.
+	Logger *log.Logger
+	// OnInfo is called synchronously on each state change.
+	OnInfo func(Info)
+	// OnStatus is called synchronously with status messages sent by the
+	// server.
+	OnStatus func(string)
+	// Dial replaces net.Dialer, e.g. to shape the connection, see the shape
+	// package.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Credentials provides what the client authenticates with. An error
+// returned by either method makes Run return it.
+type Credentials interface {
+	// Password returns the password followed by the touch password, denied
+	// is set if the server rejected the previous one.
+	Password(ctx context.Context, denied bool) ([]byte, error)
+	// TOTP returns a one-time password, failed is set if the previous one
+	// was wrong.
+	TOTP(ctx context.Context, failed bool) (string, error)
+}
+
+// Password returns Credentials that always use pass and can not answer
+// one-time password requests.
+func Password(pass []byte) Credentials { return staticCredentials(pass) }
+
+type staticCredentials []byte
+
+func (s staticCredentials) Password(ctx context.Context, denied bool) ([]byte, error) {
+	if denied {
+		return nil, protocol.ErrDenied
+	}
+	return s, nil
+}
+
+func (s staticCredentials) TOTP(ctx context.Context, failed bool) (string, error) {
+	return noCredentials{}.TOTP(ctx, failed)
+}
+
+type noCredentials struct{}
+
+func (noCredentials) Password(context.Context, bool) ([]byte, error) {
+	return nil, errors.New("Password required but no credentials were configured")
+}
+
+func (noCredentials) TOTP(context.Context, bool) (string, error) {
+	return "", errors.New("One-time password required but no credentials were configured")
+}
+
+// chanCredentials reads from the channels of the channel API.
+type chanCredentials struct {
+	pass <-chan []byte
+	totp <-chan string
+}
+
+func (c chanCredentials) Password(ctx context.Context, denied bool) ([]byte, error) {
+	select {
+	case p := <-c.pass:
+		return p, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c chanCredentials) TOTP(ctx context.Context, failed bool) (string, error) {
+	select {
+	case code := <-c.totp:
+		return code, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// credentialsError is returned by Run as is.
+type credentialsError struct{ err error }
+
+func (c *credentialsError) Error() string { return c.err.Error() }
+
+// callbackError wraps the error returned by the frame callback.
+type callbackError struct{ err error }
+
+func (c *callbackError) Error() string { return c.err.Error() }
+
+func (c *Client) password(ctx context.Context, denied bool) ([]byte, error) {
+	p, err := c.credentials.Password(ctx, denied)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &credentialsError{err}
+	}
+	return p, nil
+}
+
+func (c *Client) writeTOTP(ctx context.Context, failed bool) error {
+	code, err := c.credentials.TOTP(ctx, failed)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &credentialsError{err}
+	}
+	return c.write(protocol.MessageTOTPResponse, []byte(code))
+}
+
+// closeOnDone closes conn if ctx is done before the returned func is
+// called, which unblocks any read or write on it.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
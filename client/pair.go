@@ -0,0 +1,111 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/device"
+	"github.com/frizinak/inbetween-go-homecam/protocol"
+	"github.com/frizinak/inbetween-go-homecam/vars"
+	"golang.org/x/crypto/ed25519"
+)
+
+var ErrPairingUnsupported = errors.New("Server does not support pairing")
+
+// Pair enrolls a new device key using a one-time pairing token, without
+// knowing the password. The server must prove it holds serverKey by
+// signing the new device key. The returned identity is also set on the
+// client and should be persisted by the caller.
+func (c *Client) Pair(
+	token string,
+	serverKey ed25519.PublicKey,
+	name string,
+	timeout time.Duration,
+) (*device.Identity, error) {
+	i, err := device.NewIdentity(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r, err := c.fastest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, n := r.conn, r.n
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if !n.Has(protocol.FeatureDeviceAuth) || !n.Has(protocol.FeaturePairing) {
+		return nil, ErrPairingUnsupported
+	}
+
+	if err := protocol.WriteAuthMethod(conn, protocol.AuthPair); err != nil {
+		return nil, err
+	}
+
+	common := make([]byte, len(vars.CommonSecret))
+	copy(common, vars.CommonSecret)
+	common = append(common, token...)
+	_, ch, err := c.proto.HandshakeClient(common, conn)
+	if err != nil {
+		if err == protocol.ErrDenied {
+			return nil, errors.New("Pairing token rejected, it expired or was already used")
+		}
+		return nil, err
+	}
+
+	cmd := protocol.Control{
+		Command: "enroll",
+		Args:    []string{name, base64.StdEncoding.EncodeToString(i.PublicKey())},
+	}
+	if err := protocol.WriteControl(conn, ch, cmd); err != nil {
+		return nil, err
+	}
+
+	for {
+		m, err := protocol.ReadMessage(conn, n.MaxFrameSize)
+		if err != nil {
+			return nil, err
+		}
+
+		switch m.Type {
+		case protocol.MessageError:
+			return nil, &protocol.RemoteError{Message: string(m.Payload)}
+		case protocol.MessageControlReply:
+			d, err := ch.Open(m)
+			if err != nil {
+				return nil, err
+			}
+			var r protocol.ControlReply
+			if err := json.Unmarshal(d, &r); err != nil {
+				return nil, err
+			}
+			if r.Error != "" {
+				return nil, errors.New(r.Error)
+			}
+
+			var e protocol.Enrollment
+			if err := json.Unmarshal(r.Body, &e); err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(e.ServerKey, serverKey) {
+				return nil, protocol.ErrServerKey
+			}
+			if err := e.Verify(i.PublicKey()); err != nil {
+				return nil, err
+			}
+
+			i.ServerKey = serverKey
+			c.SetIdentity(i)
+			return i, nil
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const proxyBoundary = "homecamframe"
+
+// Proxy serves the frames it is given as MJPEG over HTTP on the loopback
+// interface, so other programs on the same machine can show the stream
+// while the server only sees this client. / is the stream,
+// /snapshot.jpg the most recent frame.
+type Proxy struct {
+	l   *log.Logger
+	srv *http.Server
+
+	sem     sync.Mutex
+	frame   []byte
+	viewers map[chan []byte]struct{}
+}
+
+func NewProxy(l *log.Logger) *Proxy {
+	p := &Proxy{l: l, viewers: make(map[chan []byte]struct{})}
+	p.srv = &http.Server{Handler: p}
+	return p
+}
+
+// ProxyAddress turns a port or host:port into a listen address, the host
+// defaults to 127.0.0.1 and must be a loopback address.
+func ProxyAddress(addr string) (string, error) {
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return "", fmt.Errorf("Proxy only listens on loopback addresses, %s is not one", host)
+		}
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// ListenAndServe serves on addr, see ProxyAddress. It returns
+// http.ErrServerClosed after Close.
+func (p *Proxy) ListenAndServe(addr string) error {
+	addr, err := ProxyAddress(addr)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.l.Printf("Serving MJPEG on http://%s/", ln.Addr())
+	return p.srv.Serve(ln)
+}
+
+// Close stops serving and disconnects all viewers.
+func (p *Proxy) Close() error { return p.srv.Close() }
+
+// Frame hands a frame to all viewers, viewers that are still busy with the
+// previous one skip it. Call before passing d on as reading it consumes it.
+func (p *Proxy) Frame(d *Data) {
+	frame := d.Bytes()
+	p.sem.Lock()
+	defer p.sem.Unlock()
+	p.frame = frame
+	for v := range p.viewers {
+		select {
+		case <-v:
+		default:
+		}
+		v <- frame
+	}
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/":
+		p.stream(w, r)
+	case "/snapshot.jpg":
+		p.sem.Lock()
+		frame := p.frame
+		p.sem.Unlock()
+		if frame == nil {
+			http.Error(w, "No frame received yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(frame)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *Proxy) stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+proxyBoundary)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	v := make(chan []byte, 1)
+	p.sem.Lock()
+	if p.frame != nil {
+		v <- p.frame
+	}
+	p.viewers[v] = struct{}{}
+	p.sem.Unlock()
+	defer func() {
+		p.sem.Lock()
+		delete(p.viewers, v)
+		p.sem.Unlock()
+	}()
+
+	p.l.Printf("Proxy viewer %s connected", r.RemoteAddr)
+	defer p.l.Printf("Proxy viewer %s disconnected", r.RemoteAddr)
+	for {
+		var frame []byte
+		select {
+		case frame = <-v:
+		case <-r.Context().Done():
+			return
+		}
+
+		_, err := fmt.Fprintf(
+			w,
+			"--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n",
+			proxyBoundary,
+			len(frame),
+		)
+		if err == nil {
+			_, err = w.Write(frame)
+		}
+		if err == nil {
+			_, err = w.Write([]byte("\r\n"))
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/protocol"
+)
+
+// CertificateChangedError is returned when a server presents a different
+// certificate than the one pinned on first connect.
+type CertificateChangedError struct {
+	Addr   string
+	Pinned string
+	Got    string
+	File   string
+}
+
+func (c *CertificateChangedError) Error() string {
+	return fmt.Sprintf(
+		"Certificate of %s changed (pinned: %s, got: %s), remove it from %s if this is expected",
+		c.Addr,
+		c.Pinned,
+		c.Got,
+		c.File,
+	)
+}
+
+func DefaultKnownHostsFile() (string, error) {
+	home, err := os.UserHomeDir()
+	return filepath.Join(home, ".config", "homecam", "known_hosts.json"), err
+}
+
+// KnownHosts stores the pinned certificate fingerprint of each server.
+type KnownHosts struct {
+	sem  sync.Mutex
+	file string
+}
+
+func NewKnownHosts(file string) *KnownHosts {
+	return &KnownHosts{file: file}
+}
+
+func (k *KnownHosts) load() (map[string]string, error) {
+	l := make(map[string]string)
+	d, err := ioutil.ReadFile(k.file)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return l, json.Unmarshal(d, &l)
+}
+
+// Verify pins fingerprint for addr if none is known yet and fails if it
+// differs from the pinned one.
+func (k *KnownHosts) Verify(addr, fingerprint string) error {
+	k.sem.Lock()
+	defer k.sem.Unlock()
+	l, err := k.load()
+	if err != nil {
+		return err
+	}
+
+	pinned, ok := l[addr]
+	if ok {
+		if pinned != fingerprint {
+			return &CertificateChangedError{addr, pinned, fingerprint, k.file}
+		}
+		return nil
+	}
+
+	l[addr] = fingerprint
+	d, err := json.MarshalIndent(l, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.file), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(k.file, d, 0600)
+}
+
+// Pinned returns the fingerprint pinned for addr, empty if none is.
+func (k *KnownHosts) Pinned(addr string) (string, error) {
+	k.sem.Lock()
+	defer k.sem.Unlock()
+	l, err := k.load()
+	if err != nil {
+		return "", err
+	}
+
+	return l[addr], nil
+}
+
+// UseTLS makes the client connect over TLS, trusting the certificate seen
+// on first connect.
+func (c *Client) UseTLS(known *KnownHosts) {
+	c.known = known
+}
+
+// dialAddr connects to addr and completes the TLS handshake if enabled.
+// The returned connection has a deadline of dialTimeout.
+func (c *Client) dialAddr(ctx context.Context, addr string) (net.Conn, error) {
+	if c.known == nil {
+		return c.dialPin(ctx, addr, nil)
+	}
+
+	return c.dialPin(ctx, addr, func(fingerprint string) error {
+		return c.known.Verify(c.addr, fingerprint)
+	})
+}
+
+// dialPin is dialAddr with pin deciding whether the certificate is
+// trusted, a nil pin disables TLS.
+func (c *Client) dialPin(ctx context.Context, addr string, pin func(fingerprint string) error) (net.Conn, error) {
+	dial := c.dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	dctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	raw, err := dial(dctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if err := raw.SetDeadline(time.Now().Add(dialTimeout)); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if pin == nil {
+		return raw, nil
+	}
+
+	var pinErr error
+	conn := tls.Client(raw, &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		// The self-signed certificate is verified by its pinned
+		// fingerprint instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("Server sent no certificate")
+			}
+			pinErr = pin(protocol.CertificateFingerprint(raw[0]))
+			return pinErr
+		},
+	})
+
+	stop := closeOnDone(ctx, raw)
+	err = conn.Handshake()
+	stop()
+	if pinErr != nil {
+		raw.Close()
+		return nil, pinErr
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
@@ -1,42 +1,46 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/frizinak/inbetween-go-homecam/client"
 	"github.com/frizinak/inbetween-go-homecam/config"
+	"github.com/frizinak/inbetween-go-homecam/device"
+	"github.com/frizinak/inbetween-go-homecam/discovery"
+	"github.com/frizinak/inbetween-go-homecam/totp"
 	"github.com/frizinak/inbetween-go-homecam/view"
 )
 
+const (
+	// browseTimeout is how long to wait for servers on the LAN to answer.
+	browseTimeout = time.Second
+	// verifyTimeout bounds verifying a server found on the LAN is ours.
+	verifyTimeout = time.Second * 5
+)
+
 func main() {
 	genPass := flag.Bool("p", false, "Generate touch password")
+	name := flag.String("n", "", "Device name used when enrolling, defaults to the hostname")
+	profileName := flag.String("profile", "", "Name of the server profile to connect to")
+	setup := flag.Bool("setup", false, "Add or change a server profile")
+	pairURI := flag.String("pair", "", "Import a homecam:// pairing URI as a server profile")
+	httpAddr := flag.String("http", "", "Also serve the stream as MJPEG over HTTP on this local port or address, e.g. 8081")
 	flag.Parse()
 
-	conf := config.Config{
-		Address:  address,
-		Password: password,
-	}
-
 	l := log.New(os.Stderr, "", 0)
-	passChan := make(chan []byte)
 	pass2Chan := make(chan []byte)
 
 	statusChan := make(chan string, 1)
-	v := view.New(l, pass2Chan, statusChan, touchPassLen)
+	v := view.New(l, pass2Chan, statusChan, defaultProfile().TouchPasswordLength)
 	tickIn := make(chan view.Reader)
-	tickOut := make(chan *client.Data)
-
-	go func() {
-		for {
-			tickIn <- <-tickOut
-		}
-	}()
-
-	c, info := client.New(l, conf.Address, passChan)
 
 	if *genPass {
 		go func() {
@@ -62,6 +66,308 @@ func main() {
 		v.Start(tickIn)
 	}
 
+	dir, err := config.ClientDir()
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "client.json")
+	conf, err := config.LoadClientConfig(file)
+	if err != nil {
+		l.Fatal(err)
+	}
+	if len(conf.Profiles) == 0 && address != "" {
+		conf.Set(defaultProfile())
+	}
+
+	var profile *config.Profile
+	if *pairURI != "" {
+		p, err := pairProfile(l, dir, conf, file, *pairURI, deviceName(*name))
+		if err != nil {
+			l.Fatal(err)
+		}
+		profile = &p
+	}
+
+	switch {
+	case profile != nil:
+	case *setup || len(conf.Profiles) == 0:
+	case *profileName != "":
+		if profile = conf.Profile(*profileName); profile == nil {
+			l.Fatalf("No profile named '%s' in %s", *profileName, file)
+		}
+	case len(conf.Profiles) == 1:
+		profile = &conf.Profiles[0]
+	}
+
+	var proxy *client.Proxy
+	if *httpAddr != "" {
+		if _, err := client.ProxyAddress(*httpAddr); err != nil {
+			l.Fatal(err)
+		}
+		proxy = client.NewProxy(l)
+		go func() {
+			if err := proxy.ListenAndServe(*httpAddr); err != nil {
+				l.Fatal(err)
+			}
+		}()
+	}
+
+	if profile != nil {
+		connect(l, v, dir, *profile, *name, statusChan, pass2Chan, tickIn, proxy)
+		v.Start(tickIn)
+		return
+	}
+
+	go func() {
+		p := chooseProfile(l, v, dir, conf, file, *setup, deviceName(*name), statusChan)
+		connect(l, v, dir, p, *name, statusChan, pass2Chan, tickIn, proxy)
+	}()
+	v.Start(tickIn)
+}
+
+// useTLS enables TLS for the compiled-in default profile. It is not part
+// of credentials.go as existing ones would no longer compile, set it from
+// an init func there instead.
+var useTLS bool
+
+// defaultProfile is built from the compiled-in credentials.
+func defaultProfile() config.Profile {
+	p := config.Profile{
+		Name:                "default",
+		Address:             address,
+		Password:            password,
+		TouchPasswordLength: touchPassLen,
+		TLS:                 useTLS,
+	}
+	if p.TouchPasswordLength == 0 {
+		p.TouchPasswordLength = 5
+	}
+	return p
+}
+
+// chooseProfile lets the user pick one of the profiles, add a new one or
+// import a pairing URI.
+func chooseProfile(
+	l *log.Logger,
+	v *view.View,
+	dir string,
+	conf *config.ClientConfig,
+	file string,
+	setup bool,
+	name string,
+	statusChan chan<- string,
+) config.Profile {
+	if setup {
+		return setupProfile(l, v, conf, file, defaultProfile(), statusChan)
+	}
+
+	found := discovered(l, conf)
+	fields := make([]view.Field, 0, len(conf.Profiles)+len(found)+2)
+	for _, p := range conf.Profiles {
+		fields = append(fields, view.Field{Label: p.Name, Kind: view.FieldButton})
+	}
+	for _, s := range found {
+		fields = append(fields, view.Field{Label: s.Instance + " (LAN)", Kind: view.FieldButton})
+	}
+	fields = append(
+		fields,
+		view.Field{Label: "New profile", Kind: view.FieldButton},
+		view.Field{Label: "Pair with URI", Kind: view.FieldButton},
+	)
+
+	results := make(chan view.FormResult)
+	v.RequestForm(fields, results)
+	r := <-results
+	if r.Button >= len(conf.Profiles) && r.Button < len(conf.Profiles)+len(found) {
+		s := found[r.Button-len(conf.Profiles)]
+		p := defaultProfile()
+		p.Name, p.Address, p.Password, p.ServerID = s.Instance, s.Address, "", s.ID
+		return setupProfile(l, v, conf, file, p, statusChan)
+	}
+
+	switch r.Button - len(conf.Profiles) - len(found) {
+	case 0:
+		p := defaultProfile()
+		p.Name = ""
+		return setupProfile(l, v, conf, file, p, statusChan)
+	case 1:
+		for {
+			v.RequestForm(
+				[]view.Field{
+					{Label: "URI", Kind: view.FieldText},
+					{Label: "Pair", Kind: view.FieldButton},
+				},
+				results,
+			)
+
+			uri := (<-results).Fields[0].Value
+			p, err := pairProfile(l, dir, conf, file, uri, name)
+			if err == nil {
+				return p
+			}
+			statusChan <- err.Error()
+		}
+	}
+
+	return conf.Profiles[r.Button]
+}
+
+// pairProfile enrolls this device with the server in a pairing URI and
+// saves it as a profile.
+func pairProfile(
+	l *log.Logger,
+	dir string,
+	conf *config.ClientConfig,
+	file string,
+	uri string,
+	name string,
+) (config.Profile, error) {
+	u, err := device.ParsePairingURI(strings.TrimSpace(uri))
+	if err != nil {
+		return config.Profile{}, err
+	}
+
+	p := config.Profile{
+		Name:                u.Name,
+		Address:             u.Address,
+		TouchPasswordLength: defaultProfile().TouchPasswordLength,
+		TLS:                 u.TLS != "",
+		ServerID:            device.Fingerprint(u.ServerKey),
+	}
+
+	c, _ := client.New(l, []string{p.Address}, nil)
+	if p.TLS {
+		known := client.NewKnownHosts(filepath.Join(dir, "known_hosts.json"))
+		if err := known.Verify(p.Address, u.TLS); err != nil {
+			return p, err
+		}
+		c.UseTLS(known)
+	}
+
+	identity, err := c.Pair(u.Token, u.ServerKey, name, time.Second*15)
+	if err != nil {
+		return p, err
+	}
+
+	if err := device.SaveIdentity(filepath.Join(dir, "identity.json"), p.Address, identity); err != nil {
+		return p, err
+	}
+
+	conf.Set(p)
+	if err := config.SaveClientConfig(file, conf); err != nil {
+		return p, err
+	}
+
+	l.Printf("Paired with %s as '%s' (%s)", p.Address, name, identity.Fingerprint())
+	return p, nil
+}
+
+// setupProfile shows the setup screen until a valid profile was entered
+// and saves it.
+func setupProfile(
+	l *log.Logger,
+	v *view.View,
+	conf *config.ClientConfig,
+	file string,
+	p config.Profile,
+	statusChan chan<- string,
+) config.Profile {
+	results := make(chan view.FormResult)
+	for {
+		tls := view.No
+		if p.TLS {
+			tls = view.Yes
+		}
+
+		v.RequestForm(
+			[]view.Field{
+				{Label: "Name", Value: p.Name, Kind: view.FieldText},
+				{Label: "Address", Value: p.Address, Kind: view.FieldText},
+				{Label: "Other addresses", Value: strings.Join(p.Addresses, ","), Kind: view.FieldText},
+				{Label: "Password", Value: p.Password, Kind: view.FieldSecret},
+				{Label: "Touch password length", Value: strconv.Itoa(p.TouchPasswordLength), Kind: view.FieldNumber},
+				{Label: "TLS", Value: tls, Kind: view.FieldToggle},
+				{Label: "Save", Kind: view.FieldButton},
+			},
+			results,
+		)
+
+		f := (<-results).Fields
+		p.Name = f[0].Value
+		p.Address = f[1].Value
+		p.Addresses = nil
+		for _, addr := range strings.Split(f[2].Value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				p.Addresses = append(p.Addresses, addr)
+			}
+		}
+		p.Password = f[3].Value
+		p.TouchPasswordLength, _ = strconv.Atoi(f[4].Value)
+		p.TLS = f[5].Value == view.Yes
+
+		if err := p.Validate(); err != nil {
+			statusChan <- err.Error()
+			continue
+		}
+
+		conf.Set(p)
+		if err := config.SaveClientConfig(file, conf); err != nil {
+			l.Println(err)
+		}
+		return p
+	}
+}
+
+// connect starts the client for profile p.
+func connect(
+	l *log.Logger,
+	v *view.View,
+	dir string,
+	p config.Profile,
+	name string,
+	statusChan chan string,
+	pass2Chan <-chan []byte,
+	tickIn chan<- view.Reader,
+	proxy *client.Proxy,
+) {
+	passChan := make(chan []byte)
+	tickOut := make(chan *client.Data)
+	frames := make(chan struct{}, 1)
+	v.SetPassLength(p.TouchPasswordLength)
+
+	go func() {
+		for {
+			d := <-tickOut
+			select {
+			case frames <- struct{}{}:
+			default:
+			}
+			if proxy != nil {
+				proxy.Frame(d)
+			}
+			tickIn <- d
+		}
+	}()
+
+	c, info := client.New(l, p.AllAddresses(), passChan)
+
+	if p.TLS {
+		c.UseTLS(client.NewKnownHosts(filepath.Join(dir, "known_hosts.json")))
+	}
+
+	idFile := filepath.Join(dir, "identity.json")
+	identity, err := device.LoadIdentity(idFile, p.Address)
+	if err != nil {
+		l.Println(err)
+	}
+	if identity != nil {
+		c.SetIdentity(identity)
+		v.SkipPass()
+	}
+
+	go enroll(l, c, idFile, p.Address, deviceName(name), frames)
+
 	go func() {
 		var str string
 		var last string
@@ -75,6 +381,28 @@ func main() {
 				str = "Reconnecting..."
 			case client.InfoError:
 				str = "Something went wrong!"
+				if err := c.LastError(); err != nil {
+					str = err.Reason()
+				}
+			case client.InfoUpgradeRequired:
+				str = "Upgrade required"
+			case client.InfoTOTPRequired:
+				str = "Enter one-time password"
+				v.RequestCode(totp.Digits, c.TOTP())
+			case client.InfoTOTPFail:
+				str = "Wrong one-time password"
+				v.RequestCode(totp.Digits, c.TOTP())
+			case client.InfoCertificateChanged:
+				str = "Server certificate changed!"
+			case client.InfoDeviceDenied:
+				str = "Device not enrolled"
+				if err := device.SaveIdentity(idFile, p.Address, nil); err != nil {
+					l.Println(err)
+				}
+				go func() {
+					time.Sleep(time.Second * 1)
+					v.ClearPass()
+				}()
 			case client.InfoHandshakeFail:
 				str = "Wrong password"
 				go func() {
@@ -91,14 +419,123 @@ func main() {
 	}()
 
 	go func() {
-		for p := range pass2Chan {
-			passChan <- append([]byte(conf.Password), p...)
+		for msg := range c.Status() {
+			if msg == "" {
+				msg = "Connected"
+			}
+			statusChan <- msg
 		}
 	}()
 
 	go func() {
-		l.Fatal(c.Connect(tickOut))
+		for touch := range pass2Chan {
+			passChan <- append([]byte(p.Password), touch...)
+		}
 	}()
 
-	v.Start(tickIn)
+	serverID := p.ServerID
+	if identity != nil && len(identity.ServerKey) != 0 {
+		serverID = device.Fingerprint(identity.ServerKey)
+	}
+
+	go func() {
+		if lan := lanAddress(l, serverID); lan != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+			err := c.VerifyAddress(ctx, lan)
+			cancel()
+			if err != nil {
+				l.Printf("Not using %s found on the LAN for %s: %s", lan, p.Name, err)
+			} else {
+				l.Printf("Found %s on the LAN at %s", p.Name, lan)
+				c.PreferAddress(lan)
+			}
+		}
+
+		if err := c.Connect(tickOut); err != nil {
+			l.Println(err)
+		}
+	}()
+}
+
+// discovered returns the servers on the LAN that are not a profile yet.
+func discovered(l *log.Logger, conf *config.ClientConfig) []discovery.Service {
+	services, err := discovery.Browse("", browseTimeout)
+	if err != nil {
+		l.Printf("LAN discovery failed: %s", err)
+	}
+
+	list := make([]discovery.Service, 0, len(services))
+outer:
+	for _, s := range services {
+		for _, p := range conf.Profiles {
+			if s.ID != "" && p.ServerID == s.ID {
+				continue outer
+			}
+			for _, addr := range p.AllAddresses() {
+				if addr == s.Address {
+					continue outer
+				}
+			}
+		}
+		list = append(list, s)
+	}
+
+	return list
+}
+
+// lanAddress returns the LAN address of the server with the given id if it
+// is advertised on the local network, i.e. we are at home. The id is not a
+// secret, the address must pass Client.VerifyAddress before it is used.
+func lanAddress(l *log.Logger, id string) string {
+	if id == "" {
+		return ""
+	}
+
+	services, err := discovery.Browse("", browseTimeout)
+	if err != nil {
+		l.Printf("LAN discovery failed: %s", err)
+	}
+	for _, s := range services {
+		if s.ID == id {
+			return s.Address
+		}
+	}
+
+	return ""
+}
+
+// enroll enrolls this device once streaming with the password started so
+// later sessions can skip the touch password.
+func enroll(l *log.Logger, c *client.Client, file, addr, name string, frames <-chan struct{}) {
+
+	for range frames {
+		if c.Identity() != nil {
+			continue
+		}
+
+		identity, err := c.Enroll(name, time.Second*10)
+		if err != nil {
+			l.Printf("Enrolling device failed: %s", err)
+			return
+		}
+
+		if err := device.SaveIdentity(file, addr, identity); err != nil {
+			l.Println(err)
+			return
+		}
+		l.Printf("Enrolled as '%s' (%s)", name, identity.Fingerprint())
+	}
+}
+
+// deviceName defaults to the hostname.
+func deviceName(name string) string {
+	if name != "" {
+		return name
+	}
+
+	name, err := os.Hostname()
+	if err != nil {
+		return "homecam-client"
+	}
+	return name
 }
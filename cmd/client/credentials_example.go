@@ -2,11 +2,15 @@
 
 // Rename this file to credentials.go
 // remove '!' from build tag above
-// fill in your passphrase and address
+// fill in your passphrase and address to compile in a default profile,
+// leave address empty to set up profiles on first run instead.
 package main
 
 var (
-	password     = "example"
-	address      = "127.0.0.1:1234"
+	password     = ""
+	address      = ""
 	touchPassLen = 5
 )
+
+// Uncomment to connect to the default profile over TLS.
+// func init() { useTLS = true }
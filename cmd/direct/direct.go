@@ -1,49 +1,58 @@
 package main
 
 import (
-	"bytes"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"time"
 
-	"github.com/frizinak/inbetween-go-homecam/client"
+	"github.com/frizinak/inbetween-go-homecam/config"
 	"github.com/frizinak/inbetween-go-homecam/server"
 	"github.com/frizinak/inbetween-go-homecam/view"
 )
 
+type frame struct {
+	*server.Frame
+}
+
+func (f frame) Created() time.Time { return f.Captured }
+
 func main() {
 	go http.ListenAndServe(":8080", nil)
 	l := log.New(os.Stderr, "", 0)
 
-	qual := server.QualityConfig{
+	qual := config.Quality{
 		MinFPS: 8,
 		MaxFPS: 16,
 
 		MinJPEGQuality: 30,
 		MaxJPEGQuality: 100,
 
-		MinResolution: 0,
-		MaxResolution: 64000 * 48000,
+		MinWidth:  0,
+		MinHeight: 0,
+		MaxWidth:  64000,
+		MaxHeight: 48000,
 
-		DesiredTotalThroughput:  1e16,
-		DesiredClientThroughput: 1e16,
+		MaxKilobytesPerSecond:          1e13,
+		MaxKilobytesPerSecondPerClient: 1e13,
 	}
 
-	s := server.New(l, "", []byte{}, "/dev/video0", qual, 100)
+	s := server.NewServer(server.Options{
+		Logger:  l,
+		Device:  "/dev/video0",
+		Quality: qual,
+	})
 	output, errs := s.Start()
-	tick := make(chan *client.Data)
-	var img *bytes.Buffer
+	tick := make(chan view.Reader)
 	go func() {
 		for {
 			select {
 			case err := <-errs:
-				panic(err)
-			case b := <-output:
-				img = b
+				l.Println(err)
+			case f := <-output:
 				select {
-				case tick <- &client.Data{Buffer: b, Created: time.Now()}:
+				case tick <- frame{f}:
 				default:
 				}
 			}
@@ -51,6 +60,7 @@ func main() {
 
 	}()
 
-	v := view.New(l)
+	v := view.New(l, nil, nil, 0)
+	v.SkipPass()
 	v.Start(tick)
 }
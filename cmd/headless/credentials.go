@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/frizinak/inbetween-go-homecam/config"
+	"github.com/frizinak/inbetween-go-homecam/prompt"
+)
+
+// credentials uses the profile's password and the touch password given on
+// the command line, or prompts for the latter.
+type credentials struct {
+	p     *prompt.Prompt
+	pass  string
+	touch config.TouchPassword
+	// fixed is set if touch was given on the command line, there is no
+	// point in retrying it.
+	fixed bool
+}
+
+func (c *credentials) Password(ctx context.Context, denied bool) ([]byte, error) {
+	if denied && c.fixed {
+		return nil, errors.New("Wrong password or touch password")
+	}
+
+	if c.touch == nil || denied {
+		touch, err := c.p.Touch("Touch password")
+		if err != nil {
+			return nil, err
+		}
+		c.touch = touch
+	}
+
+	return append([]byte(c.pass), c.touch...), nil
+}
+
+func (c *credentials) TOTP(ctx context.Context, failed bool) (string, error) {
+	if failed {
+		fmt.Fprintln(os.Stderr, "Wrong one-time password")
+	}
+	return c.p.Line("One-time password", "")
+}
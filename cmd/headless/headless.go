@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/client"
+	"github.com/frizinak/inbetween-go-homecam/config"
+	"github.com/frizinak/inbetween-go-homecam/device"
+	"github.com/frizinak/inbetween-go-homecam/prompt"
+)
+
+// snapshotTimeout bounds the snapshot command unless -timeout is given.
+const snapshotTimeout = time.Second * 30
+
+// defaultProxy is where the proxy command serves unless -http is given.
+const defaultProxy = "8081"
+
+// errDone stops Run once a command has all the frames it needs.
+var errDone = errors.New("Done")
+
+func main() {
+	profileName := flag.String("profile", "", "Name of the server profile to connect to")
+	touch := flag.String("touch", "", "Touch password as arrows (↑↓→←↖↗↙↘) or keypad digits, prompted for if needed and omitted")
+	count := flag.Int("n", 0, "Stop after this many frames, 0 for no limit")
+	timeout := flag.Duration("timeout", 0, "Give up after this long, 0 for no limit (snapshot defaults to 30s)")
+	verbose := flag.Bool("v", false, "Log connection state changes")
+	httpAddr := flag.String("http", "", "Also serve the stream as MJPEG over HTTP on this local port or address, e.g. 8081")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] command\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), `Commands:
+  snapshot [file]   save a single frame to file and exit (default snapshot.jpg, - for stdout)
+  frames [dir]      save every frame as a timestamped jpeg in dir (default .)
+  mjpeg             write frames to stdout as MJPEG, e.g. | ffmpeg -f mjpeg -i - out.mp4
+  proxy             only serve the stream over HTTP, see -http (default 127.0.0.1:8081)
+
+Flags:`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	l := log.New(os.Stderr, "", 0)
+	p := prompt.New(os.Stdin, os.Stderr)
+
+	var handle func(*client.Data) error
+	var name string
+	args := flag.Args()
+	arg := func(def string) string {
+		if len(args) > 1 {
+			return args[1]
+		}
+		return def
+	}
+	if len(args) != 0 {
+		name = args[0]
+	}
+	switch name {
+	case "snapshot":
+		handle = snapshot(arg("snapshot.jpg"))
+		*count = 1
+		if *timeout == 0 {
+			*timeout = snapshotTimeout
+		}
+	case "frames":
+		handle = frames(arg("."))
+	case "mjpeg":
+		handle = mjpeg()
+	case "proxy":
+		handle = func(*client.Data) error { return nil }
+		if *httpAddr == "" {
+			*httpAddr = defaultProxy
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	handle = limit(handle, *count)
+
+	if *httpAddr != "" {
+		if _, err := client.ProxyAddress(*httpAddr); err != nil {
+			l.Fatal(err)
+		}
+		proxy := client.NewProxy(l)
+		defer proxy.Close()
+		go func() {
+			if err := proxy.ListenAndServe(*httpAddr); err != http.ErrServerClosed {
+				l.Fatal(err)
+			}
+		}()
+
+		fn := handle
+		handle = func(d *client.Data) error {
+			proxy.Frame(d)
+			return fn(d)
+		}
+	}
+
+	dir, err := config.ClientDir()
+	if err != nil {
+		l.Fatal(err)
+	}
+	file := filepath.Join(dir, "client.json")
+	conf, err := config.LoadClientConfig(file)
+	if err != nil {
+		l.Fatal(err)
+	}
+	profile, err := chooseProfile(conf, file, *profileName)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	creds := &credentials{p: p, pass: profile.Password}
+	if *touch != "" {
+		if creds.touch, err = prompt.ParseTouch(*touch); err != nil {
+			l.Fatal(err)
+		}
+		creds.fixed = true
+	}
+
+	o := client.Options{
+		Addresses:   profile.AllAddresses(),
+		Credentials: creds,
+		Logger:      log.New(ioutil.Discard, "", 0),
+	}
+	if *verbose {
+		o.Logger = l
+	}
+	if profile.TLS {
+		o.KnownHosts = client.NewKnownHosts(filepath.Join(dir, "known_hosts.json"))
+	}
+	identity, err := device.LoadIdentity(filepath.Join(dir, "identity.json"), profile.Address)
+	if err != nil {
+		l.Println(err)
+	}
+	o.Identity = identity
+
+	var c *client.Client
+	o.OnInfo = func(i client.Info) {
+		switch i {
+		case client.InfoConnected:
+			if *verbose {
+				l.Printf("Connected to %s", c.Address())
+			}
+		case client.InfoReconnecting:
+			if *verbose {
+				l.Println("Reconnecting...")
+			}
+		case client.InfoError:
+			if err := c.LastError(); err != nil {
+				l.Println(err.Reason())
+			}
+		case client.InfoHandshakeFail:
+			l.Println("Wrong password")
+		case client.InfoDeviceDenied:
+			l.Println("Device not enrolled, using the password")
+		}
+	}
+	o.OnStatus = func(msg string) {
+		if msg != "" {
+			l.Println(msg)
+		}
+	}
+
+	if c, err = client.NewClient(o); err != nil {
+		l.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *timeout != 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	err = c.Run(ctx, handle)
+	switch {
+	case err == errDone:
+	case err == context.Canceled:
+	case err == context.DeadlineExceeded:
+		if name == "snapshot" {
+			l.Fatalf("No frame within %s", *timeout)
+		}
+	default:
+		l.Fatal(err)
+	}
+}
+
+// chooseProfile returns the named profile or the only one if name is empty.
+func chooseProfile(conf *config.ClientConfig, file, name string) (config.Profile, error) {
+	if name != "" {
+		if p := conf.Profile(name); p != nil {
+			return *p, nil
+		}
+		return config.Profile{}, fmt.Errorf("No profile named '%s' in %s", name, file)
+	}
+
+	switch len(conf.Profiles) {
+	case 0:
+		return config.Profile{}, fmt.Errorf("No profiles in %s, run the desktop client with -setup or -pair first", file)
+	case 1:
+		return conf.Profiles[0], nil
+	}
+
+	names := make([]string, len(conf.Profiles))
+	for i := range conf.Profiles {
+		names[i] = conf.Profiles[i].Name
+	}
+	return config.Profile{}, fmt.Errorf("Choose a profile with -profile: %s", strings.Join(names, ", "))
+}
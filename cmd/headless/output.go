@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/frizinak/inbetween-go-homecam/client"
+)
+
+// snapshot writes the frame to file, or stdout if file is -.
+func snapshot(file string) func(*client.Data) error {
+	return func(d *client.Data) error {
+		if file == "-" {
+			_, err := os.Stdout.Write(d.Bytes())
+			return err
+		}
+
+		tmp := file + ".tmp"
+		if err := ioutil.WriteFile(tmp, d.Bytes(), 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmp, file)
+	}
+}
+
+// frames writes each frame to dir, named after the time it was captured.
+func frames(dir string) func(*client.Data) error {
+	return func(d *client.Data) error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		name := d.Created().Format("20060102-150405.000") + ".jpg"
+		return ioutil.WriteFile(filepath.Join(dir, name), d.Bytes(), 0644)
+	}
+}
+
+// mjpeg writes the frames back to back to stdout, which is what ffmpeg and
+// most players expect from a raw MJPEG stream.
+func mjpeg() func(*client.Data) error {
+	return func(d *client.Data) error {
+		_, err := os.Stdout.Write(d.Bytes())
+		return err
+	}
+}
+
+// limit makes fn return errDone after n frames, n = 0 means no limit.
+func limit(fn func(*client.Data) error, n int) func(*client.Data) error {
+	if n <= 0 {
+		return fn
+	}
+
+	var i int
+	return func(d *client.Data) error {
+		if err := fn(d); err != nil {
+			return err
+		}
+		if i++; i >= n {
+			return errDone
+		}
+		return nil
+	}
+}
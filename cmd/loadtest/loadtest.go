@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/client"
+	"github.com/frizinak/inbetween-go-homecam/config"
+	"github.com/frizinak/inbetween-go-homecam/prompt"
+	"github.com/frizinak/inbetween-go-homecam/shape"
+)
+
+func main() {
+	addr := flag.String("addr", "", "Server address, defaults to that of -profile")
+	profileName := flag.String("profile", "", "Take the address, password and TLS setting from this client profile")
+	password := flag.String("password", "", "Password, defaults to that of -profile")
+	touch := flag.String("touch", "", "Touch password as arrows (↑↓→←↖↗↙↘) or keypad digits")
+	useTLS := flag.Bool("tls", false, "Connect over TLS, pinning the certificate in the client's known hosts")
+	n := flag.Int("n", 10, "Number of concurrent sessions")
+	duration := flag.Duration("duration", time.Second*30, "How long to run")
+	ramp := flag.Duration("ramp", time.Millisecond*100, "Delay between starting sessions")
+	think := flag.Duration("think", 0, "Time each session spends per frame before reading the next, simulating slow viewers")
+	bandwidth := flag.Int("bandwidth", 0, "Per session bandwidth cap in KiB/s, 0 for no cap")
+	out := flag.String("o", "loadtest.json", "Write the summary JSON to this file, - to skip")
+	flag.Parse()
+
+	l := log.New(os.Stderr, "", 0)
+	if *n < 1 {
+		l.Fatal("-n must be at least 1")
+	}
+
+	dir, err := config.ClientDir()
+	if err != nil {
+		l.Fatal(err)
+	}
+	if *profileName != "" {
+		conf, err := config.LoadClientConfig(filepath.Join(dir, "client.json"))
+		if err != nil {
+			l.Fatal(err)
+		}
+		p := conf.Profile(*profileName)
+		if p == nil {
+			l.Fatalf("No profile named '%s'", *profileName)
+		}
+		if *addr == "" {
+			*addr = p.Address
+		}
+		if *password == "" {
+			*password = p.Password
+		}
+		*useTLS = *useTLS || p.TLS
+	}
+	if *addr == "" {
+		l.Fatal("Pass -addr or -profile")
+	}
+
+	pass := []byte(*password)
+	if *touch != "" {
+		t, err := prompt.ParseTouch(*touch)
+		if err != nil {
+			l.Fatal(err)
+		}
+		pass = append(pass, t...)
+	}
+
+	o := client.Options{
+		Addresses:   []string{*addr},
+		Credentials: client.Password(pass),
+	}
+	if *useTLS {
+		o.KnownHosts = client.NewKnownHosts(filepath.Join(dir, "known_hosts.json"))
+	}
+	if *bandwidth > 0 {
+		o.Dial = shape.Dialer(shape.Link{Bandwidth: *bandwidth * 1024})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-quit
+		l.Println("Stopping early")
+		cancel()
+	}()
+
+	sum := Summary{
+		Started:   time.Now(),
+		Address:   *addr,
+		Sessions:  *n,
+		Duration:  duration.String(),
+		Ramp:      ramp.String(),
+		Think:     think.String(),
+		Bandwidth: *bandwidth,
+	}
+
+	l.Printf("Starting %d sessions against %s for %s", *n, *addr, *duration)
+	sessions := make([]*session, 0, *n)
+	var wg sync.WaitGroup
+	for i := 0; i < *n && ctx.Err() == nil; i++ {
+		s, err := newSession(i+1, o)
+		if err != nil {
+			l.Fatal(err)
+		}
+		sessions = append(sessions, s)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.run(ctx, *think)
+		}()
+
+		select {
+		case <-time.After(*ramp):
+		case <-ctx.Done():
+		}
+	}
+	wg.Wait()
+
+	sum = summarize(sum, sessions)
+	sum.print(os.Stdout)
+	if *out != "-" {
+		if err := sum.save(*out); err != nil {
+			l.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "\nSummary written to %s\n", *out)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Percentiles in milliseconds.
+type Percentiles struct {
+	P50 float64
+	P90 float64
+	P99 float64
+	Max float64
+}
+
+func percentiles(d []time.Duration) Percentiles {
+	if len(d) == 0 {
+		return Percentiles{}
+	}
+
+	sorted := append([]time.Duration{}, d...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) float64 {
+		i := int(p*float64(len(sorted))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		return ms(sorted[i])
+	}
+
+	return Percentiles{at(0.5), at(0.9), at(0.99), ms(sorted[len(sorted)-1])}
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+type SessionReport struct {
+	ID     int
+	Frames int
+	Bytes  uint64
+	// FPS is the number of frames per second while connected.
+	FPS float64
+	// Connected is the time spent connected in seconds.
+	Connected  float64
+	Latency    Percentiles
+	Handshake  Percentiles
+	Handshakes int
+	// Width, Height and Quality of the last frame.
+	Width   uint32
+	Height  uint32
+	Quality uint8
+	Errors  map[string]int `json:",omitempty"`
+}
+
+type Summary struct {
+	Started   time.Time
+	Address   string
+	Sessions  int
+	Duration  string
+	Ramp      string
+	Think     string
+	Bandwidth int `json:"BandwidthKilobytesPerSecond"`
+
+	Frames int
+	Bytes  uint64
+	// FPS is the mean of the sessions' FPS.
+	FPS       float64
+	Latency   Percentiles
+	Handshake Percentiles
+	Errors    map[string]int
+
+	PerSession []SessionReport
+}
+
+func (s *session) report() SessionReport {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+
+	r := SessionReport{
+		ID:         s.id,
+		Frames:     s.frames,
+		Bytes:      s.bytes,
+		Connected:  s.connected.Seconds(),
+		Latency:    percentiles(s.latencies),
+		Handshake:  percentiles(s.handshakes),
+		Handshakes: len(s.handshakes),
+		Width:      s.meta.Width,
+		Height:     s.meta.Height,
+		Quality:    s.meta.Quality,
+		Errors:     s.errors,
+	}
+	if r.Connected > 0 {
+		r.FPS = float64(s.frames) / r.Connected
+	}
+
+	return r
+}
+
+func summarize(sum Summary, sessions []*session) Summary {
+	var latencies, handshakes []time.Duration
+	sum.Errors = make(map[string]int)
+	for _, s := range sessions {
+		r := s.report()
+		sum.PerSession = append(sum.PerSession, r)
+		sum.Frames += r.Frames
+		sum.Bytes += r.Bytes
+		sum.FPS += r.FPS / float64(len(sessions))
+		for k, v := range r.Errors {
+			sum.Errors[k] += v
+		}
+
+		s.sem.Lock()
+		latencies = append(latencies, s.latencies...)
+		handshakes = append(handshakes, s.handshakes...)
+		s.sem.Unlock()
+	}
+	sum.Latency = percentiles(latencies)
+	sum.Handshake = percentiles(handshakes)
+
+	return sum
+}
+
+func (sum Summary) print(w io.Writer) {
+	t := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(t, "session\tframes\tfps\tKiB\tlatency p50\tp90\tp99\thandshake p50\tmax\tsize\tquality\terrors\t")
+	row := func(name string, frames int, fps float64, bytes uint64, l, h Percentiles, size, quality string, errs map[string]int) {
+		var n int
+		for _, v := range errs {
+			n += v
+		}
+		fmt.Fprintf(
+			t,
+			"%s\t%d\t%.1f\t%d\t%.0fms\t%.0fms\t%.0fms\t%.0fms\t%.0fms\t%s\t%s\t%d\t\n",
+			name, frames, fps, bytes/1024, l.P50, l.P90, l.P99, h.P50, h.Max, size, quality, n,
+		)
+	}
+
+	for _, r := range sum.PerSession {
+		size := fmt.Sprintf("%dx%d", r.Width, r.Height)
+		row(fmt.Sprint(r.ID), r.Frames, r.FPS, r.Bytes, r.Latency, r.Handshake, size, fmt.Sprint(r.Quality), r.Errors)
+	}
+	row("all", sum.Frames, sum.FPS, sum.Bytes, sum.Latency, sum.Handshake, "", "", sum.Errors)
+	t.Flush()
+
+	if len(sum.Errors) != 0 {
+		fmt.Fprintln(w, "\nErrors:")
+		for k, v := range sum.Errors {
+			fmt.Fprintf(w, "  %4d  %s\n", v, k)
+		}
+	}
+}
+
+func (sum Summary) save(file string) error {
+	d, err := json.MarshalIndent(sum, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, d, 0644)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/client"
+	"github.com/frizinak/inbetween-go-homecam/protocol"
+)
+
+// session is a single client and what it measured.
+type session struct {
+	id int
+	c  *client.Client
+
+	sem        sync.Mutex
+	frames     int
+	bytes      uint64
+	latencies  []time.Duration
+	handshakes []time.Duration
+	errors     map[string]int
+	meta       protocol.FrameMeta
+
+	connecting  time.Time
+	connectedAt time.Time
+	connected   time.Duration
+}
+
+func newSession(id int, o client.Options) (*session, error) {
+	s := &session{id: id, errors: make(map[string]int)}
+	o.OnInfo = s.info
+	c, err := client.NewClient(o)
+	s.c = c
+	return s, err
+}
+
+func (s *session) info(i client.Info) {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	now := time.Now()
+
+	switch i {
+	case client.InfoConnecting:
+		s.connecting = now
+	case client.InfoConnected:
+		s.handshakes = append(s.handshakes, now.Sub(s.connecting))
+		s.connectedAt = now
+	case client.InfoError, client.InfoHandshakeFail, client.InfoUpgradeRequired, client.InfoCertificateChanged:
+		reason := "Wrong password"
+		switch i {
+		case client.InfoUpgradeRequired:
+			reason = "Upgrade required"
+		case client.InfoCertificateChanged:
+			reason = "Server certificate changed"
+		case client.InfoError:
+			reason = "Unknown error"
+			if err := s.c.LastError(); err != nil {
+				reason = err.Reason()
+			}
+		}
+		s.errors[reason]++
+		fallthrough
+	case client.InfoReconnecting:
+		s.disconnected(now)
+	}
+}
+
+// disconnected must be called with s.sem held.
+func (s *session) disconnected(now time.Time) {
+	if !s.connectedAt.IsZero() {
+		s.connected += now.Sub(s.connectedAt)
+		s.connectedAt = time.Time{}
+	}
+}
+
+func (s *session) frame(d *client.Data) {
+	s.sem.Lock()
+	s.frames++
+	s.bytes += uint64(d.Len())
+	s.latencies = append(s.latencies, d.Latency())
+	s.meta = d.Meta()
+	s.sem.Unlock()
+}
+
+// run streams until ctx is done, spending think on each frame.
+func (s *session) run(ctx context.Context, think time.Duration) {
+	err := s.c.Run(ctx, func(d *client.Data) error {
+		s.frame(d)
+		if think <= 0 {
+			return nil
+		}
+
+		t := time.NewTimer(think)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	s.disconnected(time.Now())
+	if err != nil && ctx.Err() == nil {
+		s.errors[err.Error()]++
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/client"
+	"github.com/frizinak/inbetween-go-homecam/config"
+	"github.com/frizinak/inbetween-go-homecam/server"
+	"github.com/frizinak/inbetween-go-homecam/shape"
+)
+
+// links is a repeatable flag, each link is a phase of the simulation.
+type links []string
+
+func (l *links) String() string { return strings.Join(*l, " ") }
+
+func (l *links) Set(v string) error {
+	if _, err := shape.ParseLink(v); err != nil {
+		return err
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// network shapes every connection the server accepts according to the
+// current phase, so the server's writes block like on a real link.
+type network struct {
+	net.Listener
+
+	sem   sync.Mutex
+	link  shape.Link
+	conns []*shape.Conn
+}
+
+// conn removes itself from the network once the server closed it.
+type conn struct {
+	*shape.Conn
+	n *network
+}
+
+func (c conn) Close() error {
+	c.n.remove(c.Conn)
+	return c.Conn.Close()
+}
+
+func (n *network) Accept() (net.Conn, error) {
+	c, err := n.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	n.sem.Lock()
+	defer n.sem.Unlock()
+	s := shape.New(c, n.link)
+	n.conns = append(n.conns, s)
+	return conn{s, n}, nil
+}
+
+func (n *network) remove(c *shape.Conn) {
+	n.sem.Lock()
+	defer n.sem.Unlock()
+	for i := range n.conns {
+		if n.conns[i] == c {
+			n.conns = append(n.conns[:i], n.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *network) set(l shape.Link) {
+	n.sem.Lock()
+	defer n.sem.Unlock()
+	n.link = l
+	for _, c := range n.conns {
+		c.SetLink(l)
+	}
+}
+
+func main() {
+	var phases links
+	flag.Var(&phases, "link", fmt.Sprintf(
+		"Link to simulate, repeat for consecutive phases. A preset (%s), key=value overrides (bandwidth=64k,latency=100ms,jitter=20ms,stall=10s/1s) or both, e.g. 3g,latency=300ms",
+		strings.Join(shape.PresetNames(), ", "),
+	))
+	phase := flag.Duration("phase", time.Minute, "Duration of each phase")
+	interval := flag.Duration("interval", time.Second, "Sample interval")
+	clients := flag.Int("clients", 1, "Number of clients sharing the link")
+	device := flag.String("device", "", "Capture from this camera instead of generating frames")
+	size := flag.String("size", "1024x768", "Size of the generated frames, the server scales them down as the link requires")
+	configFile := flag.String("config", "", "Take the quality limits from this server config instead of the defaults")
+	out := flag.String("o", "netsim.json", "Write the report JSON to this file, - to skip")
+	verbose := flag.Bool("v", false, "Show everything the server logs, not only quality adjustments")
+	flag.Parse()
+
+	l := log.New(os.Stderr, "", 0)
+	if len(phases) == 0 {
+		phases = links{"3g"}
+	}
+	if *clients < 1 {
+		l.Fatal("-clients must be at least 1")
+	}
+
+	var w, h int
+	if *device == "" {
+		if _, err := fmt.Sscanf(*size, "%dx%d", &w, &h); err != nil || w < 1 || h < 1 {
+			l.Fatalf("Invalid size '%s', expected WIDTHxHEIGHT", *size)
+		}
+	}
+
+	o := server.Options{Device: *device, MaxPeers: *clients}
+	if *configFile != "" {
+		conf, err := config.LoadConfig(*configFile)
+		if err != nil {
+			l.Fatal(err)
+		}
+		o.Quality = conf.Quality
+	}
+
+	o.Password = make([]byte, 32)
+	if _, err := rand.Read(o.Password); err != nil {
+		l.Fatal(err)
+	}
+
+	serverLog := &adjustments{w: os.Stderr, all: *verbose}
+	o.Logger = log.New(serverLog, "server: ", 0)
+	s := server.NewServer(o)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-quit
+		l.Println("Stopping early")
+		cancel()
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		l.Fatal(err)
+	}
+	first, _ := shape.ParseLink(phases[0])
+	netw := &network{Listener: ln, link: first}
+
+	if *device == "" {
+		if err := s.FeedScaled(synthetic(ctx, s, w, h), ladder(w, h)); err != nil {
+			l.Fatal(err)
+		}
+	}
+	go func() {
+		if err := s.Serve(ctx, netw); err != nil && err != context.Canceled && err != server.ErrServerClosed {
+			l.Fatal(err)
+		}
+	}()
+
+	rec := &recorder{}
+	var wg sync.WaitGroup
+	for i := 0; i < *clients; i++ {
+		c, err := client.NewClient(client.Options{
+			Addresses:   []string{ln.Addr().String()},
+			Credentials: client.Password(o.Password),
+		})
+		if err != nil {
+			l.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Run(ctx, func(d *client.Data) error {
+				rec.frame(d)
+				return nil
+			})
+		}()
+	}
+
+	report := Report{
+		Started:  time.Now(),
+		Clients:  *clients,
+		Interval: interval.String(),
+	}
+	printHeader(os.Stdout)
+	t := time.NewTicker(*interval)
+	defer t.Stop()
+
+run:
+	for i, spec := range phases {
+		link, _ := shape.ParseLink(spec)
+		name := spec
+		if _, ok := shape.Presets[spec]; !ok {
+			name = link.String()
+		}
+		report.Phases = append(report.Phases, Phase{Link: name, Duration: phase.String()})
+		netw.set(link)
+		l.Printf("Phase %d: %s (%s)", i+1, name, link)
+
+		end := time.After(*phase)
+		for {
+			select {
+			case <-ctx.Done():
+				break run
+			case <-end:
+				continue run
+			case <-t.C:
+			}
+
+			sample := rec.sample(s.Status(), time.Since(report.Started), *interval)
+			sample.Phase, sample.Link = i, name
+			sample.print(os.Stdout)
+			report.Samples = append(report.Samples, sample)
+		}
+	}
+
+	cancel()
+	wg.Wait()
+	sctx, scancel := context.WithTimeout(context.Background(), time.Second*5)
+	s.Shutdown(sctx)
+	scancel()
+
+	report.summary(os.Stdout)
+	if *out != "-" {
+		if err := report.save(*out); err != nil {
+			l.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "\nReport written to %s\n", *out)
+	}
+}
+
+// adjustments passes on only the quality adjustments the server logs unless
+// all is set.
+type adjustments struct {
+	w   *os.File
+	all bool
+}
+
+func (a *adjustments) Write(p []byte) (int, error) {
+	if a.all || strings.Contains(string(p), "Quality adjustment") {
+		return a.w.Write(p)
+	}
+	return len(p), nil
+}
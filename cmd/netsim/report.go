@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/client"
+	"github.com/frizinak/inbetween-go-homecam/server"
+)
+
+// Sample is the state of the server and what the clients received during
+// one interval.
+type Sample struct {
+	// Time since the start in seconds.
+	Time  float64
+	Phase int
+	Link  string
+
+	// FPS, Quality and the frame size the server settled on.
+	FPS     int
+	Quality int
+	Width   int
+	Height  int
+	// Throughput as measured by the server in KiB/s.
+	Throughput float64
+	// RTT is the worst round trip time seen by the server in milliseconds.
+	RTT float64
+
+	// ReceivedFPS and Received (KiB/s) summed over all clients.
+	ReceivedFPS float64
+	Received    float64
+	// Latency is the mean time from capture to receipt in milliseconds.
+	Latency float64
+}
+
+type Phase struct {
+	Link     string
+	Duration string
+}
+
+type Report struct {
+	Started  time.Time
+	Clients  int
+	Phases   []Phase
+	Interval string
+	Samples  []Sample
+}
+
+// recorder collects the frames received between two samples.
+type recorder struct {
+	sem     sync.Mutex
+	frames  int
+	bytes   int
+	latency time.Duration
+}
+
+func (r *recorder) frame(d *client.Data) {
+	r.sem.Lock()
+	r.frames++
+	r.bytes += d.Len()
+	r.latency += d.Latency()
+	r.sem.Unlock()
+}
+
+func (r *recorder) sample(st server.Status, since time.Duration, interval time.Duration) Sample {
+	r.sem.Lock()
+	frames, bytes, latency := r.frames, r.bytes, r.latency
+	r.frames, r.bytes, r.latency = 0, 0, 0
+	r.sem.Unlock()
+
+	s := Sample{
+		Time:        since.Seconds(),
+		FPS:         st.FPS,
+		Quality:     st.Quality,
+		Width:       st.Width,
+		Height:      st.Height,
+		Throughput:  st.Throughput / 1024,
+		RTT:         ms(st.RTT),
+		ReceivedFPS: float64(frames) / interval.Seconds(),
+		Received:    float64(bytes) / 1024 / interval.Seconds(),
+	}
+	if frames != 0 {
+		s.Latency = ms(latency / time.Duration(frames))
+	}
+	return s
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func printHeader(w io.Writer) {
+	fmt.Fprintf(
+		w,
+		"%6s  %-28s  %3s  %7s  %9s  %8s  %6s  %8s  %8s  %7s\n",
+		"time", "link", "fps", "quality", "size", "KiB/s", "rtt", "recv fps", "recv KiB", "latency",
+	)
+}
+
+func (s Sample) print(w io.Writer) {
+	fmt.Fprintf(
+		w,
+		"%5.0fs  %-28s  %3d  %7d  %9s  %8.1f  %4.0fms  %8.1f  %8.1f  %5.0fms\n",
+		s.Time,
+		s.Link,
+		s.FPS,
+		s.Quality,
+		fmt.Sprintf("%dx%d", s.Width, s.Height),
+		s.Throughput,
+		s.RTT,
+		s.ReceivedFPS,
+		s.Received,
+		s.Latency,
+	)
+}
+
+// summary prints the averages of each phase.
+func (r Report) summary(w io.Writer) {
+	fmt.Fprintln(w, "\nPer phase averages:")
+	for i, p := range r.Phases {
+		var n int
+		var fps, quality, recv, latency float64
+		for _, s := range r.Samples {
+			if s.Phase != i {
+				continue
+			}
+			n++
+			fps += float64(s.FPS)
+			quality += float64(s.Quality)
+			recv += s.ReceivedFPS
+			latency += s.Latency
+		}
+		if n == 0 {
+			continue
+		}
+
+		c := float64(n)
+		fmt.Fprintf(
+			w,
+			"  %-28s  fps %4.1f  quality %5.1f  received fps %4.1f  latency %5.0fms\n",
+			p.Link,
+			fps/c,
+			quality/c,
+			recv/c,
+			latency/c,
+		)
+	}
+}
+
+func (r Report) save(file string) error {
+	d, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, d, 0644)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/server"
+)
+
+// texture is twice the frame size so frames can pan across it, the noise
+// keeps jpeg sizes close to those of a real camera.
+func texture(w, h int) *image.RGBA {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, w*2, h*2))
+	for y := 0; y < h*2; y++ {
+		for x := 0; x < w*2; x++ {
+			n := uint8(rnd.Intn(48))
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(x*200/(w*2)) + n,
+				G: uint8(y*200/(h*2)) + n,
+				B: uint8((x+y)*100/(w+h)) + n,
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// ladder returns the sizes the server may scale w x h frames down to,
+// keeping the aspect ratio.
+func ladder(w, h int) []image.Point {
+	steps := [][2]int{{1, 1}, {4, 5}, {5, 8}, {1, 2}, {3, 8}, {1, 4}}
+	sizes := make([]image.Point, len(steps))
+	for i, f := range steps {
+		sizes[i] = image.Pt(w*f[0]/f[1], h*f[0]/f[1])
+	}
+	return sizes
+}
+
+// synthetic generates w x h frames at the rate s asks for until ctx is
+// done.
+func synthetic(ctx context.Context, s *server.Server, w, h int) <-chan *server.Frame {
+	out := make(chan *server.Frame, 1)
+	tex := texture(w, h)
+	go func() {
+		defer close(out)
+		for i := 0; ; i++ {
+			fps := s.Status().FPS
+			if fps < 1 {
+				fps = 1
+			}
+
+			select {
+			case <-time.After(time.Second / time.Duration(fps)):
+			case <-ctx.Done():
+				return
+			}
+
+			x, y := (i*7)%w, (i*3)%h
+			img := tex.SubImage(image.Rect(x, y, x+w, y+h))
+			b := bytes.NewBuffer(nil)
+			if err := jpeg.Encode(b, img, &jpeg.Options{Quality: 95}); err != nil {
+				continue
+			}
+
+			select {
+			case out <- &server.Frame{Buffer: b, Captured: time.Now()}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/audit"
+	"github.com/frizinak/inbetween-go-homecam/config"
+	"github.com/frizinak/inbetween-go-homecam/device"
+	"github.com/frizinak/inbetween-go-homecam/prompt"
+	"github.com/frizinak/inbetween-go-homecam/server"
+)
+
+// loadConfig loads the config, ignoring validation errors so the commands
+// can be used to fix them.
+func loadConfig(file string) (config.Config, error) {
+	c, err := config.LoadConfig(file)
+	if _, ok := err.(config.ValidationErrors); ok {
+		err = nil
+	}
+	return c, err
+}
+
+func checkConfig(l *log.Logger, file string) {
+	_, err := config.LoadConfig(file)
+	if errs, ok := err.(config.ValidationErrors); ok {
+		fmt.Printf("%s is invalid:\n", file)
+		for _, e := range errs {
+			fmt.Printf("    %s\n", e)
+		}
+		os.Exit(1)
+	}
+
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	fmt.Printf("%s is valid\n", file)
+}
+
+func initConfig(l *log.Logger, p *prompt.Prompt, file string) {
+	if _, err := os.Stat(file); err == nil {
+		overwrite, err := p.Bool(fmt.Sprintf("%s exists, overwrite it", file), false)
+		if err != nil {
+			l.Fatal(err)
+		}
+		if !overwrite {
+			return
+		}
+	}
+
+	c, secrets, err := config.Example()
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	if c.Address, err = p.Line("Listen address", c.Address); err != nil {
+		l.Fatal(err)
+	}
+
+	cams, err := server.Cameras()
+	if err != nil {
+		l.Fatal(err)
+	}
+	for i, cam := range cams {
+		if i == 0 {
+			c.Device = cam.Device
+		}
+		fmt.Printf("    %s %s\n", cam.Device, cam.Name)
+	}
+	if c.Device, err = p.Line("Camera", c.Device); err != nil {
+		l.Fatal(err)
+	}
+
+	if c.MaxPeers, err = p.Int("Maximum number of clients", c.MaxPeers); err != nil {
+		l.Fatal(err)
+	}
+
+	generate, err := p.Bool("Generate a random password", true)
+	if err != nil {
+		l.Fatal(err)
+	}
+	if !generate {
+		if secrets.Password, err = p.NewPassword("Password"); err != nil {
+			l.Fatal(err)
+		}
+	}
+
+	touch, err := p.NewTouch("Touch password")
+	if err != nil {
+		l.Fatal(err)
+	}
+	secrets.TouchPassword = touch.String()
+
+	if c.TLS.Enabled, err = p.Bool("Enable TLS", false); err != nil {
+		l.Fatal(err)
+	}
+	if c.TOTP.Enabled, err = p.Bool("Enable two-factor authentication for remote clients", false); err != nil {
+		l.Fatal(err)
+	}
+
+	err = config.UpdateSecrets(c.SecretsPath(file), func(s *config.Secrets) { *s = secrets })
+	if err != nil {
+		l.Fatal(err)
+	}
+	if err := config.Save(file, c); err != nil {
+		l.Fatal(err)
+	}
+
+	l.Printf("Saved config to %s and secrets to %s", file, c.SecretsPath(file))
+	if c.TOTP.Enabled {
+		c.TOTP.Secret = secrets.TOTPSecret
+		l.Printf("Add this to your authenticator app: %s", c.TOTP.URI())
+	}
+	checkConfig(l, file)
+}
+
+func listCameras(l *log.Logger) {
+	cams, err := server.Cameras()
+	if err != nil {
+		l.Fatal(err)
+	}
+	if len(cams) == 0 {
+		l.Fatal("No video capture devices found")
+	}
+
+	for _, cam := range cams {
+		fmt.Printf("%s %s\n", cam.Device, cam.Name)
+		for _, f := range cam.Formats {
+			fmt.Printf("    %-4s %s\n", f.FourCC(), f.Description)
+			for _, s := range f.Sizes {
+				intervals := make([]string, len(s.Intervals))
+				for i := range s.Intervals {
+					intervals[i] = s.Intervals[i].String()
+				}
+				sep := " "
+				if s.IntervalRange {
+					sep = " - "
+				}
+				fmt.Printf("        %-12s %s\n", s.GetString(), strings.Join(intervals, sep))
+			}
+		}
+	}
+}
+
+func listDevices(l *log.Logger, file string) {
+	devices, err := device.NewStore(device.DefaultStoreFile(file))
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	list, err := devices.List()
+	if err != nil {
+		l.Fatal(err)
+	}
+	for _, d := range list {
+		fmt.Printf("%-20s %s %s\n", d.Name, d.Fingerprint(), d.Enrolled.Format("2006-01-02 15:04"))
+	}
+}
+
+func revokeDevice(l *log.Logger, file, name string) {
+	devices, err := device.NewStore(device.DefaultStoreFile(file))
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	d, err := devices.Revoke(name)
+	if err != nil {
+		l.Fatal(err)
+	}
+	l.Printf("Revoked '%s' (%s)", d.Name, d.Fingerprint())
+}
+
+func showAudit(l *log.Logger, file string, n int) {
+	c, err := loadConfig(file)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	path := c.Audit.Path(file)
+	if path == "" {
+		l.Fatal("Audit log is disabled")
+	}
+	entries, err := audit.Recent(path, n)
+	if err != nil {
+		l.Fatal(err)
+	}
+	for _, e := range entries {
+		fmt.Println(e)
+	}
+}
+
+func secretsOverridden(l *log.Logger, env, credential string) {
+	if os.Getenv(env) != "" {
+		l.Printf("Warning: $%s is set and takes precedence", env)
+	}
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		if _, err := os.Stat(filepath.Join(dir, credential)); err == nil {
+			l.Printf("Warning: systemd credential %s is set and takes precedence", credential)
+		}
+	}
+}
+
+func setPassword(l *log.Logger, p *prompt.Prompt, file string) {
+	c, err := loadConfig(file)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	pass, err := p.NewPassword("New password")
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	path := c.SecretsPath(file)
+	if err := config.UpdateSecrets(path, func(s *config.Secrets) { s.Password = pass }); err != nil {
+		l.Fatal(err)
+	}
+
+	l.Printf("Saved password to %s", path)
+	secretsOverridden(l, config.EnvPassword, "homecam-password")
+}
+
+func setTouchPassword(l *log.Logger, p *prompt.Prompt, file string) {
+	c, err := loadConfig(file)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	touch, err := p.NewTouch("New touch password")
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	path := c.SecretsPath(file)
+	err = config.UpdateSecrets(path, func(s *config.Secrets) { s.TouchPassword = touch.String() })
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	l.Printf("Saved touch password to %s", path)
+	secretsOverridden(l, config.EnvTouchPassword, "homecam-touch-password")
+}
+
+func testCapture(l *log.Logger, file, output string) {
+	c, err := loadConfig(file)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	frame, format, err := server.Capture(c.Device, time.Second*5)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(output, frame, 0644); err != nil {
+		l.Fatal(err)
+	}
+
+	l.Printf("Saved %s frame from %s to %s (%d bytes)", format, c.Device, output, len(frame))
+	if format != "MJPG" && format != "JPEG" {
+		l.Printf("Warning: %s is not a jpeg format, the server can not stream it", format)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/frizinak/inbetween-go-homecam/config"
+	"github.com/frizinak/inbetween-go-homecam/device"
+	"github.com/frizinak/inbetween-go-homecam/discovery"
+	"github.com/frizinak/inbetween-go-homecam/protocol"
+	"github.com/frizinak/inbetween-go-homecam/server"
+	"golang.org/x/crypto/ed25519"
+)
+
+// advertise announces the server on the LAN unless it only listens on
+// loopback.
+func advertise(l *log.Logger, conf config.Config, key ed25519.PrivateKey) *discovery.Responder {
+	host, p, err := net.SplitHostPort(conf.Address)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		l.Printf("Not advertising on the LAN, %s is only reachable locally", conf.Address)
+		return nil
+	}
+	port, _ := strconv.Atoi(p)
+
+	camera := conf.Device
+	if cam, err := server.ProbeCamera(conf.Device); err == nil && cam.Name != "" {
+		camera = cam.Name
+	}
+
+	r := discovery.NewResponder(l, discovery.Service{
+		Instance: conf.Discovery.Name,
+		Port:     port,
+		Version:  protocol.Version,
+		Cameras:  []string{camera},
+		ID:       device.Fingerprint(key.Public().(ed25519.PublicKey)),
+	})
+
+	go func() {
+		if err := r.ListenAndServe(); err != nil {
+			l.Printf("LAN discovery disabled: %s", err)
+		}
+	}()
+
+	return r
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/config"
+	"github.com/frizinak/inbetween-go-homecam/device"
+	"github.com/frizinak/inbetween-go-homecam/server"
+	"golang.org/x/crypto/ed25519"
+	"rsc.io/qr"
+)
+
+const pairingTTL = time.Minute * 10
+
+func pair(l *log.Logger, file, address string) {
+	conf, err := config.LoadConfig(file)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	if address == "" {
+		if address, err = pairAddress(conf.Address); err != nil {
+			l.Fatal(err)
+		}
+	}
+
+	key, err := device.LoadOrCreateKey(device.DefaultKeyFile(file))
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	uri := device.PairingURI{
+		Address:   address,
+		ServerKey: key.Public().(ed25519.PublicKey),
+	}
+
+	if uri.Name, err = os.Hostname(); err != nil {
+		uri.Name = "homecam"
+	}
+
+	if conf.TLS.Enabled {
+		tlsConf, err := server.LoadOrCreateTLS(conf.TLS.Files(file))
+		if err != nil {
+			l.Fatal(err)
+		}
+		uri.TLS = server.TLSFingerprint(tlsConf)
+	}
+
+	uri.Token, err = device.NewPairing(device.DefaultPairingFile(file)).Create(pairingTTL)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	if err := printQR(os.Stdout, uri.String()); err != nil {
+		l.Fatal(err)
+	}
+	fmt.Println(uri)
+	fmt.Printf(
+		"\nThe token can be used once and expires at %s\n",
+		time.Now().Add(pairingTTL).Format("15:04:05"),
+	)
+}
+
+// pairAddress replaces an unspecified listen host with the first address
+// of this machine clients can reach.
+func pairAddress(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listen, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			return net.JoinHostPort(n.IP.String(), port), nil
+		}
+	}
+
+	return "", fmt.Errorf("No address to reach %s, pass one as argument", listen)
+}
+
+// printQR renders text as a QR code with half block characters, light
+// modules are drawn so it scans on a dark terminal.
+func printQR(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return err
+	}
+
+	const quiet = 2
+	light := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return true
+		}
+		return !code.Black(x, y)
+	}
+
+	var b strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
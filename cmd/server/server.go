@@ -1,20 +1,136 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/frizinak/inbetween-go-homecam/audit"
 	"github.com/frizinak/inbetween-go-homecam/config"
+	"github.com/frizinak/inbetween-go-homecam/device"
+	"github.com/frizinak/inbetween-go-homecam/prompt"
 	"github.com/frizinak/inbetween-go-homecam/server"
 )
 
+const (
+	// shutdownTimeout is how long clients get to disconnect on SIGINT or
+	// SIGTERM.
+	shutdownTimeout = time.Second * 5
+	// defaultAuditEntries is how many entries audit shows by default.
+	defaultAuditEntries = 20
+)
+
 func main() {
+	configFile := flag.String("config", "", "Config file (default ~/.config/homecam/config.json)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), `Commands:
+  init                  interactively create a config
+  check-config          validate the config
+  list-cameras          list cameras with their formats, resolutions and frame rates
+  set-password          change the password
+  set-touch-password    change the touch password
+  test-capture [file]   save a single frame to file (default capture.jpg)
+  pair [host:port]      print a one-time pairing URI and QR code for a new client
+  devices               list enrolled devices
+  revoke <name>         revoke the enrolled device with the given name or fingerprint
+  audit [n]             show the n most recent audit log entries (default 20)
+
+Flags:`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	l := log.New(os.Stderr, "", log.Ldate|log.Ltime)
-	file, err := config.DefaultConfigFile()
+	file := *configFile
+	if file == "" {
+		var err error
+		if file, err = config.DefaultConfigFile(); err != nil {
+			l.Fatal(err)
+		}
+	}
+
+	p := prompt.New(os.Stdin, os.Stdout)
+	switch flag.Arg(0) {
+	case "":
+	case "init":
+		initConfig(l, p, file)
+		return
+	case "check-config":
+		checkConfig(l, file)
+		return
+	case "list-cameras":
+		listCameras(l)
+		return
+	case "set-password":
+		setPassword(l, p, file)
+		return
+	case "set-touch-password":
+		setTouchPassword(l, p, file)
+		return
+	case "test-capture":
+		output := flag.Arg(1)
+		if output == "" {
+			output = "capture.jpg"
+		}
+		testCapture(l, file, output)
+		return
+	case "pair":
+		pair(l, file, flag.Arg(1))
+		return
+	case "devices":
+		listDevices(l, file)
+		return
+	case "revoke":
+		if flag.Arg(1) == "" {
+			l.Fatal("Usage: revoke <name>")
+		}
+		revokeDevice(l, file, flag.Arg(1))
+		return
+	case "audit":
+		n := defaultAuditEntries
+		if flag.Arg(1) != "" {
+			var err error
+			if n, err = strconv.Atoi(flag.Arg(1)); err != nil || n < 1 {
+				l.Fatalf("Invalid number of entries '%s'", flag.Arg(1))
+			}
+		}
+		showAudit(l, file, n)
+		return
+	default:
+		l.Fatalf("Unknown command '%s'", flag.Arg(0))
+	}
+
+	devices, err := device.NewStore(device.DefaultStoreFile(file))
 	if err != nil {
 		l.Fatal(err)
 	}
 
+	version, backup, err := config.Migrate(file)
+	if err != nil && !os.IsNotExist(err) {
+		l.Fatal(err)
+	}
+	if backup != "" {
+		l.Printf(
+			"Migrated config from version %d to %d, the original was saved as %s",
+			version,
+			config.CurrentVersion,
+			backup,
+		)
+		if version < 3 {
+			l.Println("LAN discovery (mDNS) was added disabled, set Discovery.Enabled to advertise this server")
+		}
+	}
+
 	conf, err := config.LoadConfig(file)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -26,26 +142,115 @@ func main() {
 		}
 
 		l.Printf("Created example config file in %s", file)
+		if conf, err = config.LoadConfig(file); err == nil {
+			l.Printf("Password, touch password and TOTP secret are in %s", conf.SecretsPath(file))
+			l.Printf(
+				"To enable two-factor authentication set TOTP.Enabled and add this to your authenticator app: %s",
+				conf.TOTP.URI(),
+			)
+		}
 		return
 	}
 
+	key, err := device.LoadOrCreateKey(device.DefaultKeyFile(file))
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	var tlsConf *tls.Config
+	if conf.TLS.Enabled {
+		if tlsConf, err = server.LoadOrCreateTLS(conf.TLS.Files(file)); err != nil {
+			l.Fatal(err)
+		}
+		l.Printf("TLS enabled, certificate fingerprint: %s", server.TLSFingerprint(tlsConf))
+	}
+
+	var auditLog server.AuditLog
+	if path := conf.Audit.Path(file); path != "" {
+		a, err := audit.Open(path, conf.Audit.MaxSize(), conf.Audit.Keep)
+		if err != nil {
+			l.Fatal(err)
+		}
+		defer a.Close()
+		auditLog = a
+	}
+
 	pass := append([]byte(conf.Password), conf.RawTouchPassword()...)
-	s := server.New(
-		l,
-		conf.Address,
-		pass,
-		conf.Device,
-		conf.Quality,
-		conf.MaxPeers,
-	)
-	output, errs := s.Start()
+	s := server.NewServer(server.Options{
+		Logger:    l,
+		Address:   conf.Address,
+		Password:  pass,
+		Device:    conf.Device,
+		Quality:   conf.Quality,
+		MaxPeers:  conf.MaxPeers,
+		Keepalive: conf.Keepalive,
+		TOTP:      conf.TOTP,
+		Devices:   devices,
+		Key:       key,
+		Pairing:   device.NewPairing(device.DefaultPairingFile(file)),
+		TLS:       tlsConf,
+		Access:    conf.Access,
+		AuditLog:  auditLog,
+	})
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	changed := config.Watch(file, time.Second*2)
+	secretsChanged := config.Watch(conf.SecretsPath(file), time.Second*2)
 	go func() {
-		if err := s.Listen(output); err != nil {
-			l.Fatal(err)
+		for {
+			select {
+			case <-reload:
+			case <-changed:
+			case <-secretsChanged:
+			}
+
+			n, err := config.LoadConfig(file)
+			if err != nil {
+				l.Printf("Not reloading config: %s", err)
+				continue
+			}
+
+			s.Reload(
+				append([]byte(n.Password), n.RawTouchPassword()...),
+				n.Quality,
+				n.MaxPeers,
+				n.TOTP,
+				n.Access,
+			)
+			l.Println("Reloaded config")
+			if fields := config.RestartRequired(conf, n); len(fields) != 0 {
+				l.Printf("Restart required to apply changes to: %s", strings.Join(fields, ", "))
+			}
+		}
+	}()
+
+	if conf.Discovery.Enabled {
+		if r := advertise(l, conf, key); r != nil {
+			defer r.Close()
+		}
+	}
+
+	ln, err := net.Listen("tcp", conf.Address)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-quit
+		l.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			l.Printf("Shutdown: %s", err)
 		}
 	}()
 
-	if err := <-errs; err != nil {
+	if err := s.Serve(context.Background(), ln); err != server.ErrServerClosed {
 		l.Fatal(err)
 	}
+	<-done
 }
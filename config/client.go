@@ -0,0 +1,96 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Profile is a server the client can connect to.
+type Profile struct {
+	Name    string
+	Address string
+	// Addresses are other addresses of the same server, e.g. a dynamic DNS
+	// hostname or VPN address, tried after Address in this order.
+	Addresses           []string `json:",omitempty"`
+	Password            string
+	TouchPasswordLength int
+	TLS                 bool
+	// ServerID is the fingerprint of the server's device key, used to
+	// recognize the server when it is discovered on the LAN.
+	ServerID string `json:",omitempty"`
+}
+
+func (p Profile) Validate() error {
+	if p.Name == "" {
+		return errors.New("Name can not be empty")
+	}
+	for _, addr := range p.AllAddresses() {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("Address must be host:port, got '%s'", addr)
+		}
+	}
+	if p.TouchPasswordLength < 1 || p.TouchPasswordLength > 32 {
+		return errors.New("Touch password length must be between 1 and 32")
+	}
+	return nil
+}
+
+// AllAddresses returns Address followed by Addresses.
+func (p Profile) AllAddresses() []string {
+	return append([]string{p.Address}, p.Addresses...)
+}
+
+// ClientConfig holds the server profiles of a client.
+type ClientConfig struct {
+	Profiles []Profile
+}
+
+// Profile returns the profile with the given name or nil.
+func (c *ClientConfig) Profile(name string) *Profile {
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == name {
+			return &c.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// Set adds p or replaces the profile with the same name.
+func (c *ClientConfig) Set(p Profile) {
+	if e := c.Profile(p.Name); e != nil {
+		*e = p
+		return
+	}
+	c.Profiles = append(c.Profiles, p)
+}
+
+func DefaultClientConfigFile() (string, error) {
+	dir, err := ClientDir()
+	return filepath.Join(dir, "client.json"), err
+}
+
+// LoadClientConfig returns an empty config if file does not exist.
+func LoadClientConfig(file string) (*ClientConfig, error) {
+	c := &ClientConfig{}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return c, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(c); err != nil {
+		return c, fmt.Errorf("Invalid client config %s: %s", file, err)
+	}
+
+	return c, nil
+}
+
+func SaveClientConfig(file string, c *ClientConfig) error {
+	return writeJSON(file, c)
+}
@@ -0,0 +1,15 @@
+// +build !mobile
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ClientDir is where the client stores its profiles, identity and pinned
+// certificates.
+func ClientDir() (string, error) {
+	home, err := os.UserHomeDir()
+	return filepath.Join(home, ".config", "homecam"), err
+}
@@ -0,0 +1,20 @@
+// +build mobile
+
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ClientDir is where the client stores its profiles, identity and pinned
+// certificates: the app's files directory, a sibling of the cache directory
+// the app package exports as TMPDIR.
+func ClientDir() (string, error) {
+	tmp := os.Getenv("TMPDIR")
+	if tmp == "" {
+		return "", errors.New("TMPDIR not set, can not determine app storage")
+	}
+	return filepath.Join(filepath.Dir(tmp), "files"), nil
+}
@@ -1,12 +1,17 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/acl"
+	"github.com/frizinak/inbetween-go-homecam/totp"
+	"github.com/frizinak/inbetween-go-homecam/vars"
 )
 
 var (
@@ -39,13 +44,23 @@ func (t TouchPassword) String() string {
 }
 
 type Config struct {
-	Address          string
-	Device           string
-	Password         string
-	TouchPassword    interface{}
+	Version int
+	Address string
+	Device  string
+	// SecretsFile holds Password, TouchPassword and TOTP.Secret, relative
+	// to the config directory. See LoadSecrets for the other sources.
+	SecretsFile      string
+	Password         string      `json:",omitempty"`
+	TouchPassword    interface{} `json:",omitempty"`
 	rawTouchPassword TouchPassword
 	MaxPeers         int
 	Quality          Quality
+	Keepalive        Keepalive
+	TOTP             TOTP
+	TLS              TLS
+	Access           Access
+	Audit            Audit
+	Discovery        Discovery
 }
 
 func (c Config) RawTouchPassword() TouchPassword {
@@ -57,6 +72,32 @@ func (c Config) RawTouchPassword() TouchPassword {
 	case []byte:
 		c.rawTouchPassword = v
 		return v
+	case []interface{}:
+		valid := make(map[float64]bool, len(touchMap))
+		for _, b := range touchMap {
+			valid[float64(b)] = true
+		}
+
+		bts := make([]byte, 0, len(v))
+		for _, n := range v {
+			var f float64
+			switch n := n.(type) {
+			case float64:
+				f = n
+			case json.Number:
+				var err error
+				if f, err = n.Float64(); err != nil {
+					return nil
+				}
+			default:
+				return nil
+			}
+			if !valid[f] {
+				return nil
+			}
+			bts = append(bts, byte(f))
+		}
+		return bts
 	case string:
 		bts := make([]byte, 0, len(v)*2)
 		for _, c := range v {
@@ -97,6 +138,144 @@ func (q Quality) DesiredClientThroughput() float64 { return q.MaxKilobytesPerSec
 func (q Quality) MinimumResolution() int           { return q.MinWidth * q.MinHeight }
 func (q Quality) MaximumResolution() int           { return q.MaxWidth * q.MaxHeight }
 
+// Keepalive configures how often peers are pinged and how long they may
+// stay silent before being considered dead. Zero values use the defaults.
+type Keepalive struct {
+	IntervalMilliseconds int
+	TimeoutMilliseconds  int
+}
+
+func (k Keepalive) KeepaliveInterval() time.Duration {
+	if k.IntervalMilliseconds <= 0 {
+		return vars.KeepaliveInterval
+	}
+	return time.Duration(k.IntervalMilliseconds) * time.Millisecond
+}
+
+func (k Keepalive) KeepaliveTimeout() time.Duration {
+	if k.TimeoutMilliseconds <= 0 {
+		return vars.KeepaliveTimeout
+	}
+	return time.Duration(k.TimeoutMilliseconds) * time.Millisecond
+}
+
+// TOTP configures an optional time-based one-time password (RFC 6238) as a
+// second factor after the password handshake.
+type TOTP struct {
+	Enabled bool
+	// Secret is the base32 encoded secret shared with your authenticator app.
+	Secret string `json:",omitempty"`
+	// RemoteOnly only requires a one-time password from non-LAN addresses.
+	RemoteOnly bool
+}
+
+func (t TOTP) TOTPSecret() string {
+	if !t.Enabled {
+		return ""
+	}
+	return t.Secret
+}
+
+func (t TOTP) TOTPRemoteOnly() bool { return t.RemoteOnly }
+
+// URI returns the provisioning URI for authenticator apps.
+func (t TOTP) URI() string { return totp.URI(t.Secret, "homecam", "homecam") }
+
+// TLS wraps all connections in TLS 1.3 using a self-signed certificate
+// which clients pin on first use.
+type TLS struct {
+	Enabled bool
+	// Certificate and Key are the PEM encoded files, generated if they do
+	// not exist. Relative paths are relative to the config file.
+	Certificate string
+	Key         string
+}
+
+// Files returns the absolute paths of the certificate and key.
+func (t TLS) Files(configFile string) (cert, key string) {
+	dir := filepath.Dir(configFile)
+	cert, key = t.Certificate, t.Key
+	if cert == "" {
+		cert = "tls.crt"
+	}
+	if key == "" {
+		key = "tls.key"
+	}
+	if !filepath.IsAbs(cert) {
+		cert = filepath.Join(dir, cert)
+	}
+	if !filepath.IsAbs(key) {
+		key = filepath.Join(dir, key)
+	}
+
+	return
+}
+
+// ACL is a list of allowed and denied CIDR ranges, single addresses or
+// "lan". Deny takes precedence, an empty Allow list allows everything.
+type ACL struct {
+	Allow []string
+	Deny  []string
+}
+
+func (a ACL) Compile() (*acl.ACL, error) { return acl.New(a.Allow, a.Deny) }
+
+// acl denies everything if the lists are invalid, Validate reports why.
+func (a ACL) acl() *acl.ACL {
+	c, err := a.Compile()
+	if err != nil {
+		return acl.None()
+	}
+	return c
+}
+
+// Access restricts which addresses may connect at all and which may
+// authenticate with the password (Admin) or an enrolled device key.
+type Access struct {
+	ACL
+	Admin   ACL
+	Devices ACL
+}
+
+func (a Access) ConnectionACL() *acl.ACL { return a.ACL.acl() }
+func (a Access) AdminACL() *acl.ACL      { return a.Admin.acl() }
+func (a Access) DeviceACL() *acl.ACL     { return a.Devices.acl() }
+
+// Audit configures the connection audit log, an empty File disables it.
+type Audit struct {
+	// File is relative to the config file unless absolute.
+	File string
+	// MaxSizeKilobytes is the size after which the log is rotated.
+	MaxSizeKilobytes int
+	// Keep is the number of rotated files to keep.
+	Keep int
+}
+
+// Path returns the absolute path of the log file or an empty string if
+// disabled.
+func (a Audit) Path(configFile string) string {
+	if a.File == "" || filepath.IsAbs(a.File) {
+		return a.File
+	}
+	return filepath.Join(filepath.Dir(configFile), a.File)
+}
+
+func (a Audit) MaxSize() int64 {
+	if a.MaxSizeKilobytes <= 0 {
+		return 1024 * 1024
+	}
+	return int64(a.MaxSizeKilobytes) * 1024
+}
+
+// Discovery advertises the server on the local network over mDNS so
+// clients can find it and prefer its LAN address.
+type Discovery struct {
+	Enabled bool
+	// Name is shown in the client's profile picker, defaults to the
+	// hostname.
+	Name string
+}
+
 func DefaultConfigFile() (string, error) {
 	home, err := os.UserHomeDir()
 	return filepath.Join(home, ".config", "homecam", "config.json"), err
@@ -113,14 +292,15 @@ func LoadConfig(file string) (Config, error) {
 		return *c, err
 	}
 
-	if c.RawTouchPassword() == nil {
-		return *c, errors.New("Invalid touchpassword type")
+	if err = LoadSecrets(c, file); err != nil {
+		return *c, err
 	}
 
-	return *c, nil
+	return *c, c.Validate()
 }
 
-func EnsureConfig(file string) error {
+// Example returns the default config and freshly generated secrets.
+func Example() (Config, Secrets, error) {
 	var randPass string
 	chars := "abcdefghijklmnopqrstuvxyzABCDEFGHIJKLMNOPQRSTUVXYZ0123456789-!@#$%^&*-=(){}"
 
@@ -129,11 +309,17 @@ func EnsureConfig(file string) error {
 		randPass += string(chars[rand.Intn(len(chars))])
 	}
 
+	totpSecret, err := totp.GenerateSecret()
+	if err != nil {
+		return Config{}, Secrets{}, err
+	}
+
 	c := Config{
-		Address:       "127.0.0.1:1234",
-		Password:      randPass,
-		TouchPassword: []byte{8, 8, 8, 8, 8},
-		Device:        "/dev/video0",
+		Version:     CurrentVersion,
+		Address:     "127.0.0.1:1234",
+		SecretsFile: "secrets.json",
+		Device:      "/dev/video0",
+		MaxPeers:    10,
 		Quality: Quality{
 			MinFPS: 5,
 			MaxFPS: 20,
@@ -149,6 +335,45 @@ func EnsureConfig(file string) error {
 			MaxKilobytesPerSecond:          1200,
 			MaxKilobytesPerSecondPerClient: 200,
 		},
+		Keepalive: Keepalive{
+			IntervalMilliseconds: 1000,
+			TimeoutMilliseconds:  5000,
+		},
+		TOTP: TOTP{
+			Enabled:    false,
+			RemoteOnly: true,
+		},
+		TLS: TLS{
+			Enabled:     false,
+			Certificate: "tls.crt",
+			Key:         "tls.key",
+		},
+		Access: Access{
+			ACL:     ACL{Allow: []string{}, Deny: []string{}},
+			Admin:   ACL{Allow: []string{}, Deny: []string{}},
+			Devices: ACL{Allow: []string{}, Deny: []string{}},
+		},
+		Audit: Audit{
+			File:             "audit.log",
+			MaxSizeKilobytes: 1024,
+			Keep:             3,
+		},
+		Discovery: Discovery{Enabled: true},
+	}
+
+	secrets := Secrets{
+		Password:      randPass,
+		TouchPassword: TouchPassword{8, 8, 8, 8, 8}.String(),
+		TOTPSecret:    totpSecret,
+	}
+
+	return c, secrets, nil
+}
+
+func EnsureConfig(file string) error {
+	c, secrets, err := Example()
+	if err != nil {
+		return err
 	}
 
 	dirs := filepath.Dir(file)
@@ -159,8 +384,39 @@ func EnsureConfig(file string) error {
 	} else if err != nil {
 		return err
 	}
+	defer f.Close()
+
+	if err = WriteSecrets(c.SecretsPath(file), secrets); err != nil {
+		return err
+	}
 
 	enc := json.NewEncoder(f)
 	enc.SetIndent("", "    ")
 	return enc.Encode(c)
 }
+
+// Save atomically replaces the config file with c.
+func Save(file string, c Config) error {
+	return writeJSON(file, c)
+}
+
+func writeJSON(file string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	enc.SetIndent("", "    ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// CurrentVersion is the config version this build writes and expects.
+const CurrentVersion = 3
+
+type migration func(raw map[string]interface{}) error
+
+// migrations[i] upgrades a config from version i to i+1.
+var migrations = []migration{
+	migrateTouchPassword,
+	migrateSections,
+	migrateDiscovery,
+}
+
+// migrateTouchPassword normalizes TouchPassword to an arrow string, older
+// example configs contained a base64 encoded byte slice.
+func migrateTouchPassword(raw map[string]interface{}) error {
+	v := raw["TouchPassword"]
+	if s, ok := v.(string); ok {
+		if (Config{TouchPassword: s}).RawTouchPassword() != nil {
+			return nil
+		}
+
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("TouchPassword: can not migrate '%s'", s)
+		}
+		v = b
+	}
+
+	touch := Config{TouchPassword: v}.RawTouchPassword()
+	if touch == nil {
+		return fmt.Errorf("TouchPassword: can not migrate %v", v)
+	}
+
+	raw["TouchPassword"] = touch.String()
+	return nil
+}
+
+// migrateSections adds the sections introduced in version 2 and replaces the
+// meaningless MaxPeers of 0.
+func migrateSections(raw map[string]interface{}) error {
+	if n, ok := raw["MaxPeers"].(json.Number); !ok || n.String() == "0" {
+		raw["MaxPeers"] = 10
+	}
+
+	defaults := map[string]interface{}{
+		"Keepalive": Keepalive{IntervalMilliseconds: 1000, TimeoutMilliseconds: 5000},
+		"TOTP":      TOTP{Enabled: false, RemoteOnly: true},
+		"TLS":       TLS{Enabled: false, Certificate: "tls.crt", Key: "tls.key"},
+		"Access": Access{
+			ACL:     ACL{Allow: []string{}, Deny: []string{}},
+			Admin:   ACL{Allow: []string{}, Deny: []string{}},
+			Devices: ACL{Allow: []string{}, Deny: []string{}},
+		},
+		"Audit": Audit{File: "audit.log", MaxSizeKilobytes: 1024, Keep: 3},
+	}
+
+	for k, v := range defaults {
+		if _, ok := raw[k]; !ok {
+			raw[k] = v
+		}
+	}
+
+	return nil
+}
+
+// migrateDiscovery adds discovery, added in version 3. It is disabled as it
+// announces the server's fingerprint and name to the whole LAN, existing
+// installs have to opt in.
+func migrateDiscovery(raw map[string]interface{}) error {
+	if _, ok := raw["Discovery"]; !ok {
+		raw["Discovery"] = Discovery{Enabled: false}
+	}
+	return nil
+}
+
+// Migrate upgrades the config file to CurrentVersion in place, keeping a
+// backup of the original. It returns the version the file had and the path
+// of the backup, which is empty if nothing was migrated.
+func Migrate(file string) (int, string, error) {
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return 0, "", err
+	}
+
+	version := 0
+	if v, ok := raw["Version"].(json.Number); ok {
+		n, err := v.Int64()
+		if err != nil {
+			return 0, "", fmt.Errorf("Version: %s", err)
+		}
+		version = int(n)
+	}
+
+	if version > CurrentVersion {
+		return version, "", fmt.Errorf(
+			"Config version %d is newer than the supported version %d",
+			version,
+			CurrentVersion,
+		)
+	}
+
+	if version == CurrentVersion {
+		return version, "", nil
+	}
+
+	for i := version; i < CurrentVersion; i++ {
+		if err := migrations[i](raw); err != nil {
+			return version, "", fmt.Errorf("Migrating config to version %d: %s", i+1, err)
+		}
+	}
+	raw["Version"] = CurrentVersion
+
+	backup := fmt.Sprintf("%s.v%d.bak", file, version)
+	if err := ioutil.WriteFile(backup, d, 0600); err != nil {
+		return version, "", err
+	}
+
+	out, err := json.MarshalIndent(raw, "", "    ")
+	if err != nil {
+		return version, "", err
+	}
+
+	st, err := os.Stat(file)
+	if err != nil {
+		return version, "", err
+	}
+
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(out, '\n'), st.Mode().Perm()); err != nil {
+		return version, "", err
+	}
+
+	return version, backup, os.Rename(tmp, file)
+}
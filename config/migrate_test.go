@@ -0,0 +1,118 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const legacyQuality = `"Quality": {
+        "MinFPS": 5,
+        "MaxFPS": 20,
+        "MinJPEGQuality": 30,
+        "MaxJPEGQuality": 100,
+        "MaxKilobytesPerSecond": 1200,
+        "MaxKilobytesPerSecondPerClient": 200,
+        "MinWidth": 480,
+        "MinHeight": 320,
+        "MaxWidth": 1024,
+        "MaxHeight": 768
+    }`
+
+func legacyConfig(touch, maxPeers string) string {
+	return `{
+    "Address": "127.0.0.1:1234",
+    "Device": "/dev/video0",
+    "Password": "secret",
+    "TouchPassword": ` + touch + `,
+    "MaxPeers": ` + maxPeers + `,
+    ` + legacyQuality + `
+}`
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		version  int
+		touch    string
+		maxPeers int
+		err      string
+	}{
+		{"v0 number list", legacyConfig(`[8, 8, 4, 4]`, "0"), 0, "↑↑↓↓", 10, ""},
+		{"v0 base64", legacyConfig(`"CAgICAg="`, "0"), 0, "↑↑↑↑↑", 10, ""},
+		{"v0 arrows", legacyConfig(`"↖↘"`, "3"), 0, "↖↘", 3, ""},
+		{"v0 invalid number", legacyConfig(`[8, 7]`, "0"), 0, "", 0, "TouchPassword: can not migrate"},
+		{"v0 fraction", legacyConfig(`[8.5]`, "0"), 0, "", 0, "TouchPassword: can not migrate"},
+		{
+			"v1",
+			`{"Version": 1, "Address": "127.0.0.1:1234", "Device": "/dev/video0",
+			"Password": "secret", "TouchPassword": "↑←", "MaxPeers": 2, ` + legacyQuality + `}`,
+			1,
+			"↑←",
+			2,
+			"",
+		},
+		{"newer", `{"Version": 99}`, 99, "", 0, "newer than the supported version"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "homecam-migrate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, "config.json")
+			if err := ioutil.WriteFile(file, []byte(test.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			version, backup, err := Migrate(file)
+			if version != test.version {
+				t.Errorf("version %d, want %d", version, test.version)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			orig, err := ioutil.ReadFile(backup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(orig) != test.config {
+				t.Error("backup does not contain the original config")
+			}
+
+			c, err := LoadConfig(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Version != CurrentVersion {
+				t.Errorf("migrated version %d", c.Version)
+			}
+			if got := c.RawTouchPassword().String(); got != test.touch {
+				t.Errorf("touch password %s, want %s", got, test.touch)
+			}
+			if c.MaxPeers != test.maxPeers {
+				t.Errorf("MaxPeers %d, want %d", c.MaxPeers, test.maxPeers)
+			}
+			if c.Discovery.Enabled {
+				t.Error("migration enabled discovery")
+			}
+
+			if _, backup, err = Migrate(file); err != nil || backup != "" {
+				t.Errorf("second migration: backup '%s', error %v", backup, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"os"
+	"time"
+)
+
+// RestartRequired returns the names of the fields that differ between old
+// and new and can not be applied to a running server.
+func RestartRequired(old, new Config) []string {
+	var fields []string
+	if old.Address != new.Address {
+		fields = append(fields, "Address")
+	}
+	if old.Device != new.Device {
+		fields = append(fields, "Device")
+	}
+	if old.Keepalive != new.Keepalive {
+		fields = append(fields, "Keepalive")
+	}
+	if old.TLS != new.TLS {
+		fields = append(fields, "TLS")
+	}
+	if old.Audit != new.Audit {
+		fields = append(fields, "Audit")
+	}
+	if old.Discovery != new.Discovery {
+		fields = append(fields, "Discovery")
+	}
+
+	return fields
+}
+
+// Watch polls file every interval and sends on the returned channel when
+// its modification time or size changed.
+func Watch(file string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	stat := func() (time.Time, int64) {
+		st, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return st.ModTime(), st.Size()
+	}
+
+	go func() {
+		mod, size := stat()
+		for range time.Tick(interval) {
+			m, s := stat()
+			if m.Equal(mod) && s == size {
+				continue
+			}
+
+			mod, size = m, s
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changed
+}
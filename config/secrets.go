@@ -0,0 +1,178 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Secrets are the values that should not be stored in the config file.
+// The server needs the plaintext password as it is part of the encryption
+// key and the TOTP secret to generate codes, so no verifier can be stored
+// for either; enrolled devices are only stored by their public key.
+type Secrets struct {
+	Password      string      `json:",omitempty"`
+	TouchPassword interface{} `json:",omitempty"`
+	TOTPSecret    string      `json:",omitempty"`
+}
+
+const (
+	EnvPassword      = "HOMECAM_PASSWORD"
+	EnvTouchPassword = "HOMECAM_TOUCH_PASSWORD"
+	EnvTOTPSecret    = "HOMECAM_TOTP_SECRET"
+)
+
+// systemd credential names, see systemd.exec(5) LoadCredential=.
+const (
+	credPassword      = "homecam-password"
+	credTouchPassword = "homecam-touch-password"
+	credTOTPSecret    = "homecam-totp-secret"
+)
+
+// SecretsPath returns the absolute path of the secrets file.
+func (c Config) SecretsPath(configFile string) string {
+	f := c.SecretsFile
+	if f == "" {
+		f = "secrets.json"
+	}
+	if filepath.IsAbs(f) {
+		return f
+	}
+	return filepath.Join(filepath.Dir(configFile), f)
+}
+
+func (s Secrets) apply(c *Config) {
+	if s.Password != "" {
+		c.Password = s.Password
+	}
+	if s.TouchPassword != nil && s.TouchPassword != "" {
+		c.TouchPassword = s.TouchPassword
+		c.rawTouchPassword = nil
+	}
+	if s.TOTPSecret != "" {
+		c.TOTP.Secret = s.TOTPSecret
+	}
+}
+
+func readSecretsFile(file string) (Secrets, error) {
+	var s Secrets
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return s, err
+	}
+	if st.Mode().Perm()&0077 != 0 {
+		return s, fmt.Errorf("Secrets file %s must only be accessible by its owner (chmod 600)", file)
+	}
+
+	if err := json.NewDecoder(f).Decode(&s); err != nil {
+		return s, fmt.Errorf("Invalid secrets file %s: %s", file, err)
+	}
+
+	return s, nil
+}
+
+func readCredentials(dir string) (Secrets, error) {
+	var s Secrets
+	if dir == "" {
+		return s, nil
+	}
+
+	read := func(name string) (string, error) {
+		d, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return strings.TrimRight(string(d), "\r\n"), err
+	}
+
+	var err error
+	var touch string
+	if s.Password, err = read(credPassword); err != nil {
+		return s, err
+	}
+	if touch, err = read(credTouchPassword); err != nil {
+		return s, err
+	}
+	if touch != "" {
+		s.TouchPassword = touch
+	}
+	s.TOTPSecret, err = read(credTOTPSecret)
+	return s, err
+}
+
+func readEnv() Secrets {
+	s := Secrets{
+		Password:   os.Getenv(EnvPassword),
+		TOTPSecret: os.Getenv(EnvTOTPSecret),
+	}
+	if touch := os.Getenv(EnvTouchPassword); touch != "" {
+		s.TouchPassword = touch
+	}
+	return s
+}
+
+// LoadSecrets fills in the secrets of c, each source overriding the
+// previous one: the config file itself, the secrets file, systemd
+// credentials ($CREDENTIALS_DIRECTORY) and environment variables.
+func LoadSecrets(c *Config, configFile string) error {
+	s, err := readSecretsFile(c.SecretsPath(configFile))
+	if err != nil {
+		return err
+	}
+	s.apply(c)
+
+	if s, err = readCredentials(os.Getenv("CREDENTIALS_DIRECTORY")); err != nil {
+		return err
+	}
+	s.apply(c)
+
+	readEnv().apply(c)
+	return nil
+}
+
+// WriteSecrets creates the secrets file, it does not overwrite an existing
+// one.
+func WriteSecrets(file string, s Secrets) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "    ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// UpdateSecrets applies fn to the contents of the secrets file and saves it.
+func UpdateSecrets(file string, fn func(s *Secrets)) error {
+	s, err := readSecretsFile(file)
+	if err != nil {
+		return err
+	}
+
+	fn(&s)
+	return writeJSON(file, s)
+}
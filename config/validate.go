@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/totp"
+	"github.com/frizinak/inbetween-go-homecam/vars"
+)
+
+// FieldError describes why a single config field is invalid.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (f *FieldError) Error() string { return f.Field + ": " + f.Message }
+
+// ValidationErrors is returned by Validate and LoadConfig when one or more
+// fields are invalid.
+type ValidationErrors []*FieldError
+
+func (v ValidationErrors) Error() string {
+	l := make([]string, len(v))
+	for i := range v {
+		l[i] = v[i].Error()
+	}
+	return "Invalid config:\n\t" + strings.Join(l, "\n\t")
+}
+
+type validator ValidationErrors
+
+func (v *validator) check(ok bool, field, format string, args ...interface{}) {
+	if !ok {
+		*v = append(*v, &FieldError{field, fmt.Sprintf(format, args...)})
+	}
+}
+
+func (v *validator) between(field string, value, min, max int) {
+	v.check(value >= min && value <= max, field, "must be between %d and %d, got %d", min, max, value)
+}
+
+func (v *validator) acl(field string, a ACL) {
+	if _, err := a.Compile(); err != nil {
+		v.check(false, field, "%s", err)
+	}
+}
+
+// Validate checks the config for values the server can not work with.
+func (c Config) Validate() error {
+	v := &validator{}
+
+	v.check(
+		c.Version == CurrentVersion,
+		"Version",
+		"must be %d, got %d (older configs are migrated when the server starts)",
+		CurrentVersion,
+		c.Version,
+	)
+
+	_, _, err := net.SplitHostPort(c.Address)
+	v.check(err == nil, "Address", "must be host:port, got '%s'", c.Address)
+	v.check(c.Device != "", "Device", "can not be empty")
+	v.check(c.Password != "", "Password", "can not be empty (set it in %s, $%s or a systemd credential)", c.SecretsPath("."), EnvPassword)
+
+	touch := c.RawTouchPassword()
+	v.check(touch != nil, "TouchPassword", "must be a list of numbers or a string of arrows (↑↓→←↖↗↙↘)")
+	v.check(touch == nil || len(touch) != 0, "TouchPassword", "can not be empty")
+
+	v.check(c.MaxPeers > 0, "MaxPeers", "must be at least 1, 0 rejects every client")
+
+	q := c.Quality
+	v.between("Quality.MinFPS", q.MinFPS, 1, 255)
+	v.between("Quality.MaxFPS", q.MaxFPS, 1, 255)
+	v.check(q.MinFPS <= q.MaxFPS, "Quality.MinFPS", "must not exceed Quality.MaxFPS (%d)", q.MaxFPS)
+	v.between("Quality.MinJPEGQuality", q.MinJPEGQuality, 1, 100)
+	v.between("Quality.MaxJPEGQuality", q.MaxJPEGQuality, 1, 100)
+	v.check(
+		q.MinJPEGQuality <= q.MaxJPEGQuality,
+		"Quality.MinJPEGQuality",
+		"must not exceed Quality.MaxJPEGQuality (%d)",
+		q.MaxJPEGQuality,
+	)
+	v.check(q.MaxKilobytesPerSecond > 0, "Quality.MaxKilobytesPerSecond", "must be positive")
+	v.check(q.MaxKilobytesPerSecondPerClient > 0, "Quality.MaxKilobytesPerSecondPerClient", "must be positive")
+	v.check(q.MinWidth >= 0, "Quality.MinWidth", "can not be negative")
+	v.check(q.MinHeight >= 0, "Quality.MinHeight", "can not be negative")
+	v.check(q.MaxWidth > 0, "Quality.MaxWidth", "must be set, no resolution would match")
+	v.check(q.MaxHeight > 0, "Quality.MaxHeight", "must be set, no resolution would match")
+	v.check(q.MinWidth <= q.MaxWidth, "Quality.MinWidth", "must not exceed Quality.MaxWidth (%d)", q.MaxWidth)
+	v.check(q.MinHeight <= q.MaxHeight, "Quality.MinHeight", "must not exceed Quality.MaxHeight (%d)", q.MaxHeight)
+
+	k := c.Keepalive
+	v.check(k.IntervalMilliseconds >= 0, "Keepalive.IntervalMilliseconds", "can not be negative")
+	v.check(k.TimeoutMilliseconds >= 0, "Keepalive.TimeoutMilliseconds", "can not be negative")
+	v.check(
+		k.KeepaliveInterval() < k.KeepaliveTimeout(),
+		"Keepalive.IntervalMilliseconds",
+		"must be lower than the timeout (%s)",
+		k.KeepaliveTimeout(),
+	)
+	// Clients do not know the configured interval and time out after
+	// vars.KeepaliveTimeout without a message, e.g. while the camera is
+	// unavailable, leave room for latency.
+	v.check(
+		k.KeepaliveInterval() <= vars.KeepaliveTimeout/2,
+		"Keepalive.IntervalMilliseconds",
+		"can not exceed %d, clients time out after %s",
+		vars.KeepaliveTimeout/2/time.Millisecond,
+		vars.KeepaliveTimeout,
+	)
+
+	if c.TOTP.Enabled {
+		_, err := totp.Code(c.TOTP.Secret, time.Now())
+		v.check(err == nil, "TOTP.Secret", "%s", err)
+	}
+
+	v.acl("Access", c.Access.ACL)
+	v.acl("Access.Admin", c.Access.Admin)
+	v.acl("Access.Devices", c.Access.Devices)
+
+	v.check(c.Audit.MaxSizeKilobytes >= 0, "Audit.MaxSizeKilobytes", "can not be negative")
+	v.check(c.Audit.Keep >= 0, "Audit.Keep", "can not be negative")
+	v.check(len(c.Discovery.Name) <= 63, "Discovery.Name", "can not be longer than 63 bytes")
+
+	if len(*v) == 0 {
+		return nil
+	}
+	return ValidationErrors(*v)
+}
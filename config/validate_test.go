@@ -0,0 +1,82 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestValidateKeepalive(t *testing.T) {
+	tests := []struct {
+		interval, timeout int
+		fields            []string
+	}{
+		{0, 0, nil},
+		{1000, 5000, nil},
+		{2500, 10000, nil},
+		{2501, 10000, []string{"Keepalive.IntervalMilliseconds"}},
+		{6000, 10000, []string{"Keepalive.IntervalMilliseconds"}},
+		{2000, 1000, []string{"Keepalive.IntervalMilliseconds"}},
+		{-1, 0, []string{"Keepalive.IntervalMilliseconds"}},
+	}
+
+	c, secrets, err := Example()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets.apply(&c)
+
+	for _, test := range tests {
+		c.Keepalive = Keepalive{test.interval, test.timeout}
+		err := c.Validate()
+		if test.fields == nil {
+			if err != nil {
+				t.Errorf("%+v: %s", c.Keepalive, err)
+			}
+			continue
+		}
+
+		errs, ok := err.(ValidationErrors)
+		if !ok {
+			t.Errorf("%+v: expected validation errors, got %v", c.Keepalive, err)
+			continue
+		}
+		for _, field := range test.fields {
+			found := false
+			for _, e := range errs {
+				found = found || e.Field == field
+			}
+			if !found {
+				t.Errorf("%+v: no error for %s in %s", c.Keepalive, field, err)
+			}
+		}
+	}
+}
+
+func TestInvalidACLDeniesAll(t *testing.T) {
+	a := Access{ACL: ACL{Allow: []string{"not an address"}}}
+	if a.ConnectionACL().AllowedIP(net.ParseIP("192.168.1.2")) {
+		t.Error("invalid ACL allows connections")
+	}
+	if !a.AdminACL().AllowedIP(net.ParseIP("192.168.1.2")) {
+		t.Error("empty ACL denies connections")
+	}
+}
+
+func TestValidateACL(t *testing.T) {
+	c, secrets, err := Example()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets.apply(&c)
+
+	c.Access.Admin = ACL{Allow: []string{"192.168.1.0/24", "::1"}, Deny: []string{"192.168.1.1"}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Access.Admin.Deny = append(c.Access.Admin.Deny, "192.168.1.0/33")
+	errs, ok := c.Validate().(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Field != "Access.Admin" {
+		t.Errorf("got %v, want an error for Access.Admin", errs)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/scrypt"
@@ -16,6 +17,13 @@ const (
 	MaxCost     = 30
 	MinCost     = 6
 	MinSaltSize = 8
+	MaxSaltSize = 1024
+)
+
+var (
+	ErrNotEncrypted  = errors.New("Input is not encrypted")
+	ErrHeaderChanged = errors.New("Encryption header changed mid-stream")
+	ErrBlockSize     = errors.New("Invalid blocksize")
 )
 
 const chunkSizeMulti = 50
@@ -83,30 +91,65 @@ func (e *ImmutableKeyEncrypter) Encrypt(
 
 type ImmutableKeyDecrypter struct {
 	key        KeySlice
+	salt       []byte
+	cost       uint8
 	passphrase []byte
+
+	maxCost     uint8
+	maxSaltSize uint16
 }
 
 func NewImmutableKeyDecrypter(passphrase []byte) *ImmutableKeyDecrypter {
-	return &ImmutableKeyDecrypter{passphrase: passphrase}
+	return &ImmutableKeyDecrypter{
+		passphrase:  passphrase,
+		maxCost:     MaxCost,
+		maxSaltSize: MaxSaltSize,
+	}
 }
 
+// Limit restricts the scrypt cost and salt size the input may demand.
+// Headers are attacker controlled, a high cost makes deriving the key
+// allocate gigabytes of memory.
+func (d *ImmutableKeyDecrypter) Limit(maxCost uint8, maxSaltSize uint16) *ImmutableKeyDecrypter {
+	d.maxCost = maxCost
+	d.maxSaltSize = maxSaltSize
+	return d
+}
+
+// Decrypt decrypts r into w. The first call derives the key from the
+// header, subsequent calls reject input with a different salt or cost.
 func (d *ImmutableKeyDecrypter) Decrypt(r io.Reader, w io.Writer) error {
+	salt, iv, cost, err := header(r, d.maxSaltSize)
+	if err != nil {
+		return err
+	}
+
 	if d.key == nil {
-		salt, iv, cost, err := header(r)
-		if err != nil {
-			return err
+		if cost > d.maxCost {
+			return fmt.Errorf("scrypt cost %d exceeds limit of %d", cost, d.maxCost)
 		}
 
-		key, err := decryptWithHeader(r, w, d.passphrase, salt, iv, cost)
+		key, err := Key(d.passphrase, salt, cost)
 		if err != nil {
 			return err
 		}
-		d.key = key
 
-		return nil
+		d.key, d.salt, d.cost = key, salt, cost
+	} else if cost != d.cost || !bytes.Equal(salt, d.salt) {
+		return ErrHeaderChanged
+	}
+
+	block, err := aes.NewCipher(d.key)
+	if err != nil {
+		return err
 	}
 
-	return decryptWithKey(r, w, d.key)
+	return decrypt(
+		r,
+		w,
+		block,
+		iv,
+	)
 }
 
 func Encrypt(
@@ -131,8 +174,8 @@ func Decrypt(
 	return NewImmutableKeyDecrypter(passphrase).Decrypt(r, w)
 }
 
-func header(r io.Reader) (salt, iv []byte, cost uint8, err error) {
-	err = errors.New("Input is not encrypted")
+func header(r io.Reader, maxSaltSize uint16) (salt, iv []byte, cost uint8, err error) {
+	err = ErrNotEncrypted
 	var saltSize uint16
 	if binary.Read(r, binary.LittleEndian, &cost) != nil {
 		return
@@ -142,7 +185,12 @@ func header(r io.Reader) (salt, iv []byte, cost uint8, err error) {
 		return
 	}
 
-	header := make([]byte, saltSize+aes.BlockSize)
+	if saltSize < MinSaltSize || saltSize > maxSaltSize {
+		err = fmt.Errorf("Salt size %d out of bounds", saltSize)
+		return
+	}
+
+	header := make([]byte, int(saltSize)+aes.BlockSize)
 	if _, errl := io.ReadFull(r, header); errl != nil {
 		return
 	}
@@ -154,51 +202,6 @@ func header(r io.Reader) (salt, iv []byte, cost uint8, err error) {
 	return
 }
 
-func decryptWithHeader(
-	r io.Reader,
-	w io.Writer,
-	passphrase []byte,
-	salt,
-	iv []byte,
-	cost uint8,
-) (KeySlice, error) {
-	key, err := Key(passphrase, salt, cost)
-	if err != nil {
-		return nil, err
-	}
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	return key, decrypt(
-		r,
-		w,
-		block,
-		iv,
-	)
-}
-
-func decryptWithKey(r io.Reader, w io.Writer, key KeySlice) error {
-	_, iv, _, err := header(r)
-	if err != nil {
-		return err
-	}
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-
-	return decrypt(
-		r,
-		w,
-		block,
-		iv,
-	)
-}
-
 func encrypt(
 	r io.Reader,
 	w io.Writer,
@@ -263,8 +266,8 @@ func decrypt(
 			return err
 		}
 
-		if n != chunkSize && !(n == 0 || err == io.EOF) {
-			return errors.New("Invalid blocksize")
+		if n%size != 0 || (n != chunkSize && !(n == 0 || err == io.EOF)) {
+			return ErrBlockSize
 		}
 
 		out = out[:chunkSize]
@@ -0,0 +1,100 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func ciphertext(t *testing.T, e *ImmutableKeyEncrypter, plain []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	if err := e.Encrypt(bytes.NewReader(plain), buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encrypter(t *testing.T, pass string, saltSize uint16, cost uint8) *ImmutableKeyEncrypter {
+	e, err := NewImmutableKeyEncrypter([]byte(pass), saltSize, cost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestRoundTrip(t *testing.T) {
+	e := encrypter(t, "pass", 16, MinCost)
+	d := NewImmutableKeyDecrypter([]byte("pass")).Limit(MinCost, 16)
+	for _, n := range []int{0, 1, 15, 16, 17, 16 * chunkSizeMulti, 16*chunkSizeMulti + 1, 10000} {
+		plain := bytes.Repeat([]byte{byte(n)}, n)
+		out := bytes.NewBuffer(nil)
+		if err := d.Decrypt(bytes.NewReader(ciphertext(t, e, plain)), out); err != nil {
+			t.Fatalf("%dB: %s", n, err)
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Errorf("%dB: got %dB back", n, out.Len())
+		}
+	}
+}
+
+func TestDecryptLimits(t *testing.T) {
+	header := func(cost uint8, saltSize uint16) []byte {
+		buf := bytes.NewBuffer(nil)
+		binary.Write(buf, binary.LittleEndian, cost)
+		binary.Write(buf, binary.LittleEndian, saltSize)
+		buf.Write(make([]byte, int(saltSize)+16))
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte{MinCost, 16}},
+		{"cost above limit", header(MinCost+1, 16)},
+		{"cost above max", header(255, 16)},
+		{"salt too small", header(MinCost, MinSaltSize-1)},
+		{"salt above limit", header(MinCost, 17)},
+		{"oversized salt", header(MinCost, 0xffff)},
+		{"truncated salt", header(MinCost, 16)[:10]},
+	}
+
+	for _, test := range tests {
+		d := NewImmutableKeyDecrypter([]byte("pass")).Limit(MinCost, 16)
+		if err := d.Decrypt(bytes.NewReader(test.input), &bytes.Buffer{}); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+		if d.key != nil {
+			t.Errorf("%s: derived a key", test.name)
+		}
+	}
+}
+
+func TestDecryptHeaderChanged(t *testing.T) {
+	first := encrypter(t, "pass", 16, MinCost)
+	tests := []struct {
+		name string
+		e    *ImmutableKeyEncrypter
+	}{
+		{"cost", &ImmutableKeyEncrypter{key: first.key, salt: first.salt, saltSize: first.saltSize, cost: MinCost + 1}},
+		{"salt", encrypter(t, "pass", 16, MinCost)},
+		{"salt size", encrypter(t, "pass", 17, MinCost)},
+	}
+
+	for _, test := range tests {
+		d := NewImmutableKeyDecrypter([]byte("pass")).Limit(MinCost+1, 17)
+		if err := d.Decrypt(bytes.NewReader(ciphertext(t, first, []byte("frame"))), &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+
+		err := d.Decrypt(bytes.NewReader(ciphertext(t, test.e, []byte("frame"))), &bytes.Buffer{})
+		if err != ErrHeaderChanged {
+			t.Errorf("%s changed mid-session: got %v, want %v", test.name, err, ErrHeaderChanged)
+		}
+
+		if err := d.Decrypt(bytes.NewReader(ciphertext(t, first, []byte("frame"))), &bytes.Buffer{}); err != nil {
+			t.Errorf("%s: original header rejected after a change: %s", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// +build gofuzz
+
+package crypto
+
+import (
+	"bytes"
+	"io/ioutil"
+)
+
+// FuzzDecrypt feeds arbitrary input to a decrypter, as a hostile server
+// would.
+//   go-fuzz-build -func FuzzDecrypt && go-fuzz
+func FuzzDecrypt(data []byte) int {
+	d := NewImmutableKeyDecrypter([]byte("fuzz")).Limit(MinCost, MaxSaltSize)
+	if err := d.Decrypt(bytes.NewReader(data), ioutil.Discard); err != nil {
+		return 0
+	}
+
+	// Same header a second time must be accepted without deriving a new key.
+	if err := d.Decrypt(bytes.NewReader(data), ioutil.Discard); err != nil {
+		panic(err)
+	}
+
+	return 1
+}
+
+// FuzzHeader parses arbitrary encryption headers.
+//   go-fuzz-build -func FuzzHeader && go-fuzz
+func FuzzHeader(data []byte) int {
+	salt, iv, _, err := header(bytes.NewReader(data), MaxSaltSize)
+	if err != nil {
+		return 0
+	}
+
+	if len(salt) < MinSaltSize || len(salt) > MaxSaltSize || len(iv) != 16 {
+		panic("header returned invalid salt or iv")
+	}
+
+	return 1
+}
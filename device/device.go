@@ -0,0 +1,230 @@
+// Package device manages the Ed25519 keys clients authenticate with after
+// enrolling once using the password.
+package device
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var ErrNotFound = errors.New("No such device")
+
+// Fingerprint returns a short human readable identifier of a public key.
+func Fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Device is an enrolled client.
+type Device struct {
+	Name      string
+	PublicKey []byte
+	Enrolled  time.Time
+}
+
+func (d Device) Fingerprint() string { return Fingerprint(d.PublicKey) }
+
+// Store is the list of enrolled devices, persisted as json.
+// It is reloaded when the file changes so it can be edited while the server
+// is running.
+type Store struct {
+	sem     sync.Mutex
+	file    string
+	mod     time.Time
+	devices []Device
+}
+
+// DefaultStoreFile returns the devices file next to the given config file.
+func DefaultStoreFile(configFile string) string {
+	return filepath.Join(filepath.Dir(configFile), "devices.json")
+}
+
+// DefaultKeyFile returns the server key file next to the given config file.
+func DefaultKeyFile(configFile string) string {
+	return filepath.Join(filepath.Dir(configFile), "server.key")
+}
+
+func NewStore(file string) (*Store, error) {
+	s := &Store{file: file}
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	return s, s.reload()
+}
+
+func (s *Store) reload() error {
+	st, err := os.Stat(s.file)
+	if os.IsNotExist(err) {
+		s.devices = nil
+		s.mod = time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if st.ModTime().Equal(s.mod) {
+		return nil
+	}
+
+	d, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+
+	var devices []Device
+	if err := json.Unmarshal(d, &devices); err != nil {
+		return fmt.Errorf("Invalid devices file %s: %s", s.file, err)
+	}
+
+	s.devices = devices
+	s.mod = st.ModTime()
+	return nil
+}
+
+func (s *Store) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		return err
+	}
+
+	d, err := json.MarshalIndent(s.devices, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, d, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, s.file); err != nil {
+		return err
+	}
+
+	st, err := os.Stat(s.file)
+	if err != nil {
+		return err
+	}
+	s.mod = st.ModTime()
+	return nil
+}
+
+// List returns all enrolled devices sorted by name.
+func (s *Store) List() ([]Device, error) {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	l := make([]Device, len(s.devices))
+	copy(l, s.devices)
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	return l, nil
+}
+
+// Enroll adds a device, replacing one with the same name.
+func (s *Store) Enroll(name string, pub []byte) (Device, error) {
+	d := Device{Name: strings.TrimSpace(name), PublicKey: pub, Enrolled: time.Now()}
+	if d.Name == "" {
+		return d, errors.New("Device name can not be empty")
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return d, errors.New("Invalid public key")
+	}
+
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if err := s.reload(); err != nil {
+		return d, err
+	}
+
+	devices := make([]Device, 0, len(s.devices)+1)
+	for _, dev := range s.devices {
+		if dev.Name != d.Name {
+			devices = append(devices, dev)
+		}
+	}
+	s.devices = append(devices, d)
+	return d, s.save()
+}
+
+// Revoke removes the device with the given name or fingerprint.
+func (s *Store) Revoke(nameOrFingerprint string) (Device, error) {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if err := s.reload(); err != nil {
+		return Device{}, err
+	}
+
+	for i, dev := range s.devices {
+		if dev.Name == nameOrFingerprint || dev.Fingerprint() == nameOrFingerprint {
+			s.devices = append(s.devices[:i], s.devices[i+1:]...)
+			return dev, s.save()
+		}
+	}
+
+	return Device{}, ErrNotFound
+}
+
+// Lookup returns the enrolled device with the given public key.
+func (s *Store) Lookup(pub []byte) (Device, error) {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if err := s.reload(); err != nil {
+		return Device{}, err
+	}
+
+	for _, dev := range s.devices {
+		if string(dev.PublicKey) == string(pub) {
+			return dev, nil
+		}
+	}
+
+	return Device{}, ErrNotFound
+}
+
+// LoadOrCreateKey loads the private key stored in file, creating one if it
+// does not exist yet.
+func LoadOrCreateKey(file string) (ed25519.PrivateKey, error) {
+	d, err := ioutil.ReadFile(file)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(d)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("Invalid key in %s", file)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = f.WriteString(hex.EncodeToString(key.Seed()) + "\n")
+	return key, err
+}
@@ -0,0 +1,96 @@
+package device
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Identity is what a client needs to authenticate as an enrolled device.
+type Identity struct {
+	Name       string
+	PrivateKey ed25519.PrivateKey
+	// ServerKey is the public key the server proved to own at enrollment.
+	ServerKey ed25519.PublicKey
+}
+
+// NewIdentity generates a new key pair, the server key is filled in after
+// enrolling.
+func NewIdentity(name string) (*Identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{Name: name, PrivateKey: key}, nil
+}
+
+func (i *Identity) PublicKey() ed25519.PublicKey {
+	return i.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+func (i *Identity) Fingerprint() string { return Fingerprint(i.PublicKey()) }
+
+func DefaultIdentityFile() (string, error) {
+	home, err := os.UserHomeDir()
+	return filepath.Join(home, ".config", "homecam", "identity.json"), err
+}
+
+func loadIdentities(file string) (map[string]*Identity, error) {
+	l := make(map[string]*Identity)
+	d, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return l, json.Unmarshal(d, &l)
+}
+
+// LoadIdentity returns the identity enrolled with the server at addr, or nil
+// if this client was never enrolled there.
+func LoadIdentity(file, addr string) (*Identity, error) {
+	l, err := loadIdentities(file)
+	if err != nil {
+		return nil, err
+	}
+
+	i := l[addr]
+	if i != nil && (len(i.PrivateKey) != ed25519.PrivateKeySize ||
+		len(i.ServerKey) != ed25519.PublicKeySize) {
+		return nil, nil
+	}
+
+	return i, nil
+}
+
+// SaveIdentity stores the identity for the server at addr, a nil identity
+// removes it.
+func SaveIdentity(file, addr string, i *Identity) error {
+	l, err := loadIdentities(file)
+	if err != nil {
+		return err
+	}
+
+	if i == nil {
+		delete(l, addr)
+	} else {
+		l[addr] = i
+	}
+
+	d, err := json.MarshalIndent(l, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, d, 0600)
+}
@@ -0,0 +1,174 @@
+package device
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const PairingScheme = "homecam"
+
+var ErrNoPairing = errors.New("No pairing token pending, run the pair command")
+
+func DefaultPairingFile(configFile string) string {
+	return filepath.Join(filepath.Dir(configFile), "pairing.json")
+}
+
+type pairing struct {
+	Token   string
+	Expires time.Time
+}
+
+// Pairing holds the one-time token that lets a single new device enroll
+// without knowing the password. The file is shared between the pair
+// command and the running server.
+type Pairing struct {
+	sem  sync.Mutex
+	file string
+}
+
+func NewPairing(file string) *Pairing {
+	return &Pairing{file: file}
+}
+
+// Create replaces any pending token with a new one valid for ttl.
+func (p *Pairing) Create(ttl time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	pending := pairing{Token: hex.EncodeToString(b), Expires: time.Now().Add(ttl)}
+	d, err := json.Marshal(pending)
+	if err != nil {
+		return "", err
+	}
+
+	p.sem.Lock()
+	defer p.sem.Unlock()
+	if err := os.MkdirAll(filepath.Dir(p.file), 0755); err != nil {
+		return "", err
+	}
+
+	tmp := p.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, d, 0600); err != nil {
+		return "", err
+	}
+
+	return pending.Token, os.Rename(tmp, p.file)
+}
+
+func (p *Pairing) load() (pairing, error) {
+	var pending pairing
+	d, err := ioutil.ReadFile(p.file)
+	if os.IsNotExist(err) {
+		return pending, ErrNoPairing
+	} else if err != nil {
+		return pending, err
+	}
+
+	if err := json.Unmarshal(d, &pending); err != nil {
+		return pending, err
+	}
+
+	if time.Now().After(pending.Expires) {
+		os.Remove(p.file)
+		return pending, errors.New("Pairing token expired")
+	}
+
+	return pending, nil
+}
+
+// Token returns the pending token.
+func (p *Pairing) Token() (string, error) {
+	p.sem.Lock()
+	defer p.sem.Unlock()
+	pending, err := p.load()
+	return pending.Token, err
+}
+
+// Consume invalidates token, it fails if token was already used.
+func (p *Pairing) Consume(token string) error {
+	p.sem.Lock()
+	defer p.sem.Unlock()
+	pending, err := p.load()
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(pending.Token), []byte(token)) != 1 {
+		return errors.New("Pairing token already used")
+	}
+
+	return os.Remove(p.file)
+}
+
+// PairingURI is everything a client needs to add a server profile and
+// enroll itself:
+// homecam://host:port?name=..&key=..&token=..[&tls=..]
+type PairingURI struct {
+	Name    string
+	Address string
+	// ServerKey is the server's device authentication key.
+	ServerKey ed25519.PublicKey
+	Token     string
+	// TLS is the certificate fingerprint if the server uses TLS.
+	TLS string
+}
+
+func (p PairingURI) String() string {
+	q := url.Values{}
+	q.Set("name", p.Name)
+	q.Set("key", base64.RawURLEncoding.EncodeToString(p.ServerKey))
+	q.Set("token", p.Token)
+	if p.TLS != "" {
+		q.Set("tls", p.TLS)
+	}
+
+	u := url.URL{Scheme: PairingScheme, Host: p.Address, RawQuery: q.Encode()}
+	return u.String()
+}
+
+func ParsePairingURI(uri string) (PairingURI, error) {
+	var p PairingURI
+	u, err := url.Parse(uri)
+	if err != nil {
+		return p, err
+	}
+	if u.Scheme != PairingScheme {
+		return p, fmt.Errorf("Not a %s:// pairing URI", PairingScheme)
+	}
+
+	q := u.Query()
+	p.Name = q.Get("name")
+	p.Address = u.Host
+	p.Token = q.Get("token")
+	p.TLS = q.Get("tls")
+	if p.Name == "" {
+		p.Name = u.Hostname()
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(q.Get("key"))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return p, errors.New("Pairing URI contains an invalid server key")
+	}
+	p.ServerKey = key
+
+	if p.Address == "" || p.Token == "" {
+		return p, errors.New("Pairing URI is missing the address or token")
+	}
+
+	return p, nil
+}
@@ -0,0 +1,392 @@
+// Package discovery advertises and finds homecam servers on the local
+// network using multicast DNS service discovery (RFC 6762, RFC 6763).
+package discovery
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Group is the mDNS multicast group and port.
+const Group = "224.0.0.251:5353"
+
+const ttl = 120
+
+var (
+	local       = name{"local"}
+	serviceName = local.child("_tcp").child("_homecam")
+	// metaName lists all service types (RFC 6763 9).
+	metaName = local.child("_udp").child("_dns-sd").child("_services")
+)
+
+// Service is an advertised homecam server.
+type Service struct {
+	// Instance is the name shown to users.
+	Instance string
+	Host     string
+	Port     int
+	// Address is the host:port the service was seen on, only set by Browse.
+	Address string
+	// Version is the newest protocol version the server speaks.
+	Version uint16
+	Cameras []string
+	// ID is the fingerprint of the server's device key, used to match a
+	// discovered server to a profile.
+	ID string
+}
+
+func (s Service) instanceName() name { return serviceName.child(s.Instance) }
+func (s Service) hostName() name     { return local.child(s.Host) }
+
+func (s Service) txt() []string {
+	cameras := make([]string, len(s.Cameras))
+	for i := range s.Cameras {
+		cameras[i] = strings.Replace(s.Cameras[i], ",", " ", -1)
+	}
+
+	return []string{
+		"txtvers=1",
+		"version=" + strconv.Itoa(int(s.Version)),
+		"cameras=" + strings.Join(cameras, ","),
+		"id=" + s.ID,
+	}
+}
+
+func (s *Service) parseTXT(txt []string) {
+	for _, kv := range txt {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			continue
+		}
+		switch strings.ToLower(p[0]) {
+		case "version":
+			v, _ := strconv.Atoi(p[1])
+			s.Version = uint16(v)
+		case "cameras":
+			s.Cameras = nil
+			if p[1] != "" {
+				s.Cameras = strings.Split(p[1], ",")
+			}
+		case "id":
+			s.ID = p[1]
+		}
+	}
+}
+
+// Responder answers mDNS queries for a single service.
+type Responder struct {
+	l       *log.Logger
+	service Service
+
+	sem    sync.Mutex
+	conn   *net.UDPConn
+	group  *net.UDPAddr
+	closed bool
+}
+
+// NewResponder advertises s, an empty Host or Instance defaults to the
+// hostname.
+func NewResponder(l *log.Logger, s Service) *Responder {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "homecam"
+	}
+	host = strings.SplitN(host, ".", 2)[0]
+	if s.Host == "" {
+		s.Host = host
+	}
+	if s.Instance == "" {
+		s.Instance = host
+	}
+
+	return &Responder{l: l, service: s}
+}
+
+// ListenAndServe joins the mDNS multicast group on all interfaces and
+// answers queries until Close is called.
+func (r *Responder) ListenAndServe() error {
+	group, err := net.ResolveUDPAddr("udp4", Group)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+
+	return r.Serve(conn, group)
+}
+
+// Serve answers queries read from conn, announcements and multicast
+// responses are sent to group.
+func (r *Responder) Serve(conn *net.UDPConn, group *net.UDPAddr) error {
+	r.sem.Lock()
+	if r.closed {
+		r.sem.Unlock()
+		conn.Close()
+		return nil
+	}
+	r.conn, r.group = conn, group
+	r.sem.Unlock()
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			r.send(r.response(ttl), group)
+			time.Sleep(time.Second)
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			r.sem.Lock()
+			closed := r.closed
+			r.sem.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		m, err := parse(buf[:n])
+		if err != nil || m.flags&flagResponse != 0 {
+			continue
+		}
+		r.answer(m, from)
+	}
+}
+
+// Close sends a goodbye so browsers forget the service and stops Serve.
+func (r *Responder) Close() error {
+	r.sem.Lock()
+	conn, group := r.conn, r.group
+	r.sem.Unlock()
+	if conn != nil {
+		r.send(message{flags: flagResponse | flagAuthoritative, answers: r.response(0).answers}, group)
+	}
+
+	r.sem.Lock()
+	r.closed = true
+	r.sem.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+func (r *Responder) send(m message, to *net.UDPAddr) {
+	r.sem.Lock()
+	conn, closed := r.conn, r.closed
+	r.sem.Unlock()
+	if closed {
+		return
+	}
+	if _, err := conn.WriteToUDP(pack(m), to); err != nil {
+		r.l.Printf("Discovery: %s", err)
+	}
+}
+
+func (r *Responder) ips() []net.IP {
+	var ips, loopback []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.To4() == nil {
+			continue
+		}
+		if n.IP.IsLoopback() {
+			loopback = append(loopback, n.IP)
+			continue
+		}
+		ips = append(ips, n.IP)
+	}
+
+	if len(ips) == 0 {
+		return loopback
+	}
+	return ips
+}
+
+func (r *Responder) ptr(ttl uint32) record {
+	return record{
+		name:   serviceName,
+		typ:    typePTR,
+		class:  classIN,
+		ttl:    ttl,
+		target: r.service.instanceName(),
+	}
+}
+
+// response is the full answer to a browse.
+func (r *Responder) response(ttl uint32) message {
+	s := r.service
+	m := message{flags: flagResponse | flagAuthoritative, answers: []record{r.ptr(ttl)}}
+	m.additional = []record{
+		{name: s.instanceName(), typ: typeSRV, class: classIN, ttl: ttl, port: uint16(s.Port), target: s.hostName()},
+		{name: s.instanceName(), typ: typeTXT, class: classIN, ttl: ttl, txt: s.txt()},
+	}
+	for _, ip := range r.ips() {
+		m.additional = append(m.additional, record{name: s.hostName(), typ: typeA, class: classIN, ttl: ttl, ip: ip})
+	}
+
+	return m
+}
+
+func (r *Responder) answer(q message, from *net.UDPAddr) {
+	r.sem.Lock()
+	group := r.group
+	r.sem.Unlock()
+
+	full := r.response(ttl)
+	// Queries not sent from the mDNS port are legacy unicast queries and
+	// are answered like a regular DNS server would (RFC 6762 6.7).
+	legacy := from.Port != group.Port
+	unicast := legacy
+	var answers []record
+	for _, question := range q.questions {
+		if question.class&classTopBit != 0 {
+			unicast = true
+		}
+
+		if question.typ == typePTR || question.typ == typeANY {
+			switch {
+			case question.name.equal(serviceName):
+				answers = append(answers, full.answers...)
+			case question.name.equal(metaName):
+				answers = append(answers, record{
+					name:   metaName,
+					typ:    typePTR,
+					class:  classIN,
+					ttl:    ttl,
+					target: serviceName,
+				})
+			}
+		}
+
+		for _, rec := range full.additional {
+			if question.name.equal(rec.name) && (question.typ == rec.typ || question.typ == typeANY) {
+				answers = append(answers, rec)
+			}
+		}
+	}
+
+	if len(answers) == 0 {
+		return
+	}
+
+	reply := message{flags: flagResponse | flagAuthoritative, answers: answers}
+	if answers[0].name.equal(serviceName) {
+		reply.additional = full.additional
+	}
+	if legacy {
+		reply.id = q.id
+		reply.questions = q.questions
+	}
+
+	to := group
+	if unicast {
+		to = from
+	}
+	r.send(reply, to)
+}
+
+// Browse sends a query to group, Group if empty, and collects the services
+// that answer within timeout.
+func Browse(group string, timeout time.Duration) ([]Service, error) {
+	if group == "" {
+		group = Group
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query := message{
+		id:        uint16(rand.Intn(1 << 16)),
+		questions: []question{{name: serviceName, typ: typePTR, class: classIN}},
+	}
+	if _, err := conn.WriteToUDP(pack(query), addr); err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var services []Service
+	seen := make(map[string]bool)
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return services, nil
+			}
+			return services, err
+		}
+
+		m, err := parse(buf[:n])
+		if err != nil || m.flags&flagResponse == 0 {
+			continue
+		}
+
+		for _, s := range found(m, from) {
+			if seen[s.Instance+s.Address] {
+				continue
+			}
+			seen[s.Instance+s.Address] = true
+			services = append(services, s)
+		}
+	}
+}
+
+// found extracts the services in a response, their address is the
+// source of the response which is known to be reachable.
+func found(m message, from *net.UDPAddr) []Service {
+	records := append(m.answers, m.additional...)
+	var list []Service
+	for _, ptr := range records {
+		if ptr.typ != typePTR || ptr.ttl == 0 || !ptr.name.equal(serviceName) || len(ptr.target) == 0 {
+			continue
+		}
+
+		s := Service{Instance: ptr.target[0]}
+		for _, r := range records {
+			if !r.name.equal(ptr.target) {
+				continue
+			}
+			switch r.typ {
+			case typeSRV:
+				s.Port = int(r.port)
+				if len(r.target) != 0 {
+					s.Host = r.target[0]
+				}
+			case typeTXT:
+				s.parseTXT(r.txt)
+			}
+		}
+
+		if s.Port == 0 {
+			continue
+		}
+		s.Address = net.JoinHostPort(from.IP.String(), strconv.Itoa(s.Port))
+		list = append(list, s)
+	}
+
+	return list
+}
@@ -0,0 +1,68 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBrowse(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Service{
+		Instance: "Living room",
+		Host:     "cam",
+		Port:     1234,
+		Version:  3,
+		Cameras:  []string{"/dev/video0", "front, door"},
+		ID:       "ab:cd",
+	}
+	r := NewResponder(log.New(ioutil.Discard, "", 0), s)
+	group := conn.LocalAddr().(*net.UDPAddr)
+	served := make(chan error, 1)
+	go func() { served <- r.Serve(conn, group) }()
+
+	services, err := Browse(group.String(), time.Millisecond*500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := s
+	want.Address = "127.0.0.1:1234"
+	want.Cameras = []string{"/dev/video0", "front  door"}
+	if len(services) != 1 || !reflect.DeepEqual(services[0], want) {
+		t.Errorf("got %+v, want %+v", services, want)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Serve did not return after Close")
+	}
+}
+
+func TestBrowseGoodbye(t *testing.T) {
+	m := message{
+		flags:   flagResponse,
+		answers: []record{{name: serviceName, typ: typePTR, class: classIN, ttl: 0, target: serviceName.child("gone")}},
+		additional: []record{
+			{name: serviceName.child("gone"), typ: typeSRV, class: classIN, port: 1234, target: local.child("cam")},
+		},
+	}
+
+	if l := found(m, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); len(l) != 0 {
+		t.Errorf("goodbye reported as %+v", l)
+	}
+}
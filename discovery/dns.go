@@ -0,0 +1,314 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	typeA   uint16 = 1
+	typePTR uint16 = 12
+	typeTXT uint16 = 16
+	typeSRV uint16 = 33
+	typeANY uint16 = 255
+
+	classIN uint16 = 1
+	// classTopBit requests a unicast response in questions (RFC 6762 5.4).
+	classTopBit uint16 = 1 << 15
+
+	flagResponse      uint16 = 1 << 15
+	flagAuthoritative uint16 = 1 << 10
+)
+
+var errTruncated = errors.New("Truncated DNS message")
+
+// name is a domain name as a list of labels, which unlike the dotted form
+// allows instance names containing dots.
+type name []string
+
+func (n name) String() string { return strings.Join(n, ".") + "." }
+
+func (n name) equal(o name) bool {
+	if len(n) != len(o) {
+		return false
+	}
+	for i := range n {
+		if !strings.EqualFold(n[i], o[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n name) child(label string) name {
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	c := make(name, 0, len(n)+1)
+	return append(append(c, label), n...)
+}
+
+type question struct {
+	name  name
+	typ   uint16
+	class uint16
+}
+
+type record struct {
+	name  name
+	typ   uint16
+	class uint16
+	ttl   uint32
+
+	// target of PTR and SRV records.
+	target name
+	port   uint16
+	txt    []string
+	ip     net.IP
+}
+
+type message struct {
+	id         uint16
+	flags      uint16
+	questions  []question
+	answers    []record
+	additional []record
+}
+
+type builder struct{ bytes.Buffer }
+
+func (b *builder) u16(v uint16) {
+	var d [2]byte
+	binary.BigEndian.PutUint16(d[:], v)
+	b.Write(d[:])
+}
+
+func (b *builder) u32(v uint32) {
+	var d [4]byte
+	binary.BigEndian.PutUint32(d[:], v)
+	b.Write(d[:])
+}
+
+func (b *builder) name(n name) {
+	for _, l := range n {
+		b.WriteByte(byte(len(l)))
+		b.WriteString(l)
+	}
+	b.WriteByte(0)
+}
+
+func (b *builder) record(r record) {
+	b.name(r.name)
+	b.u16(r.typ)
+	b.u16(r.class)
+	b.u32(r.ttl)
+
+	data := &builder{}
+	switch r.typ {
+	case typePTR:
+		data.name(r.target)
+	case typeSRV:
+		data.u16(0)
+		data.u16(0)
+		data.u16(r.port)
+		data.name(r.target)
+	case typeTXT:
+		for _, s := range r.txt {
+			if len(s) > 255 {
+				s = s[:255]
+			}
+			data.WriteByte(byte(len(s)))
+			data.WriteString(s)
+		}
+	case typeA:
+		data.Write(r.ip.To4())
+	}
+
+	b.u16(uint16(data.Len()))
+	b.Write(data.Bytes())
+}
+
+// pack encodes m without name compression.
+func pack(m message) []byte {
+	b := &builder{}
+	b.u16(m.id)
+	b.u16(m.flags)
+	b.u16(uint16(len(m.questions)))
+	b.u16(uint16(len(m.answers)))
+	b.u16(0)
+	b.u16(uint16(len(m.additional)))
+
+	for _, q := range m.questions {
+		b.name(q.name)
+		b.u16(q.typ)
+		b.u16(q.class)
+	}
+	for _, r := range m.answers {
+		b.record(r)
+	}
+	for _, r := range m.additional {
+		b.record(r)
+	}
+
+	return b.Bytes()
+}
+
+type parser struct {
+	d   []byte
+	off int
+}
+
+func (p *parser) u16() (uint16, error) {
+	if p.off+2 > len(p.d) {
+		return 0, errTruncated
+	}
+	v := binary.BigEndian.Uint16(p.d[p.off:])
+	p.off += 2
+	return v, nil
+}
+
+func (p *parser) u32() (uint32, error) {
+	if p.off+4 > len(p.d) {
+		return 0, errTruncated
+	}
+	v := binary.BigEndian.Uint32(p.d[p.off:])
+	p.off += 4
+	return v, nil
+}
+
+// name reads a possibly compressed name at the current offset.
+func (p *parser) name() (name, error) {
+	var n name
+	off := p.off
+	jumped := false
+	for hops := 0; ; hops++ {
+		if off >= len(p.d) || hops > 127 {
+			return nil, errTruncated
+		}
+
+		l := int(p.d[off])
+		switch {
+		case l == 0:
+			if !jumped {
+				p.off = off + 1
+			}
+			return n, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(p.d) {
+				return nil, errTruncated
+			}
+			if !jumped {
+				p.off = off + 2
+			}
+			jumped = true
+			off = int(binary.BigEndian.Uint16(p.d[off:]) & 0x3fff)
+		case l&0xc0 != 0:
+			return nil, errors.New("Invalid DNS label")
+		default:
+			if off+1+l > len(p.d) {
+				return nil, errTruncated
+			}
+			n = append(n, string(p.d[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+func (p *parser) record() (record, error) {
+	var r record
+	var err error
+	if r.name, err = p.name(); err != nil {
+		return r, err
+	}
+	if r.typ, err = p.u16(); err != nil {
+		return r, err
+	}
+	if r.class, err = p.u16(); err != nil {
+		return r, err
+	}
+	if r.ttl, err = p.u32(); err != nil {
+		return r, err
+	}
+
+	l, err := p.u16()
+	if err != nil {
+		return r, err
+	}
+	end := p.off + int(l)
+	if end > len(p.d) {
+		return r, errTruncated
+	}
+
+	switch r.typ {
+	case typePTR:
+		r.target, err = p.name()
+	case typeSRV:
+		p.off += 4
+		if r.port, err = p.u16(); err == nil {
+			r.target, err = p.name()
+		}
+	case typeTXT:
+		for p.off < end {
+			n := int(p.d[p.off])
+			if p.off+1+n > end {
+				return r, errTruncated
+			}
+			r.txt = append(r.txt, string(p.d[p.off+1:p.off+1+n]))
+			p.off += 1 + n
+		}
+	case typeA:
+		if l == net.IPv4len {
+			r.ip = net.IP(append([]byte{}, p.d[p.off:end]...))
+		}
+	}
+
+	p.off = end
+	return r, err
+}
+
+func parse(d []byte) (message, error) {
+	var m message
+	p := &parser{d: d}
+	var counts [6]uint16
+	for i := range counts {
+		var err error
+		if counts[i], err = p.u16(); err != nil {
+			return m, err
+		}
+	}
+	m.id, m.flags = counts[0], counts[1]
+
+	for i := 0; i < int(counts[2]); i++ {
+		var q question
+		var err error
+		if q.name, err = p.name(); err != nil {
+			return m, err
+		}
+		if q.typ, err = p.u16(); err != nil {
+			return m, err
+		}
+		if q.class, err = p.u16(); err != nil {
+			return m, err
+		}
+		m.questions = append(m.questions, q)
+	}
+
+	// Authority records are parsed as additional records, neither the
+	// responder nor the browser distinguishes them.
+	for i := 0; i < int(counts[3])+int(counts[4])+int(counts[5]); i++ {
+		r, err := p.record()
+		if err != nil {
+			return m, err
+		}
+		if i < int(counts[3]) {
+			m.answers = append(m.answers, r)
+			continue
+		}
+		m.additional = append(m.additional, r)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,75 @@
+package discovery
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPackParse(t *testing.T) {
+	instance := serviceName.child("living.room")
+	m := message{
+		id:        42,
+		flags:     flagResponse | flagAuthoritative,
+		questions: []question{{name: serviceName, typ: typePTR, class: classIN | classTopBit}},
+		answers: []record{
+			{name: serviceName, typ: typePTR, class: classIN, ttl: ttl, target: instance},
+		},
+		additional: []record{
+			{name: instance, typ: typeSRV, class: classIN, ttl: ttl, port: 1234, target: local.child("cam")},
+			{name: instance, typ: typeTXT, class: classIN, ttl: ttl, txt: []string{"a=1", "", "b=c,d"}},
+			{name: local.child("cam"), typ: typeA, class: classIN, ttl: 0, ip: net.IPv4(192, 168, 1, 2).To4()},
+		},
+	}
+
+	got, err := parse(pack(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("round trip\ngot  %+v\nwant %+v", got, m)
+	}
+	if got.answers[0].target[0] != "living.room" {
+		t.Errorf("instance label with a dot was split: %s", got.answers[0].target)
+	}
+}
+
+func TestParseCompressed(t *testing.T) {
+	d := []byte{
+		0, 1, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 0,
+		// offset 12: _homecam._tcp.local PTR
+		8, '_', 'h', 'o', 'm', 'e', 'c', 'a', 'm',
+		4, '_', 't', 'c', 'p',
+		5, 'l', 'o', 'c', 'a', 'l', 0,
+		0, 12, 0, 1, 0, 0, 0, 120,
+		0, 6,
+		// cam + pointer to offset 12
+		3, 'c', 'a', 'm', 0xc0, 12,
+	}
+
+	m, err := parse(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := serviceName.child("cam")
+	if len(m.answers) != 1 || !m.answers[0].target.equal(want) {
+		t.Errorf("got %+v, want target %s", m.answers, want)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	valid := pack(message{
+		flags:   flagResponse,
+		answers: []record{{name: serviceName, typ: typeTXT, class: classIN, txt: []string{"abc"}}},
+	})
+	for i := 0; i < len(valid); i++ {
+		if _, err := parse(valid[:i]); err == nil {
+			t.Errorf("no error for message truncated to %d bytes", i)
+		}
+	}
+
+	loop := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12, 0, 12, 0, 1}
+	if _, err := parse(loop); err == nil {
+		t.Error("no error for a compression loop")
+	}
+}
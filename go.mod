@@ -10,4 +10,5 @@ require (
 	golang.org/x/exp v0.0.0-20190731235908-ec7cb31e5a56
 	golang.org/x/image v0.0.0-20190802002840-cff245a6509b
 	golang.org/x/mobile v0.0.0-20190826170111-cafc553e1ac5
+	rsc.io/qr v0.2.0
 )
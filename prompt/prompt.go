@@ -0,0 +1,284 @@
+// Package prompt asks questions on a terminal, including touch passwords
+// entered with the arrow keys.
+package prompt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/frizinak/inbetween-go-homecam/config"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var ErrInterrupted = errors.New("Interrupted")
+
+// keypad maps the numeric keypad to the touch password arrows.
+var keypad = map[rune]rune{
+	'8': '↑',
+	'2': '↓',
+	'6': '→',
+	'4': '←',
+	'7': '↖',
+	'9': '↗',
+	'1': '↙',
+	'3': '↘',
+}
+
+// escapes maps the final bytes of terminal escape sequences to arrows,
+// home, page up, end and page down are used for the diagonals.
+var escapes = map[string]rune{
+	"A":  '↑',
+	"B":  '↓',
+	"C":  '→',
+	"D":  '←',
+	"H":  '↖',
+	"1~": '↖',
+	"7~": '↖',
+	"5~": '↗',
+	"F":  '↙',
+	"4~": '↙',
+	"8~": '↙',
+	"6~": '↘',
+}
+
+type Prompt struct {
+	in *os.File
+	r  *bufio.Reader
+	w  io.Writer
+}
+
+func New(in *os.File, out io.Writer) *Prompt {
+	return &Prompt{in: in, r: bufio.NewReader(in), w: out}
+}
+
+func (p *Prompt) terminal() bool { return terminal.IsTerminal(int(p.in.Fd())) }
+
+func (p *Prompt) readLine() (string, error) {
+	l, err := p.r.ReadString('\n')
+	if err != nil && (err != io.EOF || l == "") {
+		return "", err
+	}
+	return strings.TrimRight(l, "\r\n"), nil
+}
+
+// Line asks a question, an empty answer returns def.
+func (p *Prompt) Line(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.w, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.w, "%s: ", question)
+	}
+
+	l, err := p.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	l = strings.TrimSpace(l)
+	if l == "" {
+		return def, nil
+	}
+	return l, nil
+}
+
+func (p *Prompt) Int(question string, def int) (int, error) {
+	for {
+		l, err := p.Line(question, strconv.Itoa(def))
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := strconv.Atoi(l)
+		if err == nil {
+			return n, nil
+		}
+		fmt.Fprintf(p.w, "'%s' is not a number\n", l)
+	}
+}
+
+func (p *Prompt) Bool(question string, def bool) (bool, error) {
+	d := "y/N"
+	if def {
+		d = "Y/n"
+	}
+
+	for {
+		l, err := p.Line(question+" ["+d+"]", "")
+		if err != nil {
+			return false, err
+		}
+
+		switch strings.ToLower(l) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+		fmt.Fprintln(p.w, "Answer y or n")
+	}
+}
+
+// Password reads a line without echoing it if the input is a terminal.
+func (p *Prompt) Password(question string) (string, error) {
+	fmt.Fprintf(p.w, "%s: ", question)
+	if !p.terminal() {
+		return p.readLine()
+	}
+
+	pass, err := terminal.ReadPassword(int(p.in.Fd()))
+	fmt.Fprintln(p.w)
+	return string(pass), err
+}
+
+// NewPassword asks for a password twice until both match.
+func (p *Prompt) NewPassword(question string) (string, error) {
+	for {
+		pass, err := p.Password(question)
+		if err != nil {
+			return "", err
+		}
+		if pass == "" {
+			fmt.Fprintln(p.w, "Password can not be empty")
+			continue
+		}
+
+		repeat, err := p.Password("Repeat")
+		if err != nil {
+			return "", err
+		}
+		if pass == repeat {
+			return pass, nil
+		}
+		fmt.Fprintln(p.w, "Passwords do not match")
+	}
+}
+
+// Touch reads a touch password. On a terminal the arrow keys are used,
+// home, page up, end and page down for the diagonals. The numeric keypad
+// and the arrow characters themselves are accepted as well.
+func (p *Prompt) Touch(question string) (config.TouchPassword, error) {
+	if !p.terminal() {
+		fmt.Fprintf(p.w, "%s: ", question)
+		l, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return ParseTouch(l)
+	}
+
+	fmt.Fprintf(p.w, "%s (arrow keys, home/pgup/end/pgdn for diagonals, enter when done): ", question)
+	state, err := terminal.MakeRaw(int(p.in.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	defer terminal.Restore(int(p.in.Fd()), state)
+
+	var arrows []rune
+	for {
+		r, _, err := p.r.ReadRune()
+		if err != nil {
+			return nil, err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(p.w, "\r\n")
+			return ParseTouch(string(arrows))
+		case 3, 4:
+			fmt.Fprint(p.w, "\r\n")
+			return nil, ErrInterrupted
+		case 8, 127:
+			if len(arrows) != 0 {
+				arrows = arrows[:len(arrows)-1]
+				fmt.Fprint(p.w, "\b \b")
+			}
+			continue
+		case 0x1b:
+			if r, err = p.escape(); err != nil {
+				return nil, err
+			}
+		}
+
+		if k, ok := keypad[r]; ok {
+			r = k
+		}
+		if _, err := ParseTouch(string(r)); err != nil {
+			continue
+		}
+
+		arrows = append(arrows, r)
+		fmt.Fprint(p.w, "*")
+	}
+}
+
+// NewTouch asks for a touch password twice until both match.
+func (p *Prompt) NewTouch(question string) (config.TouchPassword, error) {
+	for {
+		touch, err := p.Touch(question)
+		if err != nil {
+			fmt.Fprintln(p.w, err)
+			if err == ErrInterrupted || err == io.EOF {
+				return nil, err
+			}
+			continue
+		}
+
+		repeat, err := p.Touch("Repeat")
+		if err != nil {
+			return nil, err
+		}
+		if touch.String() == repeat.String() {
+			return touch, nil
+		}
+		fmt.Fprintln(p.w, "Touch passwords do not match")
+	}
+}
+
+// escape reads the remainder of an escape sequence and returns its arrow or
+// 0 if it is not one.
+func (p *Prompt) escape() (rune, error) {
+	b, err := p.r.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0, err
+	}
+
+	var seq []byte
+	for {
+		b, err := p.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		seq = append(seq, b)
+		if b < '0' || b > '9' {
+			break
+		}
+	}
+
+	return escapes[string(seq)], nil
+}
+
+// ParseTouch parses a touch password written as arrows or keypad digits.
+func ParseTouch(s string) (config.TouchPassword, error) {
+	arrows := []rune(strings.TrimSpace(s))
+	for i := range arrows {
+		if k, ok := keypad[arrows[i]]; ok {
+			arrows[i] = k
+		}
+	}
+
+	touch := config.Config{TouchPassword: string(arrows)}.RawTouchPassword()
+	if touch == nil {
+		return nil, errors.New("Touch password can only contain arrows (↑↓→←↖↗↙↘) or keypad digits")
+	}
+	if len(touch) == 0 {
+		return nil, errors.New("Touch password can not be empty")
+	}
+	return touch, nil
+}
@@ -0,0 +1,82 @@
+package prompt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// input returns a file containing s, the caller closes and removes it.
+func input(t *testing.T, s string) *os.File {
+	f, err := ioutil.TempFile("", "homecam-prompt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestBool(t *testing.T) {
+	tests := []struct {
+		in   string
+		def  bool
+		want []bool
+	}{
+		{"\n\ny\n", true, []bool{true, true, true}},
+		{"\n\ny\n", false, []bool{false, false, true}},
+		{"maybe\nN\nyes\n", true, []bool{false, true}},
+	}
+
+	for _, test := range tests {
+		in := input(t, test.in)
+		defer os.Remove(in.Name())
+		defer in.Close()
+		p := New(in, ioutil.Discard)
+		for i, want := range test.want {
+			got, err := p.Bool("Question", test.def)
+			if err != nil {
+				t.Fatalf("%q #%d: %s", test.in, i, err)
+			}
+			if got != want {
+				t.Errorf("%q #%d: got %t want %t", test.in, i, got, want)
+			}
+		}
+	}
+}
+
+func TestLineDefault(t *testing.T) {
+	in := input(t, "\n  value \n")
+	defer os.Remove(in.Name())
+	defer in.Close()
+	p := New(in, ioutil.Discard)
+	for _, want := range []string{"def", "value"} {
+		got, err := p.Line("Question", "def")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %q want %q", got, want)
+		}
+	}
+}
+
+func TestParseTouch(t *testing.T) {
+	touch, err := ParseTouch("8↑24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if touch.String() != "↑↑↓←" {
+		t.Errorf("got %s", touch.String())
+	}
+
+	for _, s := range []string{"", "x", "5"} {
+		if _, err := ParseTouch(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
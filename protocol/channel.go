@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+var ErrUnauthenticated = errors.New("Message failed authentication")
+
+const channelContext = "homecam-channel"
+
+const (
+	fromServer byte = 's'
+	fromClient byte = 'c'
+)
+
+// Channel encrypts and authenticates the messages that are not frames,
+// i.e. control commands, their replies and the one-time password exchange,
+// with the secret established by the handshake. Both sides number the
+// messages they seal, a message that was injected, modified, replayed or
+// reordered fails to open.
+type Channel struct {
+	aead cipher.AEAD
+
+	sem        sync.Mutex
+	send, recv uint64
+	out, in    byte
+}
+
+// NewChannel derives a channel from the session secret, server is set on
+// the side that ran HandshakeServer or HandshakeDeviceServer.
+func NewChannel(secret []byte, server bool) (*Channel, error) {
+	key := sha512.Sum512(append([]byte(channelContext), secret...))
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := &Channel{aead: aead, out: fromClient, in: fromServer}
+	if server {
+		ch.out, ch.in = ch.in, ch.out
+	}
+
+	return ch, nil
+}
+
+func (ch *Channel) nonce(dir byte, seq uint64) []byte {
+	n := make([]byte, ch.aead.NonceSize())
+	n[0] = dir
+	binary.BigEndian.PutUint64(n[len(n)-8:], seq)
+	return n
+}
+
+// Seal returns the payload of a message of type t. Messages must be
+// written in the order they were sealed.
+func (ch *Channel) Seal(t MessageType, payload []byte) []byte {
+	ch.sem.Lock()
+	defer ch.sem.Unlock()
+	n := ch.nonce(ch.out, ch.send)
+	ch.send++
+	return ch.aead.Seal(nil, n, payload, []byte{byte(t)})
+}
+
+// Open returns the plaintext of a sealed message or ErrUnauthenticated.
+func (ch *Channel) Open(m Message) ([]byte, error) {
+	ch.sem.Lock()
+	defer ch.sem.Unlock()
+	plain, err := ch.aead.Open(nil, ch.nonce(ch.in, ch.recv), m.Payload, []byte{byte(m.Type)})
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	ch.recv++
+	return plain, nil
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func channels(t *testing.T) (server, client *Channel) {
+	server, err := NewChannel([]byte("secret"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewChannel([]byte("secret"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestChannelRoundTrip(t *testing.T) {
+	server, client := channels(t)
+	for _, p := range [][]byte{nil, []byte("enroll"), bytes.Repeat([]byte{1}, 4096)} {
+		m := Message{MessageControl, client.Seal(MessageControl, p)}
+		if bytes.Contains(m.Payload, p) && len(p) != 0 {
+			t.Errorf("%dB: payload sent in plaintext", len(p))
+		}
+		b, err := server.Open(m)
+		if err != nil {
+			t.Fatalf("%dB: %s", len(p), err)
+		}
+		if !bytes.Equal(b, p) {
+			t.Errorf("%dB: got %dB back", len(p), len(b))
+		}
+
+		b, err = client.Open(Message{MessageTOTPResult, server.Seal(MessageTOTPResult, p)})
+		if err != nil || !bytes.Equal(b, p) {
+			t.Errorf("%dB: reply got %dB, %v", len(p), len(b), err)
+		}
+	}
+}
+
+func TestChannelRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		m    func(server, client *Channel) Message
+	}{
+		{"plaintext", func(s, c *Channel) Message {
+			return Message{MessageControl, []byte(`{"Command":"enroll"}`)}
+		}},
+		{"modified", func(s, c *Channel) Message {
+			p := c.Seal(MessageControl, []byte("devices"))
+			p[0] ^= 1
+			return Message{MessageControl, p}
+		}},
+		{"other type", func(s, c *Channel) Message {
+			return Message{MessageControl, c.Seal(MessageTOTPResponse, []byte("123456"))}
+		}},
+		{"other key", func(s, c *Channel) Message {
+			other, _ := NewChannel([]byte("other"), false)
+			return Message{MessageControl, other.Seal(MessageControl, []byte("devices"))}
+		}},
+		{"reflected", func(s, c *Channel) Message {
+			return Message{MessageControl, s.Seal(MessageControl, []byte("devices"))}
+		}},
+		{"reordered", func(s, c *Channel) Message {
+			c.Seal(MessageControl, []byte("first"))
+			return Message{MessageControl, c.Seal(MessageControl, []byte("second"))}
+		}},
+	}
+
+	for _, test := range tests {
+		server, client := channels(t)
+		if _, err := server.Open(test.m(server, client)); err != ErrUnauthenticated {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrUnauthenticated)
+		}
+	}
+}
+
+func TestChannelReplay(t *testing.T) {
+	server, client := channels(t)
+	m := Message{MessageControl, client.Seal(MessageControl, []byte("revoke"))}
+	if _, err := server.Open(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Open(m); err != ErrUnauthenticated {
+		t.Errorf("replay: got %v, want %v", err, ErrUnauthenticated)
+	}
+
+	next := Message{MessageControl, client.Seal(MessageControl, []byte("devices"))}
+	if _, err := server.Open(next); err != nil {
+		t.Errorf("a rejected message broke the channel: %s", err)
+	}
+}
+
+func TestSealed(t *testing.T) {
+	for _, typ := range []MessageType{MessageControl, MessageControlReply, MessageTOTPRequest, MessageTOTPResponse, MessageTOTPResult} {
+		if !typ.Sealed() {
+			t.Errorf("%s is not sealed", typ)
+		}
+	}
+	for _, typ := range []MessageType{MessageFrame, MessageKeepalive, MessageStatus, MessageError, MessagePoll} {
+		if typ.Sealed() {
+			t.Errorf("%s is sealed", typ)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/frizinak/inbetween-go-homecam/crypto"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+var ErrServerKey = errors.New("Server key does not match the one seen at enrollment")
+
+// AuthMethod is sent by the client right after negotiation if
+// FeatureDeviceAuth was negotiated.
+type AuthMethod uint8
+
+const (
+	// AuthPassword continues with HandshakeServer/HandshakeClient.
+	AuthPassword AuthMethod = iota
+	// AuthDevice continues with HandshakeDeviceServer/HandshakeDeviceClient.
+	AuthDevice
+	// AuthPair continues with HandshakeServer/HandshakeClient using a
+	// one-time pairing token as the password, the session can only be used
+	// to enroll. Requires FeaturePairing.
+	AuthPair
+)
+
+func WriteAuthMethod(w io.Writer, m AuthMethod) error {
+	_, err := w.Write([]byte{byte(m)})
+	return err
+}
+
+func ReadAuthMethod(r io.Reader) (AuthMethod, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+
+	m := AuthMethod(b[0])
+	if m > AuthPair {
+		return m, fmt.Errorf("Unknown auth method %d", m)
+	}
+
+	return m, nil
+}
+
+// Enrollment is the body of the reply to the "enroll" control command.
+type Enrollment struct {
+	ServerKey ed25519.PublicKey
+	// Signature over the enrolled device key proves the server holds
+	// ServerKey, see Verify.
+	Signature []byte
+}
+
+const enrollmentContext = "homecam-enrollment"
+
+// SignEnrollment returns the enrollment of the device key pub, signed
+// with the server's key.
+func SignEnrollment(key ed25519.PrivateKey, pub []byte) Enrollment {
+	return Enrollment{
+		ServerKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, append([]byte(enrollmentContext), pub...)),
+	}
+}
+
+// Verify returns ErrServerKey unless the enrollment of the device key pub
+// was signed with ServerKey. The device key is new, so the signature can
+// not have been replayed from an earlier enrollment.
+func (e Enrollment) Verify(pub []byte) error {
+	if len(e.ServerKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(e.ServerKey, append([]byte(enrollmentContext), pub...), e.Signature) {
+		return ErrServerKey
+	}
+	return nil
+}
+
+const deviceContext = "homecam-device-auth"
+
+// transcript is what both sides sign, binding the device key and both
+// ephemeral keys to this session.
+func transcript(device, clientEph, serverEph []byte, side string) []byte {
+	t := make([]byte, 0, len(deviceContext)+32*3+len(side))
+	t = append(t, deviceContext...)
+	t = append(t, device...)
+	t = append(t, clientEph...)
+	t = append(t, serverEph...)
+	return append(t, side...)
+}
+
+func ephemeral() (priv, pub *[32]byte, err error) {
+	priv, pub = new([32]byte), new([32]byte)
+	if _, err = rand.Read(priv[:]); err != nil {
+		return
+	}
+	curve25519.ScalarBaseMult(pub, priv)
+	return
+}
+
+// sessionPass derives the encryption passphrase from the ephemeral
+// diffie-hellman exchange.
+func sessionPass(priv *[32]byte, remote []byte, t []byte) ([]byte, error) {
+	var r, shared [32]byte
+	copy(r[:], remote)
+	curve25519.ScalarMult(&shared, priv, &r)
+	if subtle.ConstantTimeCompare(shared[:], make([]byte, 32)) == 1 {
+		return nil, ErrInvalidHandshake
+	}
+
+	sum := sha512.Sum512(append(shared[:], t...))
+	return sum[:], nil
+}
+
+// HandshakeDeviceServer authenticates an enrolled device by its Ed25519
+// signature and proves our own identity with key. The device's public key
+// is returned even if it was not enrolled.
+func (p *Protocol) HandshakeDeviceServer(
+	key ed25519.PrivateKey,
+	enrolled func(pub []byte) bool,
+	rw io.ReadWriter,
+) (*crypto.ImmutableKeyEncrypter, *Channel, ed25519.PublicKey, error) {
+	hello := make([]byte, ed25519.PublicKeySize+32)
+	if _, err := io.ReadFull(rw, hello); err != nil {
+		return nil, nil, nil, err
+	}
+	pub, clientEph := ed25519.PublicKey(hello[:ed25519.PublicKeySize]), hello[ed25519.PublicKeySize:]
+
+	priv, serverEph, err := ephemeral()
+	if err != nil {
+		return nil, nil, pub, err
+	}
+
+	sig := ed25519.Sign(key, transcript(pub, clientEph, serverEph[:], "server"))
+	if _, err := rw.Write(append(serverEph[:], sig...)); err != nil {
+		return nil, nil, pub, err
+	}
+
+	remoteSig := make([]byte, ed25519.SignatureSize)
+	if _, err := io.ReadFull(rw, remoteSig); err != nil {
+		return nil, nil, pub, err
+	}
+
+	t := transcript(pub, clientEph, serverEph[:], "client")
+	if !ed25519.Verify(pub, t, remoteSig) || !enrolled(pub) {
+		rw.Write(nok)
+		return nil, nil, pub, ErrInvalidHandshake
+	}
+
+	encryptionPass, err := sessionPass(priv, clientEph, t)
+	if err != nil {
+		rw.Write(nok)
+		return nil, nil, pub, err
+	}
+
+	ch, err := NewChannel(encryptionPass, true)
+	if err != nil {
+		rw.Write(nok)
+		return nil, nil, pub, err
+	}
+
+	rw.Write(ok)
+	crypter, err := crypto.NewImmutableKeyEncrypter(encryptionPass, encryptionSaltSize, p.encryptionCost)
+	return crypter, ch, pub, err
+}
+
+// deviceHello sends the device key pub and an ephemeral key and verifies
+// the server signed both with serverKey.
+func deviceHello(pub, serverKey ed25519.PublicKey, rw io.ReadWriter) (priv, clientEph *[32]byte, serverEph []byte, err error) {
+	if priv, clientEph, err = ephemeral(); err != nil {
+		return
+	}
+
+	if _, err = rw.Write(append(append([]byte{}, pub...), clientEph[:]...)); err != nil {
+		return
+	}
+
+	reply := make([]byte, 32+ed25519.SignatureSize)
+	if _, err = io.ReadFull(rw, reply); err != nil {
+		return
+	}
+	serverEph, sig := reply[:32], reply[32:]
+
+	if len(serverKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(serverKey, transcript(pub, clientEph[:], serverEph, "server"), sig) {
+		err = ErrServerKey
+	}
+	return
+}
+
+// VerifyServerKey checks the server owns serverKey by starting a device
+// handshake with a throwaway key and stopping once the server signed it,
+// the server sees the connection close before any device authenticated.
+func (p *Protocol) VerifyServerKey(serverKey ed25519.PublicKey, rw io.ReadWriter) error {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+
+	_, _, _, err = deviceHello(pub, serverKey, rw)
+	return err
+}
+
+// HandshakeDeviceClient authenticates with key and verifies the server
+// still owns serverKey.
+func (p *Protocol) HandshakeDeviceClient(
+	key ed25519.PrivateKey,
+	serverKey ed25519.PublicKey,
+	rw io.ReadWriter,
+) (*crypto.ImmutableKeyDecrypter, *Channel, error) {
+	pub := key.Public().(ed25519.PublicKey)
+	priv, clientEph, serverEph, err := deviceHello(pub, serverKey, rw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t := transcript(pub, clientEph[:], serverEph, "client")
+	if _, err := rw.Write(ed25519.Sign(key, t)); err != nil {
+		return nil, nil, err
+	}
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(rw, status); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(ok, status) {
+		return nil, nil, ErrDenied
+	}
+
+	decryptionPass, err := sessionPass(priv, serverEph, t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, err := NewChannel(decryptionPass, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return crypto.NewImmutableKeyDecrypter(decryptionPass).Limit(
+		p.encryptionCost,
+		encryptionSaltSize,
+	), ch, nil
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/frizinak/inbetween-go-homecam/crypto"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestEnrollment(t *testing.T) {
+	_, server, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := make([]byte, ed25519.PublicKeySize)
+	dev[0] = 1
+
+	e := SignEnrollment(server, dev)
+	if err := e.Verify(dev); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := e
+	forged.ServerKey = other.Public().(ed25519.PublicKey)
+	tests := []struct {
+		name string
+		e    Enrollment
+		pub  []byte
+	}{
+		{"other device", e, make([]byte, ed25519.PublicKeySize)},
+		{"echoed key", Enrollment{ServerKey: e.ServerKey}, dev},
+		{"other server", forged, dev},
+		{"no key", Enrollment{Signature: e.Signature}, dev},
+	}
+	for _, test := range tests {
+		if err := test.e.Verify(test.pub); err != ErrServerKey {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrServerKey)
+		}
+	}
+}
+
+func TestVerifyServerKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(crypto.MinCost, crypto.MinCost, 16, 32, Local(1<<16))
+	for _, test := range []struct {
+		key  ed25519.PublicKey
+		want error
+	}{
+		{key.Public().(ed25519.PublicKey), nil},
+		{other, ErrServerKey},
+	} {
+		s, c := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			_, _, _, err := p.HandshakeDeviceServer(key, func([]byte) bool { return true }, s)
+			done <- err
+		}()
+
+		err := p.VerifyServerKey(test.key, c)
+		c.Close()
+		if err != test.want {
+			t.Errorf("got %v, want %v", err, test.want)
+		}
+		if err := <-done; err != io.EOF {
+			t.Errorf("server got %v, want EOF", err)
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,63 @@
+// +build gofuzz
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/frizinak/inbetween-go-homecam/crypto"
+)
+
+// FuzzReadMessage parses arbitrary messages and frame payloads.
+//   go-fuzz-build -func FuzzReadMessage && go-fuzz
+func FuzzReadMessage(data []byte) int {
+	const max = 1 << 16
+	r := bytes.NewReader(data)
+	n := Negotiated{Features: FeaturePush | FeatureMetadata, MaxFrameSize: max}
+	score := 0
+	for {
+		m, err := ReadMessage(r, max)
+		if err != nil {
+			return score
+		}
+
+		if len(m.Payload) > max {
+			panic("ReadMessage exceeded max size")
+		}
+
+		switch m.Type {
+		case MessageFrame:
+			if _, _, err := ParseFrame(n, m.Payload); err == nil {
+				score = 1
+			}
+		case MessageKeepalive:
+			if _, err := ParseKeepalive(m.Payload); err == nil {
+				score = 1
+			}
+		}
+	}
+}
+
+// FuzzNegotiateClient feeds an arbitrary server hello and negotiation
+// result to a client.
+//   go-fuzz-build -func FuzzNegotiateClient && go-fuzz
+func FuzzNegotiateClient(data []byte) int {
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(data), ioutil.Discard}
+
+	p := New(crypto.MinCost, crypto.MinCost, 16, 32, Local(1<<16))
+	n, err := p.NegotiateClient(rw)
+	if err != nil {
+		return 0
+	}
+
+	if n.MaxFrameSize > 1<<16 {
+		panic("negotiated a larger frame size than offered")
+	}
+
+	return 1
+}
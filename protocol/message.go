@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+type MessageType uint8
+
+const (
+	// MessageFrame is an encrypted frame, see FrameMeta.
+	MessageFrame MessageType = iota + 1
+	// MessageKeepalive is a ping or pong, see Keepalive.
+	MessageKeepalive
+	// MessageStatus is a human readable status update from the server.
+	MessageStatus
+	// MessageError is sent by the server right before closing the connection.
+	MessageError
+	// MessageControlReply is the response to a MessageControl, sealed.
+	MessageControlReply
+	// MessagePoll requests the next frame (FeaturePoll only).
+	MessagePoll
+	// MessageControl is a command sent by the client, see Control, sealed.
+	MessageControl
+	// MessageTOTPRequest asks the client for a one-time password
+	// (FeatureTOTP only), sealed.
+	MessageTOTPRequest
+	// MessageTOTPResponse carries the one-time password entered by the user,
+	// sealed.
+	MessageTOTPResponse
+	// MessageTOTPResult is a single byte, 1 if the one-time password was
+	// accepted, 0 if not, sealed.
+	MessageTOTPResult
+)
+
+// Sealed reports whether messages of type t are sealed with the session's
+// Channel and must be rejected if they do not open.
+func (t MessageType) Sealed() bool {
+	switch t {
+	case MessageControl, MessageControlReply,
+		MessageTOTPRequest, MessageTOTPResponse, MessageTOTPResult:
+		return true
+	}
+	return false
+}
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageFrame:
+		return "frame"
+	case MessageKeepalive:
+		return "keepalive"
+	case MessageStatus:
+		return "status"
+	case MessageError:
+		return "error"
+	case MessageControlReply:
+		return "control-reply"
+	case MessagePoll:
+		return "poll"
+	case MessageControl:
+		return "control"
+	case MessageTOTPRequest:
+		return "totp-request"
+	case MessageTOTPResponse:
+		return "totp-response"
+	case MessageTOTPResult:
+		return "totp-result"
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// MessageTooLargeError is returned when a peer announces a message larger
+// than allowed.
+type MessageTooLargeError struct {
+	Size uint32
+	Max  uint32
+}
+
+func (m *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("Message of %dB exceeds max size of %dB", m.Size, m.Max)
+}
+
+// RemoteError is an error reported by the peer through a MessageError.
+type RemoteError struct {
+	Message string
+}
+
+func (r *RemoteError) Error() string { return r.Message }
+
+// WriteAdmission admits the client if err is nil and refuses it with err as
+// a MessageError otherwise. Only sent if FeatureAdmission was negotiated.
+func WriteAdmission(w io.Writer, err error) error {
+	if err == nil {
+		_, err := w.Write([]byte{1})
+		return err
+	}
+
+	if _, werr := w.Write([]byte{0}); werr != nil {
+		return werr
+	}
+	return WriteMessage(w, MessageError, []byte(err.Error()))
+}
+
+// ReadAdmission returns a *RemoteError if the server refused the client.
+func ReadAdmission(r io.Reader, max uint32) error {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	if b[0] == 1 {
+		return nil
+	}
+
+	m, err := ReadMessage(r, max)
+	if err != nil {
+		return err
+	}
+	return &RemoteError{Message: string(m.Payload)}
+}
+
+type Message struct {
+	Type    MessageType
+	Payload []byte
+}
+
+// WriteMessage writes a single message as a type byte, a uint32 payload
+// length and the payload.
+func WriteMessage(w io.Writer, t MessageType, payload []byte) error {
+	hdr := make([]byte, 5)
+	hdr[0] = byte(t)
+	binary.LittleEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	if _, err := w.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReadMessage reads a single message, refusing payloads larger than max.
+// Memory is allocated as the payload comes in rather than upfront, so a peer
+// announcing a large message and never sending it costs us nothing.
+func ReadMessage(r io.Reader, max uint32) (Message, error) {
+	var m Message
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return m, err
+	}
+
+	m.Type = MessageType(hdr[0])
+	l := binary.LittleEndian.Uint32(hdr[1:])
+	if l > max {
+		return m, &MessageTooLargeError{l, max}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	n, err := io.CopyN(buf, r, int64(l))
+	if err == io.EOF && n < int64(l) {
+		err = io.ErrUnexpectedEOF
+	}
+	m.Payload = buf.Bytes()
+	return m, err
+}
+
+// FrameMeta prefixes the ciphertext of each MessageFrame when
+// FeatureMetadata was negotiated.
+type FrameMeta struct {
+	Sequence uint64
+	Captured int64
+	Width    uint32
+	Height   uint32
+	Quality  uint8
+	FPS      uint8
+}
+
+var frameMetaSize = binary.Size(FrameMeta{})
+
+func (f FrameMeta) CapturedAt() time.Time { return time.Unix(0, f.Captured) }
+
+func (f FrameMeta) String() string {
+	return fmt.Sprintf("%dx%d @ %dfps (jpeg: %d)", f.Width, f.Height, f.FPS, f.Quality)
+}
+
+// FramePayload builds the payload of a MessageFrame.
+func FramePayload(n Negotiated, meta FrameMeta, ciphertext []byte) []byte {
+	if !n.Has(FeatureMetadata) {
+		return ciphertext
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, frameMetaSize+len(ciphertext)))
+	binary.Write(buf, binary.LittleEndian, meta)
+	buf.Write(ciphertext)
+	return buf.Bytes()
+}
+
+// ParseFrame splits the payload of a MessageFrame into its metadata and
+// ciphertext.
+func ParseFrame(n Negotiated, payload []byte) (FrameMeta, []byte, error) {
+	var meta FrameMeta
+	if !n.Has(FeatureMetadata) {
+		return meta, payload, nil
+	}
+
+	if len(payload) < frameMetaSize {
+		return meta, nil, fmt.Errorf("Frame of %dB too short for metadata", len(payload))
+	}
+
+	err := binary.Read(bytes.NewReader(payload), binary.LittleEndian, &meta)
+	return meta, payload[frameMetaSize:], err
+}
+
+// Keepalive is the payload of a MessageKeepalive. Each side periodically
+// sends a ping (Echo == 0) which the other side answers with a pong that
+// echoes the ping's Sent time, allowing the pinging side to measure the
+// round-trip time against its own clock.
+type Keepalive struct {
+	Sent int64
+	Echo int64
+}
+
+func Ping() []byte {
+	return Keepalive{Sent: time.Now().UnixNano()}.payload()
+}
+
+// Pong returns the payload replying to k.
+func (k Keepalive) Pong() []byte {
+	return Keepalive{Sent: time.Now().UnixNano(), Echo: k.Sent}.payload()
+}
+
+func (k Keepalive) IsPong() bool { return k.Echo != 0 }
+
+// RTT returns the round-trip time measured by a pong.
+func (k Keepalive) RTT() time.Duration {
+	return time.Since(time.Unix(0, k.Echo))
+}
+
+func (k Keepalive) payload() []byte {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf, uint64(k.Sent))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(k.Echo))
+	return buf
+}
+
+func ParseKeepalive(payload []byte) (Keepalive, error) {
+	var k Keepalive
+	if len(payload) != 16 {
+		return k, fmt.Errorf("Invalid keepalive of %dB", len(payload))
+	}
+
+	k.Sent = int64(binary.LittleEndian.Uint64(payload))
+	k.Echo = int64(binary.LittleEndian.Uint64(payload[8:]))
+	return k, nil
+}
+
+// Control is the payload of a MessageControl.
+type Control struct {
+	Command string
+	Args    []string
+}
+
+// ControlReply is the payload of a MessageControlReply.
+type ControlReply struct {
+	Command string
+	Error   string
+	Body    json.RawMessage
+}
+
+func WriteControl(w io.Writer, ch *Channel, c Control) error {
+	d, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return WriteMessage(w, MessageControl, ch.Seal(MessageControl, d))
+}
+
+func WriteControlReply(w io.Writer, ch *Channel, c ControlReply) error {
+	d, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return WriteMessage(w, MessageControlReply, ch.Seal(MessageControlReply, d))
+}
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// announce is a reader that announces a payload of size bytes but never
+// sends it.
+func announce(size uint32) io.Reader {
+	hdr := make([]byte, 5)
+	hdr[0] = byte(MessageFrame)
+	binary.LittleEndian.PutUint32(hdr[1:], size)
+	return bytes.NewReader(hdr)
+}
+
+func TestReadMessageTooLarge(t *testing.T) {
+	_, err := ReadMessage(announce(0xffffffff), 1024)
+	e, ok := err.(*MessageTooLargeError)
+	if !ok {
+		t.Fatalf("got %v, want *MessageTooLargeError", err)
+	}
+	if e.Size != 0xffffffff || e.Max != 1024 {
+		t.Errorf("got %+v", e)
+	}
+
+	if _, err := ReadMessage(announce(1025), 1024); err == nil {
+		t.Error("accepted a message one byte over max")
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ReadMessage(announce(1<<30), 1<<30); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("allocated %dB for an announced but missing payload", n)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := WriteMessage(buf, MessageStatus, []byte("status")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < buf.Len(); i++ {
+		if _, err := ReadMessage(bytes.NewReader(buf.Bytes()[:i]), 1024); err == nil {
+			t.Errorf("no error for a message truncated to %d bytes", i)
+		}
+	}
+}
+
+func TestParseFrameShort(t *testing.T) {
+	n := Negotiated{Features: FeaturePush | FeatureMetadata}
+	if _, _, err := ParseFrame(n, make([]byte, frameMetaSize-1)); err == nil {
+		t.Error("accepted a frame shorter than its metadata")
+	}
+}
+
+func TestParseKeepaliveSize(t *testing.T) {
+	for _, n := range []int{0, 15, 17, 1024} {
+		if _, err := ParseKeepalive(make([]byte, n)); err == nil {
+			t.Errorf("accepted a %dB keepalive", n)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	msgs := []Message{
+		{MessageStatus, []byte("hello")},
+		{MessagePoll, []byte{}},
+		{MessageFrame, bytes.Repeat([]byte{7}, 4096)},
+	}
+	for _, m := range msgs {
+		if err := WriteMessage(buf, m.Type, m.Payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range msgs {
+		m, err := ReadMessage(buf, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Type != want.Type || !bytes.Equal(m.Payload, want.Payload) {
+			t.Errorf("got %s of %dB, want %s of %dB", m.Type, len(m.Payload), want.Type, len(want.Payload))
+		}
+	}
+
+	if _, err := ReadMessage(buf, 4096); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := WriteAdmission(buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadAdmission(buf, 1024); err != nil {
+		t.Errorf("admitted client got %v", err)
+	}
+
+	if err := WriteAdmission(buf, errors.New("Too many peers")); err != nil {
+		t.Fatal(err)
+	}
+	err := ReadAdmission(buf, 1024)
+	if r, ok := err.(*RemoteError); !ok || r.Message != "Too many peers" {
+		t.Errorf("got %v, want a *RemoteError", err)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	meta := FrameMeta{Sequence: 3, Captured: 42, Width: 640, Height: 480, Quality: 80, FPS: 15}
+	ciphertext := []byte("ciphertext")
+
+	for _, n := range []Negotiated{
+		{Features: FeaturePush},
+		{Features: FeaturePush | FeatureMetadata},
+	} {
+		m, c, err := ParseFrame(n, FramePayload(n, meta, ciphertext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c, ciphertext) {
+			t.Errorf("%s: got ciphertext %q", n, c)
+		}
+
+		want := meta
+		if !n.Has(FeatureMetadata) {
+			want = FrameMeta{}
+		}
+		if m != want {
+			t.Errorf("%s: got %+v, want %+v", n, m, want)
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	ping, err := ParseKeepalive(Ping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping.IsPong() {
+		t.Error("ping is a pong")
+	}
+
+	pong, err := ParseKeepalive(ping.Pong())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pong.IsPong() || pong.Echo != ping.Sent {
+		t.Errorf("pong %+v does not echo ping %+v", pong, ping)
+	}
+	if rtt := pong.RTT(); rtt < 0 || rtt > time.Minute {
+		t.Errorf("rtt of %s", rtt)
+	}
+}
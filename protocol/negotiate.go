@@ -0,0 +1,291 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// Version is the newest protocol version this build speaks.
+	Version uint16 = 3
+	// MinVersion is the oldest protocol version this build still speaks.
+	MinVersion uint16 = 3
+)
+
+var magic = [4]byte{'H', 'C', 'A', 'M'}
+
+type Cipher uint32
+
+const (
+	// CipherScryptAESCBC derives keys with scrypt and encrypts with AES-256-CBC.
+	CipherScryptAESCBC Cipher = 1 << iota
+)
+
+type Feature uint32
+
+const (
+	// FeaturePoll makes the client request each frame.
+	FeaturePoll Feature = 1 << iota
+	// FeaturePush makes the server send frames as soon as they are captured.
+	FeaturePush
+	// FeatureMetadata prefixes each frame with a FrameMeta.
+	FeatureMetadata
+	// FeatureTOTP means the client can prompt for a one-time password.
+	FeatureTOTP
+	// FeatureDeviceAuth allows enrolled devices to authenticate with their
+	// key instead of the password, see AuthMethod.
+	FeatureDeviceAuth
+	// FeaturePairing allows new devices to enroll with a one-time token,
+	// see AuthPair.
+	FeaturePairing
+	// FeatureAdmission makes the server tell the client whether it was
+	// admitted right after negotiation, see WriteAdmission.
+	FeatureAdmission
+)
+
+// Capabilities is what one side of a connection supports, or after
+// negotiation, what both sides agreed upon.
+type Capabilities struct {
+	MinVersion   uint16
+	MaxVersion   uint16
+	Ciphers      Cipher
+	Features     Feature
+	MaxFrameSize uint32
+}
+
+// Local returns all capabilities supported by this build.
+func Local(maxFrameSize uint32) Capabilities {
+	return Capabilities{
+		MinVersion:   MinVersion,
+		MaxVersion:   Version,
+		Ciphers:      CipherScryptAESCBC,
+		Features:     FeaturePoll | FeaturePush | FeatureMetadata | FeatureTOTP | FeatureDeviceAuth | FeaturePairing | FeatureAdmission,
+		MaxFrameSize: maxFrameSize,
+	}
+}
+
+// Negotiated is the common set of capabilities both peers agreed upon.
+type Negotiated struct {
+	Version      uint16
+	Cipher       Cipher
+	Features     Feature
+	MaxFrameSize uint32
+}
+
+func (n Negotiated) Has(f Feature) bool { return n.Features&f != 0 }
+
+func (n Negotiated) String() string {
+	mode := "poll"
+	if n.Has(FeaturePush) {
+		mode = "push"
+	}
+	return fmt.Sprintf(
+		"v%d cipher:%d mode:%s metadata:%t max-frame:%dB",
+		n.Version,
+		n.Cipher,
+		mode,
+		n.Has(FeatureMetadata),
+		n.MaxFrameSize,
+	)
+}
+
+// VersionError is returned when both peers have no protocol version in
+// common, one of them needs to be upgraded.
+type VersionError struct {
+	LocalMin, LocalMax   uint16
+	RemoteMin, RemoteMax uint16
+}
+
+func (v *VersionError) Error() string {
+	if v.RemoteMax == 0 {
+		return "Upgrade required: peer does not speak a versioned protocol"
+	}
+
+	who := "peer"
+	if v.RemoteMax > v.LocalMax {
+		who = "this side"
+	}
+
+	return fmt.Sprintf(
+		"Upgrade required: %s is outdated (local: v%d-v%d, remote: v%d-v%d)",
+		who,
+		v.LocalMin,
+		v.LocalMax,
+		v.RemoteMin,
+		v.RemoteMax,
+	)
+}
+
+// NegotiationError is returned when both peers speak a common protocol
+// version but have no cipher or streaming mode in common.
+type NegotiationError struct {
+	Reason string
+}
+
+func (n *NegotiationError) Error() string {
+	return fmt.Sprintf("Negotiation failed: %s", n.Reason)
+}
+
+// Negotiate picks the best common set of two sets of capabilities.
+func Negotiate(local, remote Capabilities) (Negotiated, error) {
+	var n Negotiated
+	n.Version = local.MaxVersion
+	if remote.MaxVersion < n.Version {
+		n.Version = remote.MaxVersion
+	}
+
+	if n.Version < local.MinVersion || n.Version < remote.MinVersion {
+		return n, &VersionError{
+			LocalMin:  local.MinVersion,
+			LocalMax:  local.MaxVersion,
+			RemoteMin: remote.MinVersion,
+			RemoteMax: remote.MaxVersion,
+		}
+	}
+
+	n.Cipher = best(uint32(local.Ciphers & remote.Ciphers))
+	if n.Cipher == 0 {
+		return n, &NegotiationError{"no common cipher suite"}
+	}
+
+	common := local.Features & remote.Features
+	switch {
+	case common&FeaturePush != 0:
+		n.Features = FeaturePush
+	case common&FeaturePoll != 0:
+		n.Features = FeaturePoll
+	default:
+		return n, &NegotiationError{"no common streaming mode"}
+	}
+	n.Features |= common &^ (FeaturePush | FeaturePoll)
+
+	n.MaxFrameSize = local.MaxFrameSize
+	if remote.MaxFrameSize < n.MaxFrameSize {
+		n.MaxFrameSize = remote.MaxFrameSize
+	}
+	if n.MaxFrameSize == 0 {
+		return n, &NegotiationError{"no common frame size"}
+	}
+
+	return n, nil
+}
+
+// NegotiateServer announces the local capabilities, reads those of the
+// client and replies with the negotiated result.
+func (p *Protocol) NegotiateServer(rw io.ReadWriter) (Negotiated, error) {
+	if err := writeHello(rw, p.caps); err != nil {
+		return Negotiated{}, err
+	}
+
+	remote, err := readHello(rw)
+	if err != nil {
+		return Negotiated{}, err
+	}
+
+	n, negErr := Negotiate(p.caps, remote)
+	if negErr != nil {
+		rw.Write(nok)
+		return n, negErr
+	}
+
+	if _, err := rw.Write(ok); err != nil {
+		return n, err
+	}
+
+	return n, binary.Write(rw, binary.LittleEndian, n)
+}
+
+// Probe reads the capabilities announced by the server and reports whether
+// negotiating with it would succeed, without announcing ours. The server
+// sees the connection close before negotiation and does not admit it.
+func (p *Protocol) Probe(r io.Reader) error {
+	remote, err := readHello(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = Negotiate(p.caps, remote)
+	return err
+}
+
+// NegotiateClient reads the capabilities of the server, announces the local
+// ones and reads the result the server settled on.
+func (p *Protocol) NegotiateClient(rw io.ReadWriter) (Negotiated, error) {
+	var n Negotiated
+	remote, err := readHello(rw)
+	if err != nil {
+		return n, err
+	}
+
+	if err := writeHello(rw, p.caps); err != nil {
+		return n, err
+	}
+
+	if _, err := Negotiate(p.caps, remote); err != nil {
+		return n, err
+	}
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(rw, status); err != nil {
+		return n, err
+	}
+	if status[0] != ok[0] {
+		return n, &NegotiationError{"server rejected our capabilities"}
+	}
+
+	if err := binary.Read(rw, binary.LittleEndian, &n); err != nil {
+		return n, err
+	}
+
+	// Never trust the server to pick something we did not offer.
+	if n.Version < p.caps.MinVersion || n.Version > p.caps.MaxVersion {
+		return n, &VersionError{
+			LocalMin:  p.caps.MinVersion,
+			LocalMax:  p.caps.MaxVersion,
+			RemoteMin: n.Version,
+			RemoteMax: n.Version,
+		}
+	}
+	if n.Cipher&p.caps.Ciphers == 0 ||
+		n.Features&^p.caps.Features != 0 ||
+		n.MaxFrameSize > p.caps.MaxFrameSize {
+		return n, &NegotiationError{"server picked unsupported capabilities"}
+	}
+
+	return n, nil
+}
+
+func writeHello(w io.Writer, c Capabilities) error {
+	if _, err := w.Write(magic[:]); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, c)
+}
+
+func readHello(r io.Reader) (Capabilities, error) {
+	var c Capabilities
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, m); err != nil {
+		return c, err
+	}
+
+	for i := range m {
+		if m[i] != magic[i] {
+			return c, &VersionError{}
+		}
+	}
+
+	return c, binary.Read(r, binary.LittleEndian, &c)
+}
+
+func best(set uint32) Cipher {
+	for i := 31; i >= 0; i-- {
+		if set&(1<<uint(i)) != 0 {
+			return Cipher(1 << uint(i))
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,192 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/frizinak/inbetween-go-homecam/crypto"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := Local(1 << 20)
+	tests := []struct {
+		name   string
+		remote Capabilities
+		want   Negotiated
+		err    interface{}
+	}{
+		{
+			"same",
+			Local(1 << 20),
+			Negotiated{Version: Version, Cipher: CipherScryptAESCBC, Features: local.Features &^ FeaturePoll, MaxFrameSize: 1 << 20},
+			nil,
+		},
+		{
+			"newer peer",
+			Capabilities{MinVersion: MinVersion, MaxVersion: Version + 5, Ciphers: CipherScryptAESCBC | 1<<5, Features: FeaturePush | 1<<20, MaxFrameSize: 1 << 30},
+			Negotiated{Version: Version, Cipher: CipherScryptAESCBC, Features: FeaturePush, MaxFrameSize: 1 << 20},
+			nil,
+		},
+		{
+			"poll only",
+			Capabilities{MinVersion: MinVersion, MaxVersion: Version, Ciphers: CipherScryptAESCBC, Features: FeaturePoll | FeatureMetadata, MaxFrameSize: 1024},
+			Negotiated{Version: Version, Cipher: CipherScryptAESCBC, Features: FeaturePoll | FeatureMetadata, MaxFrameSize: 1024},
+			nil,
+		},
+		{"too old", Capabilities{MinVersion: 1, MaxVersion: MinVersion - 1, Ciphers: CipherScryptAESCBC, Features: FeaturePush, MaxFrameSize: 1}, Negotiated{}, &VersionError{}},
+		{"too new", Capabilities{MinVersion: Version + 1, MaxVersion: Version + 2, Ciphers: CipherScryptAESCBC, Features: FeaturePush, MaxFrameSize: 1}, Negotiated{}, &VersionError{}},
+		{"no cipher", Capabilities{MinVersion: MinVersion, MaxVersion: Version, Ciphers: 1 << 5, Features: FeaturePush, MaxFrameSize: 1}, Negotiated{}, &NegotiationError{}},
+		{"no mode", Capabilities{MinVersion: MinVersion, MaxVersion: Version, Ciphers: CipherScryptAESCBC, Features: FeatureMetadata, MaxFrameSize: 1}, Negotiated{}, &NegotiationError{}},
+		{"no frame size", Capabilities{MinVersion: MinVersion, MaxVersion: Version, Ciphers: CipherScryptAESCBC, Features: FeaturePush}, Negotiated{}, &NegotiationError{}},
+	}
+
+	for _, test := range tests {
+		n, err := Negotiate(local, test.remote)
+		switch test.err.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			} else if n != test.want {
+				t.Errorf("%s: got %+v, want %+v", test.name, n, test.want)
+			}
+		case *VersionError:
+			if _, ok := err.(*VersionError); !ok {
+				t.Errorf("%s: got %v, want a *VersionError", test.name, err)
+			}
+		case *NegotiationError:
+			if _, ok := err.(*NegotiationError); !ok {
+				t.Errorf("%s: got %v, want a *NegotiationError", test.name, err)
+			}
+		}
+	}
+}
+
+func negotiate(server, client *Protocol) (sn, cn Negotiated, serr, cerr error) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		sn, serr = server.NegotiateServer(s)
+		if serr != nil {
+			s.Close()
+		}
+		close(done)
+	}()
+
+	cn, cerr = client.NegotiateClient(c)
+	if cerr != nil {
+		c.Close()
+	}
+	<-done
+	return
+}
+
+func TestNegotiateRoundTrip(t *testing.T) {
+	server := New(crypto.MinCost, crypto.MinCost, 16, 32, Local(1<<20))
+	client := New(crypto.MinCost, crypto.MinCost, 16, 32, Local(1<<16))
+
+	sn, cn, serr, cerr := negotiate(server, client)
+	if serr != nil || cerr != nil {
+		t.Fatalf("server: %v, client: %v", serr, cerr)
+	}
+	if sn != cn {
+		t.Errorf("server negotiated %s, client %s", sn, cn)
+	}
+	if cn.MaxFrameSize != 1<<16 || !cn.Has(FeaturePush) || cn.Has(FeaturePoll) || !cn.Has(FeatureMetadata) {
+		t.Errorf("negotiated %s", cn)
+	}
+}
+
+func TestNegotiateVersionMismatch(t *testing.T) {
+	old := Local(1 << 16)
+	old.MinVersion, old.MaxVersion = MinVersion-1, MinVersion-1
+	server := New(crypto.MinCost, crypto.MinCost, 16, 32, old)
+	client := New(crypto.MinCost, crypto.MinCost, 16, 32, Local(1<<16))
+
+	_, _, serr, cerr := negotiate(server, client)
+	if _, ok := serr.(*VersionError); !ok {
+		t.Errorf("server: got %v, want a *VersionError", serr)
+	}
+	if _, ok := cerr.(*VersionError); !ok {
+		t.Errorf("client: got %v, want a *VersionError", cerr)
+	}
+}
+
+func TestNegotiateClientUnversionedServer(t *testing.T) {
+	client := New(crypto.MinCost, crypto.MinCost, 16, 32, Local(1<<16))
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(make([]byte, 64)), ioutil.Discard}
+
+	if _, err := client.NegotiateClient(rw); err == nil {
+		t.Fatal("negotiated with an unversioned server")
+	} else if v, ok := err.(*VersionError); !ok || v.RemoteMax != 0 {
+		t.Errorf("got %v, want a *VersionError without remote versions", err)
+	}
+}
+
+func TestNegotiateClientRejectsUnoffered(t *testing.T) {
+	local := Local(1 << 16)
+	tests := []struct {
+		name string
+		n    Negotiated
+	}{
+		{"version", Negotiated{Version: Version + 1, Cipher: CipherScryptAESCBC, Features: FeaturePush, MaxFrameSize: 1}},
+		{"cipher", Negotiated{Version: Version, Cipher: 1 << 5, Features: FeaturePush, MaxFrameSize: 1}},
+		{"feature", Negotiated{Version: Version, Cipher: CipherScryptAESCBC, Features: FeaturePush | 1<<20, MaxFrameSize: 1}},
+		{"frame size", Negotiated{Version: Version, Cipher: CipherScryptAESCBC, Features: FeaturePush, MaxFrameSize: 1 << 17}},
+	}
+
+	for _, test := range tests {
+		in := bytes.NewBuffer(nil)
+		writeHello(in, local)
+		in.Write(ok)
+		binary.Write(in, binary.LittleEndian, test.n)
+
+		client := New(crypto.MinCost, crypto.MinCost, 16, 32, local)
+		rw := struct {
+			io.Reader
+			io.Writer
+		}{in, ioutil.Discard}
+		if _, err := client.NegotiateClient(rw); err == nil {
+			t.Errorf("%s: accepted %+v", test.name, test.n)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	server := New(crypto.MinCost, crypto.MinCost, 16, 32, Local(1<<16))
+	client := New(crypto.MinCost, crypto.MinCost, 16, 32, Local(1<<16))
+
+	s, c := net.Pipe()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.NegotiateServer(s)
+		done <- err
+	}()
+
+	err := client.Probe(c)
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != io.EOF {
+		t.Errorf("server got %v, want EOF", err)
+	}
+
+	old := Local(1 << 16)
+	old.MinVersion, old.MaxVersion = MinVersion-1, MinVersion-1
+	in := bytes.NewBuffer(nil)
+	writeHello(in, old)
+	if _, ok := client.Probe(in).(*VersionError); !ok {
+		t.Error("probe succeeded against an outdated server")
+	}
+}
@@ -21,75 +21,99 @@ var (
 	ok  = []byte{1}
 )
 
+const encryptionSaltSize = 60
+
 type Protocol struct {
 	handshakeCost  uint8
 	encryptionCost uint8
 	saltSize       int
 	hashLen        int
+	caps           Capabilities
 }
 
-func New(handshakeCost, encryptionCost uint8, saltSize, hashLen int) *Protocol {
+func New(
+	handshakeCost,
+	encryptionCost uint8,
+	saltSize,
+	hashLen int,
+	caps Capabilities,
+) *Protocol {
 	return &Protocol{
 		handshakeCost:  handshakeCost,
 		encryptionCost: encryptionCost,
 		saltSize:       saltSize,
 		hashLen:        hashLen,
+		caps:           caps,
 	}
 }
 
-func (p *Protocol) HandshakeServer(pass []byte, rw io.ReadWriter) (*crypto.ImmutableKeyEncrypter, error) {
+func (p *Protocol) HandshakeServer(pass []byte, rw io.ReadWriter) (*crypto.ImmutableKeyEncrypter, *Channel, error) {
 	handshake := make([]byte, p.saltSize)
 	if _, err := rand.Read(handshake); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if _, err := rw.Write(handshake); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	remoteHandshakeHash := make([]byte, p.hashLen)
 	if _, err := io.ReadFull(rw, remoteHandshakeHash); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	encryptionPass, handshakeHash, err := p.handshake(pass, handshake)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if !bytes.Equal(remoteHandshakeHash, handshakeHash) {
 		rw.Write(nok)
-		return nil, ErrInvalidHandshake
+		return nil, nil, ErrInvalidHandshake
+	}
+
+	ch, err := NewChannel(encryptionPass, true)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	rw.Write(ok)
-	return crypto.NewImmutableKeyEncrypter(encryptionPass, 60, p.encryptionCost)
+	crypter, err := crypto.NewImmutableKeyEncrypter(encryptionPass, encryptionSaltSize, p.encryptionCost)
+	return crypter, ch, err
 }
 
-func (p *Protocol) HandshakeClient(pass []byte, rw io.ReadWriter) (*crypto.ImmutableKeyDecrypter, error) {
+func (p *Protocol) HandshakeClient(pass []byte, rw io.ReadWriter) (*crypto.ImmutableKeyDecrypter, *Channel, error) {
 	handshake := make([]byte, p.saltSize)
 	if _, err := io.ReadFull(rw, handshake); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	decryptionPass, handshakeHash, err := p.handshake(pass, handshake)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if _, err = rw.Write(handshakeHash); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	status := make([]byte, 1)
 	if _, err = rw.Read(status); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if !bytes.Equal(ok, status) {
-		return nil, ErrDenied
+		return nil, nil, ErrDenied
+	}
+
+	ch, err := NewChannel(decryptionPass, false)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return crypto.NewImmutableKeyDecrypter(decryptionPass), nil
+	return crypto.NewImmutableKeyDecrypter(decryptionPass).Limit(
+		p.encryptionCost,
+		encryptionSaltSize,
+	), ch, nil
 }
 
 func (p *Protocol) handshake(pass, salt []byte) (key, handshakeHash []byte, err error) {
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/frizinak/inbetween-go-homecam/crypto"
+)
+
+func TestHandshake(t *testing.T) {
+	p := New(crypto.MinCost, crypto.MinCost, 32, 32, Local(1<<16))
+	tests := []struct {
+		name   string
+		client string
+		err    error
+	}{
+		{"match", "pass", nil},
+		{"mismatch", "wrong", ErrDenied},
+	}
+
+	for _, test := range tests {
+		s, c := net.Pipe()
+		type result struct {
+			e   *crypto.ImmutableKeyEncrypter
+			ch  *Channel
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			e, ch, err := p.HandshakeServer([]byte("pass"), s)
+			done <- result{e, ch, err}
+		}()
+
+		d, ch, err := p.HandshakeClient([]byte(test.client), c)
+		r := <-done
+		s.Close()
+		c.Close()
+
+		if err != test.err {
+			t.Errorf("%s: client got %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if test.err != nil {
+			if r.err != ErrInvalidHandshake {
+				t.Errorf("%s: server got %v, want %v", test.name, r.err, ErrInvalidHandshake)
+			}
+			continue
+		}
+		if r.err != nil {
+			t.Fatalf("%s: server: %s", test.name, r.err)
+		}
+
+		cipher, plain := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+		if err := r.e.Encrypt(bytes.NewReader([]byte("frame")), cipher); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Decrypt(cipher, plain); err != nil {
+			t.Fatalf("%s: decrypt: %s", test.name, err)
+		}
+		if plain.String() != "frame" {
+			t.Errorf("%s: got %q", test.name, plain.String())
+		}
+
+		sealed := r.ch.Seal(MessageControlReply, []byte("reply"))
+		if b, err := ch.Open(Message{MessageControlReply, sealed}); err != nil || string(b) != "reply" {
+			t.Errorf("%s: channel got %q, %v", test.name, b, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import "time"
+
+// congestionSlack is how much the round-trip time may grow beyond twice its
+// baseline before the path is considered congested.
+const congestionSlack = time.Millisecond * 50
+
+// RTT tracks the round-trip times measured by keepalives.
+type RTT struct {
+	min      time.Duration
+	smoothed time.Duration
+}
+
+func (r *RTT) Add(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	if r.min == 0 || d < r.min {
+		r.min = d
+	}
+
+	if r.smoothed == 0 {
+		r.smoothed = d
+		return
+	}
+
+	r.smoothed = (7*r.smoothed + d) / 8
+}
+
+func (r *RTT) Min() time.Duration      { return r.min }
+func (r *RTT) Smoothed() time.Duration { return r.smoothed }
+
+// Congested reports whether the round-trip time grew well beyond its
+// baseline, i.e.: data is queueing up somewhere along the path.
+func (r *RTT) Congested() bool {
+	return r.min != 0 && r.smoothed > 2*r.min+congestionSlack
+}
@@ -0,0 +1,13 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// CertificateFingerprint returns the fingerprint TLS certificates are
+// pinned by, the hex encoded sha256 of their DER encoding.
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
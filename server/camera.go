@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/blackjack/webcam"
+	"github.com/blackjack/webcam/ioctl"
+)
+
+// V4L2 fourccs of (motion) jpeg, the only formats the server can stream.
+const (
+	formatMJPEG webcam.PixelFormat = 'M' | 'J'<<8 | 'P'<<16 | 'G'<<24
+	formatJPEG  webcam.PixelFormat = 'J' | 'P'<<8 | 'E'<<16 | 'G'<<24
+)
+
+type v4l2Capability struct {
+	driver       [16]uint8
+	card         [32]uint8
+	busInfo      [32]uint8
+	version      uint32
+	capabilities uint32
+	deviceCaps   uint32
+	reserved     [3]uint32
+}
+
+type v4l2Frmivalenum struct {
+	index       uint32
+	pixelFormat uint32
+	width       uint32
+	height      uint32
+	typ         uint32
+	// discrete: numerator, denominator
+	// stepwise: min, max and step as numerator, denominator pairs
+	union    [6]uint32
+	reserved [2]uint32
+}
+
+const frmivalTypeDiscrete = 1
+
+var (
+	vidiocQuerycap           = ioctl.IoR('V', 0, unsafe.Sizeof(v4l2Capability{}))
+	vidiocEnumFrameintervals = ioctl.IoRW('V', 75, unsafe.Sizeof(v4l2Frmivalenum{}))
+)
+
+// FrameInterval is the time between two frames as a fraction of a second.
+type FrameInterval struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+func (f FrameInterval) FPS() float64 {
+	if f.Numerator == 0 {
+		return 0
+	}
+	return float64(f.Denominator) / float64(f.Numerator)
+}
+
+func (f FrameInterval) String() string {
+	return strconv.FormatFloat(f.FPS(), 'f', -1, 64) + "fps"
+}
+
+type CameraSize struct {
+	webcam.FrameSize
+	Intervals []FrameInterval
+	// IntervalRange is true if Intervals only holds the lower and upper
+	// bound of a continuous range.
+	IntervalRange bool
+}
+
+type CameraFormat struct {
+	Format      webcam.PixelFormat
+	Description string
+	Sizes       []CameraSize
+}
+
+// FourCC returns the four character code of the format, e.g. MJPG.
+func (c CameraFormat) FourCC() string { return fourCC(c.Format) }
+
+func fourCC(f webcam.PixelFormat) string {
+	b := []byte{byte(f), byte(f >> 8), byte(f >> 16), byte(f >> 24)}
+	return strings.TrimRight(string(b), " \x00")
+}
+
+type Camera struct {
+	Device  string
+	Name    string
+	Formats []CameraFormat
+}
+
+// Cameras enumerates the /dev/video* devices, devices that can not be
+// opened or do not support video capture are skipped.
+func Cameras() ([]*Camera, error) {
+	devices, err := filepath.Glob("/dev/video*")
+	if err != nil {
+		return nil, err
+	}
+
+	num := func(dev string) int {
+		n, _ := strconv.Atoi(strings.TrimPrefix(dev, "/dev/video"))
+		return n
+	}
+	sort.Slice(devices, func(i, j int) bool { return num(devices[i]) < num(devices[j]) })
+
+	cams := make([]*Camera, 0, len(devices))
+	for _, dev := range devices {
+		cam, err := ProbeCamera(dev)
+		if err != nil {
+			continue
+		}
+		cams = append(cams, cam)
+	}
+
+	return cams, nil
+}
+
+// ProbeCamera lists the formats, frame sizes and frame intervals of device.
+func ProbeCamera(device string) (*Camera, error) {
+	cam, err := webcam.Open(device)
+	if err != nil {
+		return nil, err
+	}
+	defer cam.Close()
+
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fd := f.Fd()
+
+	c := &Camera{Device: device}
+	caps := &v4l2Capability{}
+	if err := ioctl.Ioctl(fd, vidiocQuerycap, uintptr(unsafe.Pointer(caps))); err == nil {
+		c.Name = string(bytes.TrimRight(caps.card[:], "\x00"))
+	}
+
+	for pix, desc := range cam.GetSupportedFormats() {
+		format := CameraFormat{Format: pix, Description: desc}
+		for _, size := range cam.GetSupportedFrameSizes(pix) {
+			cs := CameraSize{FrameSize: size}
+			cs.Intervals, cs.IntervalRange = frameIntervals(fd, pix, size.MaxWidth, size.MaxHeight)
+			format.Sizes = append(format.Sizes, cs)
+		}
+
+		sort.Slice(format.Sizes, func(i, j int) bool {
+			a, b := format.Sizes[i], format.Sizes[j]
+			return a.MaxWidth*a.MaxHeight > b.MaxWidth*b.MaxHeight
+		})
+		c.Formats = append(c.Formats, format)
+	}
+
+	sort.Slice(c.Formats, func(i, j int) bool { return c.Formats[i].Format < c.Formats[j].Format })
+	return c, nil
+}
+
+func frameIntervals(fd uintptr, pix webcam.PixelFormat, width, height uint32) ([]FrameInterval, bool) {
+	var l []FrameInterval
+	for i := uint32(0); ; i++ {
+		e := &v4l2Frmivalenum{index: i, pixelFormat: uint32(pix), width: width, height: height}
+		if err := ioctl.Ioctl(fd, vidiocEnumFrameintervals, uintptr(unsafe.Pointer(e))); err != nil {
+			return l, false
+		}
+
+		if e.typ != frmivalTypeDiscrete {
+			return []FrameInterval{
+				{e.union[0], e.union[1]},
+				{e.union[2], e.union[3]},
+			}, true
+		}
+
+		l = append(l, FrameInterval{e.union[0], e.union[1]})
+	}
+}
+
+// pixelFormat picks the format to stream in, preferring jpeg.
+func pixelFormat(formats map[webcam.PixelFormat]string) (webcam.PixelFormat, error) {
+	for _, f := range []webcam.PixelFormat{formatMJPEG, formatJPEG} {
+		if _, ok := formats[f]; ok {
+			return f, nil
+		}
+	}
+
+	for f := range formats {
+		return f, nil
+	}
+
+	return 0, errors.New("Camera reports no formats")
+}
+
+// Capture grabs a single frame from device at the highest resolution it
+// supports and returns it along with the four character code of its format.
+func Capture(device string, timeout time.Duration) ([]byte, string, error) {
+	cam, err := webcam.Open(device)
+	if err != nil {
+		return nil, "", err
+	}
+	defer cam.Close()
+
+	pix, err := pixelFormat(cam.GetSupportedFormats())
+	if err != nil {
+		return nil, "", err
+	}
+
+	var width, height uint32
+	for _, s := range cam.GetSupportedFrameSizes(pix) {
+		if s.MaxWidth*s.MaxHeight > width*height {
+			width, height = s.MaxWidth, s.MaxHeight
+		}
+	}
+
+	if _, _, _, err = cam.SetImageFormat(pix, width, height); err != nil {
+		return nil, "", err
+	}
+
+	if err = cam.StartStreaming(); err != nil {
+		return nil, "", err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := cam.WaitForFrame(1)
+		switch err.(type) {
+		case nil:
+		case *webcam.Timeout:
+			if time.Now().After(deadline) {
+				return nil, "", fmt.Errorf("No frame from %s within %s", device, timeout)
+			}
+			continue
+		default:
+			return nil, "", err
+		}
+
+		frame, err := cam.ReadFrame()
+		if err != nil {
+			return nil, "", err
+		}
+		if len(frame) == 0 {
+			continue
+		}
+
+		d := make([]byte, len(frame))
+		copy(d, frame)
+		return d, fourCC(pix), nil
+	}
+}
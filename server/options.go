@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/acl"
+	"github.com/frizinak/inbetween-go-homecam/vars"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Options configures a server created with NewServer. Only Password is
+// required, the zero value of every other field has a sensible default.
+type Options struct {
+	// Logger defaults to discarding everything.
+	Logger *log.Logger
+	// Address is listened on by Listen, Serve uses the given listener.
+	Address string
+	// Password followed by the touch password.
+	Password []byte
+	// Device defaults to /dev/video0.
+	Device string
+	// Quality defaults to what the example configuration uses.
+	Quality Config
+	// MaxPeers defaults to 10.
+	MaxPeers  int
+	Keepalive KeepaliveConfig
+	// TOTP defaults to no two-factor authentication.
+	TOTP TOTPConfig
+	// Devices and Key enable device authentication, Pairing additionally
+	// enables pairing.
+	Devices DeviceStore
+	Key     ed25519.PrivateKey
+	Pairing Pairing
+	// TLS wraps every listener when set.
+	TLS *tls.Config
+	// Access defaults to allowing everything.
+	Access   AccessConfig
+	AuditLog AuditLog
+}
+
+const (
+	defaultDevice   = "/dev/video0"
+	defaultMaxPeers = 10
+)
+
+type defaultQuality struct{}
+
+func (defaultQuality) MinimumFPS() int                  { return 5 }
+func (defaultQuality) MaximumFPS() int                  { return 20 }
+func (defaultQuality) MinimumJPEGQuality() int          { return 30 }
+func (defaultQuality) MaximumJPEGQuality() int          { return 100 }
+func (defaultQuality) DesiredTotalThroughput() float64  { return 1200 * 1024 }
+func (defaultQuality) DesiredClientThroughput() float64 { return 200 * 1024 }
+func (defaultQuality) MinimumResolution() int           { return 480 * 320 }
+func (defaultQuality) MaximumResolution() int           { return 1024 * 768 }
+
+type defaultKeepalive struct{}
+
+func (defaultKeepalive) KeepaliveInterval() time.Duration { return vars.KeepaliveInterval }
+func (defaultKeepalive) KeepaliveTimeout() time.Duration  { return vars.KeepaliveTimeout }
+
+type noTOTP struct{}
+
+func (noTOTP) TOTPSecret() string   { return "" }
+func (noTOTP) TOTPRemoteOnly() bool { return false }
+
+type allowAll struct{}
+
+func (allowAll) ConnectionACL() *acl.ACL { return nil }
+func (allowAll) AdminACL() *acl.ACL      { return nil }
+func (allowAll) DeviceACL() *acl.ACL     { return nil }
+
+func (o Options) withDefaults() Options {
+	if o.Logger == nil {
+		o.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	if o.Device == "" {
+		o.Device = defaultDevice
+	}
+	if o.Quality == nil {
+		o.Quality = defaultQuality{}
+	}
+	if o.MaxPeers == 0 {
+		o.MaxPeers = defaultMaxPeers
+	}
+	if o.Keepalive == nil {
+		o.Keepalive = defaultKeepalive{}
+	}
+	if o.TOTP == nil {
+		o.TOTP = noTOTP{}
+	}
+	if o.Access == nil {
+		o.Access = allowAll{}
+	}
+
+	return o
+}
@@ -2,19 +2,34 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
 	"image/jpeg"
 	"io"
 	"log"
 	"net"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/blackjack/webcam"
+	"github.com/frizinak/inbetween-go-homecam/acl"
+	"github.com/frizinak/inbetween-go-homecam/audit"
+	"github.com/frizinak/inbetween-go-homecam/crypto"
+	"github.com/frizinak/inbetween-go-homecam/device"
 	"github.com/frizinak/inbetween-go-homecam/protocol"
+	"github.com/frizinak/inbetween-go-homecam/totp"
 	"github.com/frizinak/inbetween-go-homecam/vars"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/image/draw"
 )
 
 type Resolution struct {
@@ -40,6 +55,62 @@ type Config interface {
 	MaximumResolution() int
 }
 
+type KeepaliveConfig interface {
+	KeepaliveInterval() time.Duration
+	KeepaliveTimeout() time.Duration
+}
+
+type TOTPConfig interface {
+	// TOTPSecret returns the base32 encoded TOTP secret, an empty string
+	// disables two-factor authentication.
+	TOTPSecret() string
+	// TOTPRemoteOnly returns whether LAN clients are exempt.
+	TOTPRemoteOnly() bool
+}
+
+// AccessConfig restricts which addresses may connect. Connections are
+// checked right after being accepted, sessions authenticated with the
+// password (admin) or an enrolled device are further restricted by their
+// respective ACL. A nil ACL allows everything.
+type AccessConfig interface {
+	ConnectionACL() *acl.ACL
+	AdminACL() *acl.ACL
+	DeviceACL() *acl.ACL
+}
+
+// AuditLog records every connection attempt, see audit.Log.
+type AuditLog interface {
+	Write(audit.Entry) error
+	Recent(n int) ([]audit.Entry, error)
+}
+
+// DeviceStore keeps track of enrolled devices, see device.Store.
+type DeviceStore interface {
+	Enroll(name string, pub []byte) (device.Device, error)
+	Revoke(nameOrFingerprint string) (device.Device, error)
+	List() ([]device.Device, error)
+	Lookup(pub []byte) (device.Device, error)
+}
+
+// Pairing holds the one-time token new devices enroll with, see
+// device.Pairing.
+type Pairing interface {
+	Token() (string, error)
+	Consume(token string) error
+}
+
+const pairingTimeout = time.Minute
+
+const (
+	totpTimeout     = time.Minute * 2
+	totpMaxAttempts = 3
+	totpMaxFailures = 10
+	totpLockout     = time.Minute * 5
+	// totpSkew is the number of time steps a code is accepted before or
+	// after its own.
+	totpSkew = 1
+)
+
 type qualityConfig struct {
 	MinFPS int
 	MaxFPS int
@@ -54,6 +125,27 @@ type qualityConfig struct {
 	MaxResolution int
 }
 
+func newQualityConfig(quality Config) qualityConfig {
+	return qualityConfig{
+		MinFPS:                  quality.MinimumFPS(),
+		MaxFPS:                  quality.MaximumFPS(),
+		MinJPEGQuality:          quality.MinimumJPEGQuality(),
+		MaxJPEGQuality:          quality.MaximumJPEGQuality(),
+		DesiredTotalThroughput:  quality.DesiredTotalThroughput(),
+		DesiredClientThroughput: quality.DesiredClientThroughput(),
+		MinResolution:           quality.MinimumResolution(),
+		MaxResolution:           quality.MaximumResolution(),
+	}
+}
+
+// maxClientMessage is the largest message a client is allowed to send.
+const maxClientMessage = 1 << 16
+
+type frame struct {
+	data []byte
+	meta protocol.FrameMeta
+}
+
 type Server struct {
 	l *log.Logger
 
@@ -64,25 +156,37 @@ type Server struct {
 		pass     []byte
 		maxPeers int
 
-		data []byte
+		frame      *frame
+		throughput float64
+		rtt        map[net.Conn]*protocol.RTT
+
+		keepaliveInterval time.Duration
+		keepaliveTimeout  time.Duration
 
-		clients int
-		peers   int
-		bytes   uint64
-		since   time.Time
+		clients  int
+		peers    int
+		rejected uint64
+		bytes    uint64
+		since    time.Time
 
 		proto *protocol.Protocol
+		tls   *tls.Config
 	}
 
 	cam struct {
 		reinit      bool
+		rescan      bool
 		device      string
 		cam         *webcam.Webcam
 		activeRes   int
 		resolutions []Resolution
 	}
 
-	frameCount               uint64
+	status struct {
+		seq uint64
+		msg string
+	}
+
 	fps                      int
 	jpegOpts                 *jpeg.Options
 	lastResolutionAdjustment time.Time
@@ -91,8 +195,48 @@ type Server struct {
 	quality qualityConfig
 
 	scryptRatelimit chan struct{}
+	auditLog        AuditLog
+
+	totp struct {
+		secret     string
+		remoteOnly bool
+		used       map[totpUse]struct{}
+		// failures is keyed by totpKey.
+		failures map[string]*totpFailures
+	}
+
+	devices struct {
+		store   DeviceStore
+		key     ed25519.PrivateKey
+		pairing Pairing
+	}
+
+	access struct {
+		conn    *acl.ACL
+		admin   *acl.ACL
+		devices *acl.ACL
+	}
+
+	run struct {
+		started bool
+		// fed is set once Feed encodes frames from elsewhere, scaled if
+		// FeedScaled did so they follow cam.activeRes.
+		fed    bool
+		scaled bool
+		closed bool
+		output chan *Frame
+		errs   chan error
+		// stop is closed by Shutdown, captured once capturing stopped.
+		stop      chan struct{}
+		captured  chan struct{}
+		listeners map[net.Listener]struct{}
+		conns     map[net.Conn]struct{}
+		sessions  sync.WaitGroup
+	}
 }
 
+// New creates a server without device authentication, TLS, access lists
+// or an audit log, see NewServer for those.
 func New(
 	l *log.Logger,
 	addr string,
@@ -101,53 +245,139 @@ func New(
 	quality Config,
 	maxPeers int,
 ) *Server {
-	q := qualityConfig{
-		MinFPS:                  quality.MinimumFPS(),
-		MaxFPS:                  quality.MaximumFPS(),
-		MinJPEGQuality:          quality.MinimumJPEGQuality(),
-		MaxJPEGQuality:          quality.MaximumJPEGQuality(),
-		DesiredTotalThroughput:  quality.DesiredTotalThroughput(),
-		DesiredClientThroughput: quality.DesiredClientThroughput(),
-		MinResolution:           quality.MinimumResolution(),
-		MaxResolution:           quality.MaximumResolution(),
-	}
+	return NewServer(Options{
+		Logger:   l,
+		Address:  addr,
+		Password: pass,
+		Device:   device,
+		Quality:  quality,
+		MaxPeers: maxPeers,
+	})
+}
+
+// NewServer creates a server, nothing happens until Start, Listen or Serve
+// is called.
+func NewServer(o Options) *Server {
+	o = o.withDefaults()
+	q := newQualityConfig(o.Quality)
 
 	s := &Server{
-		l:               l,
+		l:               o.Logger,
 		fps:             q.MaxFPS,
 		jpegOpts:        &jpeg.Options{Quality: q.MaxJPEGQuality},
 		quality:         q,
 		scryptRatelimit: make(chan struct{}, 1),
+		auditLog:        o.AuditLog,
 	}
 
-	s.cam.device = device
-	s.net.addr = addr
-	s.net.maxPeers = maxPeers
+	s.cam.device = o.Device
+	s.net.addr = o.Address
+	s.net.maxPeers = o.MaxPeers
+	s.net.rtt = make(map[net.Conn]*protocol.RTT)
+	s.net.keepaliveInterval = o.Keepalive.KeepaliveInterval()
+	s.net.keepaliveTimeout = o.Keepalive.KeepaliveTimeout()
+	s.totp.secret = o.TOTP.TOTPSecret()
+	s.totp.remoteOnly = o.TOTP.TOTPRemoteOnly()
+	s.devices.store = o.Devices
+	s.devices.key = o.Key
+	s.devices.pairing = o.Pairing
 	s.net.since = time.Now()
-	s.net.pass = pass
+	s.net.pass = o.Password
+	s.net.tls = o.TLS
+	s.access.conn = o.Access.ConnectionACL()
+	s.access.admin = o.Access.AdminACL()
+	s.access.devices = o.Access.DeviceACL()
+	s.run.errs = make(chan error, errBuffer)
+	s.run.stop = make(chan struct{})
+	s.run.captured = make(chan struct{})
+	s.run.listeners = make(map[net.Listener]struct{})
+	s.run.conns = make(map[net.Conn]struct{})
+
+	caps := protocol.Local(vars.MaxFrameSize)
+	if o.Devices == nil || o.Key == nil {
+		caps.Features &^= protocol.FeatureDeviceAuth | protocol.FeaturePairing
+	}
+	if o.Pairing == nil {
+		caps.Features &^= protocol.FeaturePairing
+	}
 	s.net.proto = protocol.New(
 		vars.HandshakeCost,
 		vars.EncryptCost,
 		vars.HandshakeLen,
 		vars.HandshakeHashLen,
+		caps,
 	)
 
 	return s
 }
 
-func (s *Server) initCam() {
+// Reload applies a new configuration to the running server without
+// dropping clients. Changes to the address, device, keepalive, TLS and audit
+// log settings require a restart.
+func (s *Server) Reload(
+	pass []byte,
+	quality Config,
+	maxPeers int,
+	twoFactor TOTPConfig,
+	access AccessConfig,
+) {
+	q := newQualityConfig(quality)
+	s.sem.Lock()
+	defer s.sem.Unlock()
+
+	if q.MinResolution != s.quality.MinResolution || q.MaxResolution != s.quality.MaxResolution {
+		s.cam.rescan = true
+		s.cam.reinit = true
+	}
+
+	s.quality = q
+	if s.fps < q.MinFPS {
+		s.fps = q.MinFPS
+	} else if s.fps > q.MaxFPS {
+		s.fps = q.MaxFPS
+	}
+	if s.jpegOpts.Quality < q.MinJPEGQuality {
+		s.jpegOpts.Quality = q.MinJPEGQuality
+	} else if s.jpegOpts.Quality > q.MaxJPEGQuality {
+		s.jpegOpts.Quality = q.MaxJPEGQuality
+	}
+
+	s.net.maxPeers = maxPeers
+	s.net.pass = pass
+	if secret := twoFactor.TOTPSecret(); secret != s.totp.secret {
+		s.totp.secret = secret
+		s.totp.used = nil
+		s.totp.failures = nil
+	}
+	s.totp.remoteOnly = twoFactor.TOTPRemoteOnly()
+	s.access.conn = access.ConnectionACL()
+	s.access.admin = access.AdminACL()
+	s.access.devices = access.DeviceACL()
+}
+
+// initCam keeps trying to open the camera until it succeeds or Shutdown is
+// called, in which case it returns false.
+func (s *Server) initCam() bool {
 	var last time.Time
 	for {
 		err := s.tryInitCam()
 		if err == nil {
-			break
+			s.setStatus("")
+			return true
 		}
 
 		if time.Since(last) > time.Second*10 {
 			last = time.Now()
 			s.l.Printf("Initiating cam failed: %s, will keep trying", err)
+			s.report(fmt.Errorf("Initiating cam failed: %s", err))
+			s.setStatus("Camera unavailable")
+		}
+
+		select {
+		case <-s.run.stop:
+			return false
+		case <-time.After(time.Second):
 		}
-		time.Sleep(time.Second)
 	}
 }
 
@@ -164,31 +394,31 @@ func (s *Server) tryInitCam() error {
 		return err
 	}
 
-	formats := s.cam.cam.GetSupportedFormats()
-	// TODO
-	// get first one for now
-	var pix webcam.PixelFormat
-	for i := range formats {
-		pix = i
-		break
+	pix, err := pixelFormat(s.cam.cam.GetSupportedFormats())
+	if err != nil {
+		return err
 	}
 
-	if s.cam.resolutions == nil {
+	s.sem.Lock()
+	rescan := s.cam.resolutions == nil || s.cam.rescan
+	minRes, maxRes := s.quality.MinResolution, s.quality.MaxResolution
+	s.sem.Unlock()
+
+	if rescan {
 		sizes := s.cam.cam.GetSupportedFrameSizes(pix)
-		s.cam.resolutions = make([]Resolution, 0, len(sizes))
+		resolutions := make([]Resolution, 0, len(sizes))
 		for i := range sizes {
 			res := int(sizes[i].MaxWidth * sizes[i].MinHeight)
-			if res < s.quality.MinResolution || res > s.quality.MaxResolution {
+			if res < minRes || res > maxRes {
 				continue
 			}
-			s.cam.resolutions = append(
-				s.cam.resolutions,
+			resolutions = append(
+				resolutions,
 				Resolution{sizes[i].MaxWidth, sizes[i].MinHeight},
 			)
 		}
-		s.cam.activeRes = len(s.cam.resolutions) - 1
 
-		if len(s.cam.resolutions) == 0 {
+		if len(resolutions) == 0 {
 			for i := range sizes {
 				s.l.Printf(
 					"%dx%d = %d",
@@ -200,9 +430,15 @@ func (s *Server) tryInitCam() error {
 			return errors.New("No resolutions found, try adjusting the min/max requirments")
 		}
 
-		sort.Slice(s.cam.resolutions, func(i, j int) bool {
-			return s.cam.resolutions[i].Resolution() < s.cam.resolutions[j].Resolution()
+		sort.Slice(resolutions, func(i, j int) bool {
+			return resolutions[i].Resolution() < resolutions[j].Resolution()
 		})
+
+		s.sem.Lock()
+		s.cam.resolutions = resolutions
+		s.cam.activeRes = len(resolutions) - 1
+		s.cam.rescan = false
+		s.sem.Unlock()
 	}
 
 	_, _, _, err = s.cam.cam.SetImageFormat(
@@ -218,9 +454,24 @@ func (s *Server) tryInitCam() error {
 	return s.cam.cam.StartStreaming()
 }
 
-func (s *Server) connErr(err error) {
-	if err != io.EOF {
-		s.l.Println(err)
+// connErr logs err and records it as the reason the connection ended.
+func (s *Server) connErr(e *audit.Entry, err error) {
+	if err == io.EOF {
+		e.Reason = "Client disconnected"
+		return
+	}
+
+	e.Reason = err.Error()
+	s.l.Println(err)
+}
+
+func (s *Server) audit(e audit.Entry) {
+	if s.auditLog == nil {
+		return
+	}
+
+	if err := s.auditLog.Write(e); err != nil {
+		s.l.Printf("Writing audit log failed: %s", err)
 	}
 }
 
@@ -237,6 +488,7 @@ func (s *Server) addBytes(bytes uint64) {
 
 	if since > iv {
 		throughput := float64(s.net.bytes) / since
+		s.net.throughput = throughput
 		s.net.since = time.Now()
 		s.net.bytes = 0
 
@@ -251,6 +503,11 @@ func (s *Server) addBytes(bytes uint64) {
 		}
 
 		factor := throughput / desired
+		maxRTT, congested := s.congestion()
+		if congested && factor < 1.1 {
+			factor = 1.1
+		}
+
 		if factor < 0.01 {
 			factor = 0.01
 		} else if factor > 20 {
@@ -330,11 +587,17 @@ func (s *Server) addBytes(bytes uint64) {
 				s.lastResolutionAdjustment = time.Now()
 			}
 
+			var width, height uint32
+			if s.cam.activeRes < len(s.cam.resolutions) {
+				width = s.cam.resolutions[s.cam.activeRes].width
+				height = s.cam.resolutions[s.cam.activeRes].height
+			}
 			s.l.Printf(
-				"%.1fkB/s throughput => Quality adjustment: %dx%d @ %dfps (jpeg: %d)",
+				"%.1fkB/s throughput, %s rtt => Quality adjustment: %dx%d @ %dfps (jpeg: %d)",
 				throughput/1024,
-				s.cam.resolutions[s.cam.activeRes].width,
-				s.cam.resolutions[s.cam.activeRes].height,
+				maxRTT,
+				width,
+				height,
 				s.fps,
 				s.jpegOpts.Quality,
 			)
@@ -362,163 +625,1150 @@ func (s *Server) addPeer(amount int) error {
 }
 
 func (s *Server) conn(c net.Conn) {
-	b := make([]byte, 1)
-	var frame uint64 = 0
+	e := &audit.Entry{
+		Time:    time.Now(),
+		Remote:  c.RemoteAddr().String(),
+		Outcome: audit.OutcomeHandshakeFailed,
+	}
+	defer func() {
+		if e.Outcome == "" {
+			return
+		}
+		e.Duration = time.Since(e.Time).Seconds()
+		s.audit(*e)
+	}()
+
+	s.session(c, e)
+}
+
+func (s *Server) session(c net.Conn, e *audit.Entry) {
 	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		s.connErr(e, err)
+		return
+	}
+
+	n, err := s.net.proto.NegotiateServer(c)
+	if err == io.EOF {
+		// Closed without announcing itself, e.g. a client checking whether
+		// this address is reachable, nothing to audit.
+		e.Outcome = ""
+		return
+	}
+	if err != nil {
+		e.Outcome, e.Reason = audit.OutcomeNegotiationFailed, err.Error()
+		s.l.Printf("Negotiation with %s failed: %s", c.RemoteAddr(), err)
+		return
+	}
+
 	if err := s.addPeer(1); err != nil {
-		s.connErr(err)
+		e.Outcome = audit.OutcomeFull
+		if n.Has(protocol.FeatureAdmission) {
+			protocol.WriteAdmission(c, err)
+		} else {
+			protocol.WriteMessage(c, protocol.MessageError, []byte(err.Error()))
+		}
+		s.connErr(e, err)
 		return
 	}
 	defer s.addPeer(-1)
 
-	if err := c.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
-		s.connErr(err)
+	if n.Has(protocol.FeatureAdmission) {
+		if err := protocol.WriteAdmission(c, nil); err != nil {
+			s.connErr(e, err)
+			return
+		}
+	}
+
+	method := protocol.AuthPassword
+	if n.Has(protocol.FeatureDeviceAuth) {
+		if method, err = protocol.ReadAuthMethod(c); err != nil {
+			s.connErr(e, err)
+			return
+		}
+	}
+	if method == protocol.AuthPair && !n.Has(protocol.FeaturePairing) {
+		s.connErr(e, fmt.Errorf("Pairing attempt from %s without negotiating it", c.RemoteAddr()))
 		return
 	}
 
-	common := make([]byte, len(vars.CommonSecret))
-	copy(common, vars.CommonSecret)
-	common = append(common, s.net.pass...)
-	s.scryptRatelimit <- struct{}{}
-	crypter, err := s.net.proto.HandshakeServer(common, c)
+	s.sem.Lock()
+	roleACL, role := s.access.admin, "password"
+	switch method {
+	case protocol.AuthDevice:
+		roleACL, role = s.access.devices, "device"
+	case protocol.AuthPair:
+		roleACL, role = s.access.devices, "pairing"
+	}
+	s.sem.Unlock()
+	e.Auth = role
+	if !roleACL.Allowed(c.RemoteAddr()) {
+		e.Outcome, e.Reason = audit.OutcomeRejected, role+" authentication refused by ACL"
+		s.reject(c.RemoteAddr(), role+" authentication")
+		return
+	}
+
+	var crypter *crypto.ImmutableKeyEncrypter
+	var ch *protocol.Channel
+	var dev *device.Device
+	var token string
+	switch method {
+	case protocol.AuthDevice:
+		crypter, ch, dev, err = s.handshakeDevice(c)
+	case protocol.AuthPair:
+		crypter, ch, token, err = s.handshakePairing(c)
+	default:
+		crypter, ch, err = s.handshakePassword(c)
+	}
+	if dev != nil {
+		e.Device, e.Fingerprint = dev.Name, dev.Fingerprint()
+	}
 	if err != nil {
-		<-s.scryptRatelimit
-		s.connErr(err)
+		if err == protocol.ErrInvalidHandshake {
+			e.Outcome = audit.OutcomeDenied
+			err = fmt.Errorf("Denied %s authentication from %s", role, c.RemoteAddr())
+			if dev != nil {
+				err = fmt.Errorf("Denied device %s from %s, not enrolled", e.Fingerprint, c.RemoteAddr())
+			}
+		}
+		s.connErr(e, err)
 		return
 	}
-	<-s.scryptRatelimit
 
+	e.Outcome = audit.OutcomeAccepted
 	s.addClient(1)
 	defer s.addClient(-1)
-	s.l.Println("New client", c.RemoteAddr())
-	if err != nil {
-		s.connErr(err)
+	if dev != nil {
+		s.l.Printf("New client %s, device '%s' (%s)", c.RemoteAddr(), dev.Name, n)
+	} else {
+		s.l.Printf("New client %s (%s)", c.RemoteAddr(), n)
+	}
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		s.connErr(e, err)
 		return
 	}
 
-	w := newCountWriter(c)
-	var nbytes uint64
-
-	for {
-		if err := c.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
-			s.connErr(err)
-			return
-		}
+	push := n.Has(protocol.FeaturePush)
+	msgs := make(chan protocol.Message)
+	readErr := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			err := c.SetReadDeadline(time.Now().Add(s.net.keepaliveTimeout))
+			if err != nil {
+				readErr <- err
+				return
+			}
 
-		_, err := c.Read(b)
-		if err != nil {
-			s.connErr(err)
-			return
-		}
+			m, err := protocol.ReadMessage(c, maxClientMessage)
+			if err != nil {
+				readErr <- err
+				return
+			}
 
-		w.Reset()
-		if frame == s.frameCount {
-			if _, err = w.Flush([]byte{0, 0, 0}); err != nil {
-				s.connErr(err)
+			select {
+			case msgs <- m:
+			case <-quit:
 				return
 			}
+		}
+	}()
 
-			time.Sleep(time.Millisecond * 50)
-			continue
+	write := func(t protocol.MessageType, payload []byte) error {
+		if err := c.SetWriteDeadline(time.Now().Add(s.net.keepaliveTimeout)); err != nil {
+			return err
+		}
+		if err := protocol.WriteMessage(c, t, payload); err != nil {
+			return err
 		}
+		e.Bytes += uint64(5 + len(payload))
+		return nil
+	}
+	sealed := func(t protocol.MessageType, payload []byte) error {
+		return write(t, ch.Seal(t, payload))
+	}
 
-		frame = s.frameCount
-		err = crypter.Encrypt(bytes.NewBuffer(s.net.data), w)
-		if err != nil {
-			s.connErr(err)
+	rtt := &protocol.RTT{}
+	s.setRTT(c, rtt)
+	defer s.setRTT(c, nil)
+
+	// A pairing session may only enroll, the token is its second factor.
+	pairing := method == protocol.AuthPair
+	var totpAttempts int
+	var totpRequested time.Time
+	totpPending := !pairing && s.requireTOTP(c.RemoteAddr())
+	if totpPending {
+		if !n.Has(protocol.FeatureTOTP) {
+			err := errors.New("One-time password required, client upgrade required")
+			e.Outcome = audit.OutcomeDenied
+			write(protocol.MessageError, []byte(err.Error()))
+			s.connErr(e, err)
 			return
 		}
 
-		nbytes, err = w.Flush(nil)
-		if err != nil {
-			s.connErr(err)
+		totpRequested = time.Now()
+		if err := sealed(protocol.MessageTOTPRequest, nil); err != nil {
+			s.connErr(e, err)
 			return
 		}
-		s.addBytes(nbytes)
 	}
-}
 
-func (s *Server) Listen(output <-chan *bytes.Buffer) error {
-	ln, err := net.Listen("tcp", s.net.addr)
-	if err != nil {
-		return err
-	}
+	var frame uint64 = 0
+	var status uint64 = 0
+	var polled bool
+	var pinged time.Time
+	ticker := time.NewTicker(time.Millisecond * 50)
+	defer ticker.Stop()
 
-	go func() {
-		for d := range output {
-			if s.jpegOpts.Quality < 100 {
-				i, err := jpeg.Decode(d)
+	for {
+		select {
+		case err := <-readErr:
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				err = fmt.Errorf(
+					"Client %s timed out, no keepalive within %s",
+					c.RemoteAddr(),
+					s.net.keepaliveTimeout,
+				)
+			}
+			s.connErr(e, err)
+			return
+		case m := <-msgs:
+			if m.Type.Sealed() {
+				if m.Payload, err = ch.Open(m); err != nil {
+					e.Reason = fmt.Sprintf("Unauthenticated %s message", m.Type)
+					s.l.Printf("%s from %s", e.Reason, c.RemoteAddr())
+					return
+				}
+			}
+
+			switch m.Type {
+			case protocol.MessagePoll:
+				polled = true
+			case protocol.MessageKeepalive:
+				k, err := protocol.ParseKeepalive(m.Payload)
+				if err != nil {
+					s.connErr(e, err)
+					return
+				}
+				if k.IsPong() {
+					s.addRTT(c, k.RTT())
+					break
+				}
+				if err := write(protocol.MessageKeepalive, k.Pong()); err != nil {
+					s.connErr(e, err)
+					return
+				}
+			case protocol.MessageTOTPResponse:
+				if !totpPending {
+					s.connErr(e, fmt.Errorf("Unexpected %s message from %s", m.Type, c.RemoteAddr()))
+					return
+				}
+
+				ok, reused, err := s.verifyTOTP(totpKey(c.RemoteAddr(), dev), string(m.Payload))
+				if err != nil {
+					e.Outcome = audit.OutcomeDenied
+					write(protocol.MessageError, []byte(err.Error()))
+					s.connErr(e, err)
+					return
+				}
+
+				if reused {
+					s.l.Printf("Reused one-time password from %s", c.RemoteAddr())
+					err := write(protocol.MessageStatus, []byte("One-time password already used, wait for the next one"))
+					if err == nil {
+						err = sealed(protocol.MessageTOTPResult, []byte{0})
+					}
+					if err != nil {
+						s.connErr(e, err)
+						return
+					}
+					break
+				}
+
+				if !ok {
+					totpAttempts++
+					s.l.Printf("Invalid one-time password from %s", c.RemoteAddr())
+					if totpAttempts >= totpMaxAttempts {
+						e.Outcome, e.Reason = audit.OutcomeDenied, "Too many invalid one-time passwords"
+						write(protocol.MessageError, []byte(e.Reason))
+						return
+					}
+					if err := sealed(protocol.MessageTOTPResult, []byte{0}); err != nil {
+						s.connErr(e, err)
+						return
+					}
+					break
+				}
+
+				totpPending = false
+				if err := sealed(protocol.MessageTOTPResult, []byte{1}); err != nil {
+					s.connErr(e, err)
+					return
+				}
+			case protocol.MessageControl:
+				if totpPending {
+					s.connErr(e, fmt.Errorf("Control message from %s before one-time password", c.RemoteAddr()))
+					return
+				}
+
+				d, enrolled, err := s.control(m.Payload, role, token)
 				if err != nil {
-					s.l.Println(err)
-					continue
+					s.connErr(e, err)
+					return
+				}
+				if err := sealed(protocol.MessageControlReply, d); err != nil {
+					s.connErr(e, err)
+					return
 				}
-				d.Reset()
-				if err := jpeg.Encode(d, i, s.jpegOpts); err != nil {
-					s.l.Println(err)
-					continue
+				if pairing && enrolled {
+					e.Reason = "Paired"
+					return
 				}
+			default:
+				s.connErr(e, fmt.Errorf("Unexpected %s message from %s", m.Type, c.RemoteAddr()))
+				return
+			}
+		case <-s.run.stop:
+			e.Reason = "Server is shutting down"
+			write(protocol.MessageError, []byte(e.Reason))
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(pinged) > s.net.keepaliveInterval {
+			pinged = time.Now()
+			if dev != nil && !s.enrolled(dev.PublicKey) {
+				e.Reason = "Device revoked"
+				write(protocol.MessageError, []byte(e.Reason))
+				s.l.Printf("Disconnected revoked device '%s' (%s)", dev.Name, c.RemoteAddr())
+				return
 			}
-			s.net.data = d.Bytes()
-			s.frameCount++
-			if s.frameCount > 1e16 {
-				s.frameCount = 0
+			if err := write(protocol.MessageKeepalive, protocol.Ping()); err != nil {
+				s.connErr(e, err)
+				return
 			}
 		}
-	}()
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			conn.Close()
-			s.connErr(err)
+		if pairing {
+			if time.Since(e.Time) > pairingTimeout {
+				e.Reason = "No enrollment within " + pairingTimeout.String()
+				write(protocol.MessageError, []byte(e.Reason))
+				return
+			}
 			continue
 		}
 
-		go s.conn(conn)
-	}
-}
-
-func (s *Server) Start() (<-chan *bytes.Buffer, <-chan error) {
-	errs := make(chan error)
-	output := make(chan *bytes.Buffer, 1)
-	var last time.Time
-	go func() {
-		s.cam.reinit = true
-		for {
-			if s.cam.reinit {
-				s.cam.reinit = false
-				s.initCam()
+		if totpPending {
+			if time.Since(totpRequested) > totpTimeout {
+				e.Outcome, e.Reason = audit.OutcomeDenied, "No one-time password entered in time"
+				write(protocol.MessageError, []byte(e.Reason))
+				return
 			}
+			continue
+		}
 
-			err := s.cam.cam.WaitForFrame(1)
-			switch err.(type) {
-			case nil:
-			case *webcam.Timeout:
-				continue
-			default:
-				s.l.Printf("Failed waiting for cam frame: %s", err)
-				s.cam.reinit = true
-				continue
+		if seq, msg := s.getStatus(); seq != status {
+			status = seq
+			if err := write(protocol.MessageStatus, []byte(msg)); err != nil {
+				s.connErr(e, err)
+				return
 			}
+		}
 
-			if time.Since(last) < time.Second/time.Duration(s.fps) {
-				s.cam.cam.ReadFrame()
-				continue
-			}
+		if !push && !polled {
+			continue
+		}
 
-			_d, err := s.cam.cam.ReadFrame()
-			if err != nil {
-				s.l.Printf("Failed reading cam frame: %s", err)
-				s.cam.reinit = true
-				continue
-			}
-			d := make([]byte, len(_d))
-			copy(d, _d)
+		f := s.getFrame()
+		if f == nil || f.meta.Sequence == frame {
+			continue
+		}
 
-			last = time.Now()
-			output <- bytes.NewBuffer(d)
+		frame = f.meta.Sequence
+		buf := bytes.NewBuffer(nil)
+		if err := crypter.Encrypt(bytes.NewBuffer(f.data), buf); err != nil {
+			s.connErr(e, err)
+			return
 		}
-	}()
 
-	return output, errs
+		payload := protocol.FramePayload(n, f.meta, buf.Bytes())
+		if len(payload) > int(n.MaxFrameSize) {
+			s.l.Printf(
+				"Dropping frame of %dB for %s, exceeds max frame size of %dB",
+				len(payload),
+				c.RemoteAddr(),
+				n.MaxFrameSize,
+			)
+			continue
+		}
+
+		polled = false
+		if err := write(protocol.MessageFrame, payload); err != nil {
+			s.connErr(e, err)
+			return
+		}
+		s.addBytes(uint64(len(payload)))
+	}
+}
+
+// reject counts and logs a connection refused by an ACL.
+func (s *Server) reject(addr net.Addr, reason string) {
+	s.sem.Lock()
+	s.net.rejected++
+	n := s.net.rejected
+	s.sem.Unlock()
+	s.l.Printf("Rejected %s from %s by ACL (%d rejected in total)", reason, addr, n)
+}
+
+func (s *Server) handshakePassword(c net.Conn) (*crypto.ImmutableKeyEncrypter, *protocol.Channel, error) {
+	s.sem.Lock()
+	common := make([]byte, len(vars.CommonSecret))
+	copy(common, vars.CommonSecret)
+	common = append(common, s.net.pass...)
+	s.sem.Unlock()
+	s.scryptRatelimit <- struct{}{}
+	crypter, ch, err := s.net.proto.HandshakeServer(common, c)
+	<-s.scryptRatelimit
+	return crypter, ch, err
+}
+
+// handshakePairing authenticates with the pending pairing token, which is
+// returned to be consumed once the session enrolled a device.
+func (s *Server) handshakePairing(c net.Conn) (*crypto.ImmutableKeyEncrypter, *protocol.Channel, string, error) {
+	token, err := s.devices.pairing.Token()
+	if err != nil {
+		s.l.Printf("Pairing attempt from %s: %s", c.RemoteAddr(), err)
+		// Fail the handshake like a wrong token would.
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, "", err
+		}
+		token = string(b)
+	}
+
+	common := make([]byte, len(vars.CommonSecret))
+	copy(common, vars.CommonSecret)
+	common = append(common, token...)
+	s.scryptRatelimit <- struct{}{}
+	crypter, ch, err := s.net.proto.HandshakeServer(common, c)
+	<-s.scryptRatelimit
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return crypter, ch, token, nil
+}
+
+func (s *Server) handshakeDevice(c net.Conn) (*crypto.ImmutableKeyEncrypter, *protocol.Channel, *device.Device, error) {
+	var dev device.Device
+	crypter, ch, pub, err := s.net.proto.HandshakeDeviceServer(
+		s.devices.key,
+		func(pub []byte) bool {
+			var err error
+			dev, err = s.devices.store.Lookup(pub)
+			if err != nil && err != device.ErrNotFound {
+				s.l.Println(err)
+			}
+			return err == nil
+		},
+		c,
+	)
+	if dev.PublicKey == nil {
+		dev.PublicKey = pub
+	}
+
+	return crypter, ch, &dev, err
+}
+
+// enrolled fails closed, like handshakeDevice, a store that can not be read
+// revokes every device.
+func (s *Server) enrolled(pub []byte) bool {
+	_, err := s.devices.store.Lookup(pub)
+	if err != nil && err != device.ErrNotFound {
+		s.l.Println(err)
+	}
+	return err == nil
+}
+
+// control runs a control command for a session authenticated as role and
+// reports whether a device was enrolled. Pairing sessions can only enroll,
+// which consumes their token.
+func (s *Server) control(payload []byte, role, token string) ([]byte, bool, error) {
+	admin := role == "password"
+	var c protocol.Control
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, false, err
+	}
+
+	r := protocol.ControlReply{Command: c.Command}
+	var body interface{}
+	var err error
+	switch {
+	case role == "pairing" && c.Command != "enroll":
+		r.Error = "Pairing sessions can only enroll"
+	case c.Command == "status":
+		body = s.Status()
+	case c.Command == "audit":
+		if !admin {
+			r.Error = "Only password sessions can view the audit log"
+			break
+		}
+		body, err = s.recentAudit(c.Args)
+		if err != nil {
+			r.Error = err.Error()
+		}
+	case c.Command == "enroll", c.Command == "devices", c.Command == "revoke":
+		if !admin && role != "pairing" {
+			r.Error = "Only password sessions can manage devices"
+			break
+		}
+		if s.devices.store == nil {
+			r.Error = "Device enrollment is disabled"
+			break
+		}
+		if role != "pairing" {
+			token = ""
+		}
+		body, err = s.controlDevices(c, token)
+		if err != nil {
+			r.Error = err.Error()
+		}
+	default:
+		r.Error = fmt.Sprintf("Unknown command '%s'", c.Command)
+	}
+
+	if body != nil {
+		d, err := json.Marshal(body)
+		if err != nil {
+			return nil, false, err
+		}
+		r.Body = d
+	}
+
+	d, err := json.Marshal(r)
+	return d, c.Command == "enroll" && r.Error == "", err
+}
+
+func (s *Server) recentAudit(args []string) ([]audit.Entry, error) {
+	if s.auditLog == nil {
+		return nil, errors.New("Audit log is disabled")
+	}
+
+	n := 50
+	if len(args) != 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+			return nil, errors.New("Usage: audit [number of entries]")
+		}
+	}
+
+	return s.auditLog.Recent(n)
+}
+
+// controlDevices runs a device command, enrolling consumes token if set.
+func (s *Server) controlDevices(c protocol.Control, token string) (interface{}, error) {
+	switch c.Command {
+	case "enroll":
+		if len(c.Args) != 2 || strings.TrimSpace(c.Args[0]) == "" {
+			return nil, errors.New("Usage: enroll <name> <base64 public key>")
+		}
+		pub, err := base64.StdEncoding.DecodeString(c.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(pub) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid public key")
+		}
+		if token != "" {
+			if err := s.devices.pairing.Consume(token); err != nil {
+				return nil, err
+			}
+		}
+		dev, err := s.devices.store.Enroll(c.Args[0], pub)
+		if err != nil {
+			return nil, err
+		}
+		s.l.Printf("Enrolled device '%s' (%s)", dev.Name, dev.Fingerprint())
+		return protocol.SignEnrollment(s.devices.key, pub), nil
+	case "revoke":
+		if len(c.Args) != 1 {
+			return nil, errors.New("Usage: revoke <name or fingerprint>")
+		}
+		dev, err := s.devices.store.Revoke(c.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		s.l.Printf("Revoked device '%s' (%s)", dev.Name, dev.Fingerprint())
+		return dev, nil
+	}
+
+	return s.devices.store.List()
+}
+
+// Status is a snapshot of the current stream settings.
+type Status struct {
+	Clients    int
+	Peers      int
+	Rejected   uint64
+	FPS        int
+	Quality    int
+	Width      int
+	Height     int
+	Throughput float64
+	RTT        time.Duration
+}
+
+func (s *Server) Status() Status {
+	s.sem.Lock()
+	st := Status{
+		Clients:    s.net.clients,
+		Peers:      s.net.peers,
+		Rejected:   s.net.rejected,
+		FPS:        s.fps,
+		Quality:    s.jpegOpts.Quality,
+		Throughput: s.net.throughput,
+	}
+	st.RTT, _ = s.congestion()
+	if f := s.net.frame; f != nil {
+		st.Width = int(f.meta.Width)
+		st.Height = int(f.meta.Height)
+	}
+	s.sem.Unlock()
+	return st
+}
+
+func (s *Server) requireTOTP(addr net.Addr) bool {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if s.totp.secret == "" {
+		return false
+	}
+
+	return !s.totp.remoteOnly || !acl.IsLAN(addr)
+}
+
+// totpUse is a one-time password accepted for a time step.
+type totpUse struct {
+	counter int64
+	code    string
+}
+
+type totpFailures struct {
+	n    int
+	last time.Time
+}
+
+// totpKey is what invalid one-time passwords are counted by: the device for
+// device sessions and the remote host otherwise, so knowing the password
+// does not allow locking out everyone else.
+func totpKey(addr net.Addr, dev *device.Device) string {
+	if dev != nil {
+		return "device " + dev.Fingerprint()
+	}
+
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return "host " + host
+}
+
+// verifyTOTP checks a one-time password, rejecting reuse of an already
+// accepted one and locking out key after too many failures. A reused code
+// is no guess, it is reported as such and does not count as a failure.
+func (s *Server) verifyTOTP(key, code string) (ok, reused bool, err error) {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	now := time.Now()
+	for k, f := range s.totp.failures {
+		if now.Sub(f.last) >= totpLockout {
+			delete(s.totp.failures, k)
+		}
+	}
+
+	if f := s.totp.failures[key]; f != nil && f.n >= totpMaxFailures {
+		return false, false, errors.New("Too many invalid one-time passwords, try again later")
+	}
+
+	counter, ok, err := totp.Verify(s.totp.secret, code, now, totpSkew)
+	if err != nil {
+		return false, false, err
+	}
+
+	if !ok {
+		if s.totp.failures == nil {
+			s.totp.failures = make(map[string]*totpFailures)
+		}
+		f := s.totp.failures[key]
+		if f == nil {
+			f = &totpFailures{}
+			s.totp.failures[key] = f
+		}
+		f.n++
+		f.last = now
+		return false, false, nil
+	}
+
+	oldest := totp.Counter(now) - totpSkew
+	for u := range s.totp.used {
+		if u.counter < oldest {
+			delete(s.totp.used, u)
+		}
+	}
+
+	use := totpUse{counter, code}
+	if _, ok := s.totp.used[use]; ok {
+		return false, true, nil
+	}
+	if s.totp.used == nil {
+		s.totp.used = make(map[totpUse]struct{})
+	}
+	s.totp.used[use] = struct{}{}
+	delete(s.totp.failures, key)
+	return true, false, nil
+}
+
+func (s *Server) setRTT(c net.Conn, rtt *protocol.RTT) {
+	s.sem.Lock()
+	if rtt == nil {
+		delete(s.net.rtt, c)
+	} else {
+		s.net.rtt[c] = rtt
+	}
+	s.sem.Unlock()
+}
+
+func (s *Server) addRTT(c net.Conn, d time.Duration) {
+	s.sem.Lock()
+	if rtt, ok := s.net.rtt[c]; ok {
+		rtt.Add(d)
+	}
+	s.sem.Unlock()
+}
+
+// congestion returns the highest smoothed round-trip time and whether any
+// client's path appears congested. Expects s.sem to be locked.
+func (s *Server) congestion() (time.Duration, bool) {
+	var max time.Duration
+	var congested bool
+	for _, rtt := range s.net.rtt {
+		if rtt.Smoothed() > max {
+			max = rtt.Smoothed()
+		}
+		if rtt.Congested() {
+			congested = true
+		}
+	}
+
+	return max, congested
+}
+
+func (s *Server) setStatus(msg string) {
+	s.sem.Lock()
+	if s.status.msg != msg {
+		s.status.msg = msg
+		s.status.seq++
+	}
+	s.sem.Unlock()
+}
+
+func (s *Server) getStatus() (uint64, string) {
+	s.sem.Lock()
+	seq, msg := s.status.seq, s.status.msg
+	s.sem.Unlock()
+	return seq, msg
+}
+
+func (s *Server) getFrame() *frame {
+	s.sem.Lock()
+	f := s.net.frame
+	s.sem.Unlock()
+	return f
+}
+
+// ErrServerClosed is returned by Serve and Listen after Shutdown.
+var ErrServerClosed = errors.New("Server closed")
+
+// errBuffer is how many errors Start's error channel holds, errors are
+// dropped when nobody reads them.
+const errBuffer = 16
+
+// report sends err on the error channel returned by Start without blocking.
+func (s *Server) report(err error) {
+	select {
+	case s.run.errs <- err:
+	default:
+	}
+}
+
+// Listen listens on the configured address and serves the frames read from
+// output, the channel returned by Start.
+func (s *Server) Listen(output <-chan *Frame) error {
+	ln, err := net.Listen("tcp", s.net.addr)
+	if err != nil {
+		return err
+	}
+
+	s.Feed(output)
+	return s.Serve(context.Background(), ln)
+}
+
+// Feed streams the frames read from output instead of capturing them, e.g.
+// those returned by Start or generated ones. Call it before Serve. The
+// server can not change the resolution of fed frames, see FeedScaled.
+func (s *Server) Feed(output <-chan *Frame) {
+	s.sem.Lock()
+	s.run.fed = true
+	s.sem.Unlock()
+	go s.encode(output)
+}
+
+// FeedScaled is Feed for frames the server may scale down to one of sizes,
+// the resolution then adapts to the throughput like it does for a camera.
+// Sizes outside the configured minimum and maximum resolution are ignored.
+func (s *Server) FeedScaled(output <-chan *Frame, sizes []image.Point) error {
+	s.sem.Lock()
+	resolutions := make([]Resolution, 0, len(sizes))
+	for _, size := range sizes {
+		res := size.X * size.Y
+		if res < s.quality.MinResolution || res > s.quality.MaxResolution {
+			continue
+		}
+		resolutions = append(resolutions, Resolution{uint32(size.X), uint32(size.Y)})
+	}
+
+	if len(resolutions) == 0 {
+		s.sem.Unlock()
+		return errors.New("No resolutions found, try adjusting the min/max requirments")
+	}
+
+	sort.Slice(resolutions, func(i, j int) bool {
+		return resolutions[i].Resolution() < resolutions[j].Resolution()
+	})
+
+	s.cam.resolutions = resolutions
+	s.cam.activeRes = len(resolutions) - 1
+	s.run.fed, s.run.scaled = true, true
+	s.sem.Unlock()
+	go s.encode(output)
+	return nil
+}
+
+// encode reencodes frames at the current quality and makes them available
+// to sessions until output is closed.
+func (s *Server) encode(output <-chan *Frame) {
+	var seq uint64
+	for d := range output {
+		s.sem.Lock()
+		quality, fps := s.jpegOpts.Quality, s.fps
+		var size image.Point
+		if s.run.scaled {
+			res := s.cam.resolutions[s.cam.activeRes]
+			size = image.Pt(int(res.width), int(res.height))
+		}
+		s.sem.Unlock()
+
+		var bounds image.Rectangle
+		if quality < 100 || size != (image.Point{}) {
+			i, err := jpeg.Decode(d)
+			if err != nil {
+				s.l.Println(err)
+				continue
+			}
+			if size != (image.Point{}) && i.Bounds().Size() != size {
+				scaled := image.NewRGBA(image.Rectangle{Max: size})
+				draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), i, i.Bounds(), draw.Src, nil)
+				i = scaled
+			}
+			d.Reset()
+			if err := jpeg.Encode(d, i, &jpeg.Options{Quality: quality}); err != nil {
+				s.l.Println(err)
+				continue
+			}
+			bounds = i.Bounds()
+		} else {
+			c, err := jpeg.DecodeConfig(bytes.NewReader(d.Bytes()))
+			if err != nil {
+				s.l.Println(err)
+				continue
+			}
+			bounds = image.Rect(0, 0, c.Width, c.Height)
+		}
+
+		seq++
+		f := &frame{
+			data: d.Bytes(),
+			meta: protocol.FrameMeta{
+				Sequence: seq,
+				Captured: d.Captured.UnixNano(),
+				Width:    uint32(bounds.Dx()),
+				Height:   uint32(bounds.Dy()),
+				Quality:  uint8(quality),
+				FPS:      uint8(fps),
+			},
+		}
+
+		s.sem.Lock()
+		s.net.frame = f
+		s.sem.Unlock()
+	}
+}
+
+// Serve accepts connections on ln until ctx is done or Shutdown is called,
+// ln is wrapped in TLS if configured. Capturing is started unless Start or
+// Feed was called before.
+// Sessions outlive ctx, only Shutdown ends them.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	if s.net.tls != nil {
+		ln = tls.NewListener(ln, s.net.tls)
+	}
+
+	s.sem.Lock()
+	if s.run.closed {
+		s.sem.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.run.listeners[ln] = struct{}{}
+	if !s.run.started && !s.run.fed {
+		go s.encode(s.start())
+	}
+	s.sem.Unlock()
+	defer func() {
+		s.sem.Lock()
+		delete(s.run.listeners, ln)
+		s.sem.Unlock()
+		ln.Close()
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.sem.Lock()
+			closed := s.run.closed
+			s.sem.Unlock()
+			switch {
+			case closed:
+				return ErrServerClosed
+			case ctx.Err() != nil:
+				return ctx.Err()
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay *= 2; delay == 0 {
+					delay = time.Millisecond * 5
+				} else if delay > time.Second {
+					delay = time.Second
+				}
+				s.l.Printf("Accept failed: %s, retrying in %s", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		s.sem.Lock()
+		connACL := s.access.conn
+		s.sem.Unlock()
+		if !connACL.Allowed(conn.RemoteAddr()) {
+			s.reject(conn.RemoteAddr(), "connection")
+			s.audit(audit.Entry{
+				Time:    time.Now(),
+				Remote:  conn.RemoteAddr().String(),
+				Outcome: audit.OutcomeRejected,
+				Reason:  "connection refused by ACL",
+			})
+			conn.Close()
+			continue
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrack(conn)
+			s.conn(conn)
+		}()
+	}
+}
+
+// track registers a session so Shutdown can wait for it, it returns false
+// if the server is shutting down.
+func (s *Server) track(c net.Conn) bool {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if s.run.closed {
+		return false
+	}
+	s.run.conns[c] = struct{}{}
+	s.run.sessions.Add(1)
+	return true
+}
+
+func (s *Server) untrack(c net.Conn) {
+	s.sem.Lock()
+	delete(s.run.conns, c)
+	s.sem.Unlock()
+	s.run.sessions.Done()
+}
+
+// Shutdown stops accepting connections and capturing, tells clients the
+// server is going away, waits for their sessions to end and closes the
+// camera. If ctx is done first the remaining connections are closed and
+// ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.sem.Lock()
+	if s.run.closed {
+		s.sem.Unlock()
+		return ErrServerClosed
+	}
+	s.run.closed = true
+	close(s.run.stop)
+	for ln := range s.run.listeners {
+		ln.Close()
+	}
+	started := s.run.started
+	s.sem.Unlock()
+
+	captured := !started
+	if started {
+		select {
+		case <-s.run.captured:
+			captured = true
+		case <-ctx.Done():
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.run.sessions.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.sem.Lock()
+		for c := range s.run.conns {
+			c.Close()
+		}
+		s.sem.Unlock()
+	}
+
+	if captured && s.cam.cam != nil {
+		if cerr := s.cam.cam.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Frame is a single jpeg encoded frame as read from the camera.
+type Frame struct {
+	*bytes.Buffer
+	Captured time.Time
+}
+
+// Start starts capturing. Frames are sent on the first channel, camera
+// errors on the second which is buffered and drops errors nobody reads.
+// Both are closed once Shutdown stopped capturing. Calling Start again
+// returns the same channels.
+func (s *Server) Start() (<-chan *Frame, <-chan error) {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if !s.run.started {
+		s.start()
+	}
+	return s.run.output, s.run.errs
+}
+
+// start must be called with s.sem held.
+func (s *Server) start() <-chan *Frame {
+	s.run.started = true
+	s.run.output = make(chan *Frame, 1)
+	if s.run.closed {
+		close(s.run.output)
+		close(s.run.errs)
+		close(s.run.captured)
+		return s.run.output
+	}
+
+	go s.capture()
+	return s.run.output
+}
+
+func (s *Server) capture() {
+	defer func() {
+		close(s.run.output)
+		close(s.run.errs)
+		close(s.run.captured)
+	}()
+
+	var last time.Time
+	s.cam.reinit = true
+	for {
+		select {
+		case <-s.run.stop:
+			return
+		default:
+		}
+
+		if s.cam.reinit {
+			s.cam.reinit = false
+			if !s.initCam() {
+				return
+			}
+		}
+
+		err := s.cam.cam.WaitForFrame(1)
+		switch err.(type) {
+		case nil:
+		case *webcam.Timeout:
+			continue
+		default:
+			s.l.Printf("Failed waiting for cam frame: %s", err)
+			s.report(fmt.Errorf("Failed waiting for cam frame: %s", err))
+			s.cam.reinit = true
+			continue
+		}
+
+		if time.Since(last) < time.Second/time.Duration(s.fps) {
+			s.cam.cam.ReadFrame()
+			continue
+		}
+
+		_d, err := s.cam.cam.ReadFrame()
+		if err != nil {
+			s.l.Printf("Failed reading cam frame: %s", err)
+			s.report(fmt.Errorf("Failed reading cam frame: %s", err))
+			s.cam.reinit = true
+			continue
+		}
+		d := make([]byte, len(_d))
+		copy(d, _d)
+
+		last = time.Now()
+		select {
+		case s.run.output <- &Frame{Buffer: bytes.NewBuffer(d), Captured: last}:
+		case <-s.run.stop:
+			return
+		}
+	}
 }
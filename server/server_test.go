@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/frizinak/inbetween-go-homecam/device"
+	"github.com/frizinak/inbetween-go-homecam/protocol"
+	"github.com/frizinak/inbetween-go-homecam/totp"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{}
+	s.totp.secret = secret
+
+	now := time.Now()
+	current, _ := totp.Code(secret, now)
+	previous, _ := totp.Code(secret, now.Add(-totp.Period))
+	if previous == current {
+		t.Skip("consecutive time steps share a code")
+	}
+
+	check := func(code string, wantOK, wantReused bool) {
+		t.Helper()
+		ok, reused, err := s.verifyTOTP("host 192.0.2.1", code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != wantOK || reused != wantReused {
+			t.Errorf("%s: ok %t reused %t, want %t %t", code, ok, reused, wantOK, wantReused)
+		}
+	}
+
+	check(current, true, false)
+	check(current, false, true)
+	// An older code within the skew that was never used is still valid.
+	check(previous, true, false)
+	check(previous, false, true)
+	if len(s.totp.failures) != 0 {
+		t.Errorf("reused codes counted as failures: %+v", s.totp.failures)
+	}
+
+	for i := 0; i < totpMaxFailures; i++ {
+		check("000000x", false, false)
+	}
+	if _, _, err := s.verifyTOTP("host 192.0.2.1", current); err == nil {
+		t.Error("no lockout after too many failures")
+	}
+	if _, _, err := s.verifyTOTP("host 192.0.2.2", current); err != nil {
+		t.Errorf("failures of one host locked out another: %s", err)
+	}
+
+	s.totp.failures["host 192.0.2.1"].last = now.Add(-totpLockout)
+	if _, _, err := s.verifyTOTP("host 192.0.2.1", "000000x"); err != nil {
+		t.Errorf("still locked out after %s: %s", totpLockout, err)
+	}
+}
+
+func TestTOTPKey(t *testing.T) {
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	b := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5678}
+	if totpKey(a, nil) != totpKey(b, nil) {
+		t.Error("connections from one host have different keys")
+	}
+
+	dev := &device.Device{Name: "phone", PublicKey: make([]byte, 32)}
+	if totpKey(a, dev) == totpKey(a, nil) {
+		t.Error("a device shares its key with its host")
+	}
+}
+
+type testStore struct{ enrolled []device.Device }
+
+func (t *testStore) Enroll(name string, pub []byte) (device.Device, error) {
+	d := device.Device{Name: name, PublicKey: pub}
+	t.enrolled = append(t.enrolled, d)
+	return d, nil
+}
+func (t *testStore) Revoke(string) (device.Device, error) { return device.Device{}, device.ErrNotFound }
+func (t *testStore) List() ([]device.Device, error)       { return t.enrolled, nil }
+func (t *testStore) Lookup([]byte) (device.Device, error) { return device.Device{}, device.ErrNotFound }
+
+type testPairing struct{ token string }
+
+func (t *testPairing) Token() (string, error) { return t.token, nil }
+func (t *testPairing) Consume(token string) error {
+	if token != t.token {
+		return errors.New("Pairing token already used")
+	}
+	t.token = ""
+	return nil
+}
+
+func TestPairingControl(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, pairing := &testStore{}, &testPairing{"token"}
+	s := NewServer(Options{Devices: store, Key: key, Pairing: pairing})
+
+	control := func(cmd string, args ...string) (protocol.ControlReply, bool) {
+		t.Helper()
+		d, _ := json.Marshal(protocol.Control{Command: cmd, Args: args})
+		out, enrolled, err := s.control(d, "pairing", "token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r protocol.ControlReply
+		if err := json.Unmarshal(out, &r); err != nil {
+			t.Fatal(err)
+		}
+		return r, enrolled
+	}
+
+	pub := base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+	for _, cmd := range [][]string{{"status"}, {"devices"}, {"revoke", "phone"}, {"audit"}, {"enroll", "phone"}, {"enroll", "phone", "c2hvcnQ="}} {
+		if r, enrolled := control(cmd[0], cmd[1:]...); r.Error == "" || enrolled {
+			t.Errorf("%v: allowed on a pairing session", cmd)
+		}
+	}
+	if pairing.token == "" || len(store.enrolled) != 0 {
+		t.Fatal("rejected commands consumed the token or enrolled a device")
+	}
+
+	r, enrolled := control("enroll", "phone", pub)
+	if r.Error != "" || !enrolled {
+		t.Fatalf("enroll: %s", r.Error)
+	}
+	if pairing.token != "" || len(store.enrolled) != 1 {
+		t.Error("enrolling did not consume the token")
+	}
+	var e protocol.Enrollment
+	if err := json.Unmarshal(r.Body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Verify(make([]byte, ed25519.PublicKeySize)); err != nil {
+		t.Error(err)
+	}
+
+	if r, enrolled := control("enroll", "tablet", pub); r.Error == "" || enrolled {
+		t.Error("enrolled twice with one token")
+	}
+}
+
+func TestFeedScaled(t *testing.T) {
+	s := NewServer(Options{})
+	if err := s.FeedScaled(nil, []image.Point{{100, 100}}); err == nil {
+		t.Fatal("fed without a resolution within the limits")
+	}
+
+	frames := make(chan *Frame)
+	defer close(frames)
+	sizes := []image.Point{{800, 600}, {320, 240}, {640, 480}, {4000, 3000}}
+	if err := s.FeedScaled(frames, sizes); err != nil {
+		t.Fatal(err)
+	}
+
+	feed := func(res int) (int, int) {
+		s.sem.Lock()
+		s.cam.activeRes, s.net.frame = res, nil
+		s.sem.Unlock()
+
+		b := bytes.NewBuffer(nil)
+		if err := jpeg.Encode(b, image.NewGray(image.Rect(0, 0, 1024, 768)), nil); err != nil {
+			t.Fatal(err)
+		}
+		frames <- &Frame{Buffer: b, Captured: time.Now()}
+		for i := 0; i < 100; i++ {
+			if st := s.Status(); st.Width != 0 {
+				return st.Width, st.Height
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatal("frame was not encoded")
+		return 0, 0
+	}
+
+	if w, h := feed(1); w != 800 || h != 600 {
+		t.Errorf("got %dx%d, want 800x600", w, h)
+	}
+	if w, h := feed(0); w != 640 || h != 480 {
+		t.Errorf("got %dx%d, want 640x480", w, h)
+	}
+}
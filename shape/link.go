@@ -0,0 +1,130 @@
+package shape
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Presets are typical links, loss shows up as stalls since TCP retransmits.
+var Presets = map[string]Link{
+	"lan": {},
+	"rtt200": {
+		Latency: time.Millisecond * 100,
+	},
+	"wifi": {
+		Bandwidth: 2500 * 1024,
+		Latency:   time.Millisecond * 3,
+		Jitter:    time.Millisecond * 10,
+	},
+	"lossy-wifi": {
+		Bandwidth:  600 * 1024,
+		Latency:    time.Millisecond * 5,
+		Jitter:     time.Millisecond * 40,
+		StallEvery: time.Second * 4,
+		StallFor:   time.Millisecond * 600,
+	},
+	"3g": {
+		Bandwidth:  90 * 1024,
+		Latency:    time.Millisecond * 100,
+		Jitter:     time.Millisecond * 50,
+		StallEvery: time.Second * 20,
+		StallFor:   time.Second,
+	},
+	"edge": {
+		Bandwidth: 25 * 1024,
+		Latency:   time.Millisecond * 250,
+		Jitter:    time.Millisecond * 100,
+	},
+}
+
+// PresetNames returns the names of the presets in alphabetical order.
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for n := range Presets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseLink parses a preset name optionally followed by overrides or only
+// overrides, separated by commas, e.g. "3g,latency=300ms" or
+// "bandwidth=64k,stall=10s/2s". Bandwidth is in bytes per second with an
+// optional k or m suffix.
+func ParseLink(s string) (Link, error) {
+	var l Link
+	for i, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			p, ok := Presets[f]
+			if !ok || i != 0 {
+				return l, fmt.Errorf("Unknown link '%s', use one of %s or key=value", f, strings.Join(PresetNames(), ", "))
+			}
+			l = p
+			continue
+		}
+
+		var err error
+		switch k, v := kv[0], kv[1]; k {
+		case "bandwidth":
+			l.Bandwidth, err = parseBytes(v)
+		case "latency":
+			l.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			l.Jitter, err = time.ParseDuration(v)
+		case "stall":
+			parts := strings.SplitN(v, "/", 2)
+			if len(parts) != 2 {
+				return l, fmt.Errorf("Stall must be every/duration, e.g. 10s/500ms, got '%s'", v)
+			}
+			if l.StallEvery, err = time.ParseDuration(parts[0]); err == nil {
+				l.StallFor, err = time.ParseDuration(parts[1])
+			}
+		default:
+			return l, fmt.Errorf("Unknown link setting '%s'", k)
+		}
+		if err != nil {
+			return l, fmt.Errorf("Invalid %s: %s", kv[0], err)
+		}
+	}
+
+	return l, nil
+}
+
+func parseBytes(s string) (int, error) {
+	mul := 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mul, s = 1024, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		mul, s = 1024*1024, strings.TrimSuffix(s, "m")
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	return int(n * float64(mul)), err
+}
+
+func (l Link) String() string {
+	if l == (Link{}) {
+		return "unshaped"
+	}
+
+	var parts []string
+	if l.Bandwidth > 0 {
+		parts = append(parts, fmt.Sprintf("%.0fKiB/s", float64(l.Bandwidth)/1024))
+	}
+	if l.Latency > 0 {
+		parts = append(parts, "latency "+l.Latency.String())
+	}
+	if l.Jitter > 0 {
+		parts = append(parts, "jitter "+l.Jitter.String())
+	}
+	if l.StallEvery > 0 {
+		parts = append(parts, fmt.Sprintf("stall %s/%s", l.StallEvery, l.StallFor))
+	}
+	return strings.Join(parts, " ")
+}
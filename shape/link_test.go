@@ -0,0 +1,68 @@
+package shape
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLink(t *testing.T) {
+	threeG := Presets["3g"]
+	threeG.Latency = time.Millisecond * 300
+
+	tests := []struct {
+		in   string
+		want Link
+	}{
+		{"lan", Link{}},
+		{"edge", Presets["edge"]},
+		{"3g,latency=300ms", threeG},
+		{" 3g , latency=300ms ", threeG},
+		{"bandwidth=64k,stall=10s/2s", Link{Bandwidth: 64 * 1024, StallEvery: time.Second * 10, StallFor: time.Second * 2}},
+		{"bandwidth=1.5m", Link{Bandwidth: 1536 * 1024}},
+		{"bandwidth=100", Link{Bandwidth: 100}},
+		{"wifi,jitter=0s,bandwidth=1k", Link{Bandwidth: 1024, Latency: Presets["wifi"].Latency}},
+	}
+
+	for _, test := range tests {
+		l, err := ParseLink(test.in)
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+			continue
+		}
+		if l != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.in, l, test.want)
+		}
+	}
+}
+
+func TestParseLinkInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"5g",
+		"latency=100ms,3g",
+		"latency=fast",
+		"bandwidth=lots",
+		"stall=10s",
+		"stall=10s/x",
+		"loss=1%",
+	} {
+		if l, err := ParseLink(s); err == nil {
+			t.Errorf("%s: no error, got %+v", s, l)
+		}
+	}
+}
+
+func TestPresetNames(t *testing.T) {
+	names := PresetNames()
+	if len(names) != len(Presets) {
+		t.Fatalf("got %d names for %d presets", len(names), len(Presets))
+	}
+	for i := range names {
+		if _, ok := Presets[names[i]]; !ok {
+			t.Errorf("unknown preset %s", names[i])
+		}
+		if i > 0 && names[i-1] >= names[i] {
+			t.Errorf("%s sorted before %s", names[i-1], names[i])
+		}
+	}
+}
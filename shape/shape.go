@@ -0,0 +1,387 @@
+// Package shape slows connections down to simulate worse networks on a
+// single machine.
+package shape
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Link describes the network to simulate, the zero value does not shape
+// anything. Every field applies to each direction separately.
+type Link struct {
+	// Bandwidth in bytes per second, 0 for unlimited.
+	Bandwidth int
+	// Latency is added in each direction, the round trip grows by twice
+	// this.
+	Latency time.Duration
+	// Jitter is the maximum random latency added on top of Latency. Data is
+	// never reordered.
+	Jitter time.Duration
+	// StallEvery is the average time between stalls during which nothing
+	// is delivered for StallFor, like Wi-Fi retransmitting or a cell
+	// handover.
+	StallEvery time.Duration
+	StallFor   time.Duration
+}
+
+// queueLen is the number of chunks buffered in each direction, a chunk is
+// at most 1/20th of a second of data.
+const queueLen = 8
+
+var (
+	errTimeout net.Error = timeoutError{}
+	errClosed            = errors.New("use of closed network connection")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type chunk struct {
+	data []byte
+	at   time.Time
+	err  error
+}
+
+// Conn is a net.Conn shaped according to its Link. Deadlines are handled by
+// Conn itself as data is read from and written to the underlying
+// connection in the background.
+type Conn struct {
+	net.Conn
+
+	in, out *line
+	inq     chan chunk
+	outq    chan chunk
+	pending chunk
+
+	sem           sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	writeErr      error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// New wraps c. The receive buffer of a TCP connection is shrunk when
+// bandwidth is limited, as loopback buffers would otherwise absorb far
+// more than a real link keeps in flight.
+func New(c net.Conn, l Link) *Conn {
+	if t, ok := c.(*net.TCPConn); ok && l.Bandwidth > 0 {
+		n := l.Bandwidth / 10
+		if n < 4096 {
+			n = 4096
+		}
+		t.SetReadBuffer(n)
+	}
+
+	s := &Conn{
+		Conn:   c,
+		in:     newLine(l),
+		out:    newLine(l),
+		inq:    make(chan chunk, queueLen),
+		outq:   make(chan chunk, queueLen),
+		closed: make(chan struct{}),
+	}
+	go s.receive()
+	go s.send()
+	return s
+}
+
+// Dialer returns a dial func for client.Options that shapes every
+// connection according to l.
+func Dialer(l Link) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return New(c, l), nil
+	}
+}
+
+// SetLink changes the simulated network, data already in flight keeps its
+// schedule.
+func (c *Conn) SetLink(l Link) {
+	c.in.set(l)
+	c.out.set(l)
+}
+
+func (c *Conn) receive() {
+	for {
+		buf := make([]byte, c.in.chunkSize())
+		n, err := c.Conn.Read(buf)
+		ch := chunk{data: buf[:n], err: err}
+		ch.at = c.in.schedule(n, time.Now())
+		select {
+		case c.inq <- ch:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Conn) send() {
+	for {
+		var ch chunk
+		select {
+		case ch = <-c.outq:
+		case <-c.closed:
+			return
+		}
+
+		if c.wait(ch.at, time.Time{}) != nil {
+			return
+		}
+		if _, err := c.Conn.Write(ch.data); err != nil {
+			c.sem.Lock()
+			c.writeErr = err
+			c.sem.Unlock()
+			return
+		}
+	}
+}
+
+// wait sleeps until t, it fails early if the deadline passes or the
+// connection is closed.
+func (c *Conn) wait(t, deadline time.Time) error {
+	if !deadline.IsZero() && deadline.Before(t) {
+		t = deadline
+	}
+
+	d := time.Until(t)
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			return errClosed
+		}
+	}
+
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return errTimeout
+	}
+	return nil
+}
+
+// next receives the next chunk, giving up at deadline.
+func (c *Conn) next(deadline time.Time) (chunk, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return chunk{}, errTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case ch := <-c.inq:
+		return ch, nil
+	case <-timeout:
+		return chunk{}, errTimeout
+	case <-c.closed:
+		return chunk{}, errClosed
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.sem.Lock()
+	deadline := c.readDeadline
+	c.sem.Unlock()
+
+	if len(c.pending.data) == 0 && c.pending.err == nil {
+		ch, err := c.next(deadline)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = ch
+	}
+	if err := c.wait(c.pending.at, deadline); err != nil {
+		return 0, err
+	}
+
+	n := copy(p, c.pending.data)
+	c.pending.data = c.pending.data[n:]
+	if n == 0 && c.pending.err != nil {
+		return 0, c.pending.err
+	}
+	return n, nil
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) != 0 {
+		c.sem.Lock()
+		deadline, err := c.writeDeadline, c.writeErr
+		c.sem.Unlock()
+		if err != nil {
+			return written, err
+		}
+
+		n := c.out.chunkSize()
+		if n > len(p) {
+			n = len(p)
+		}
+		ch := chunk{data: append([]byte{}, p[:n]...)}
+		ch.at = c.out.schedule(n, time.Now())
+		if err := c.enqueue(ch, deadline); err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *Conn) enqueue(ch chunk, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case c.outq <- ch:
+		return nil
+	case <-timeout:
+		return errTimeout
+	case <-c.closed:
+		return errClosed
+	}
+}
+
+func (c *Conn) Close() error {
+	err := errClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.sem.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.sem.Unlock()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.sem.Lock()
+	c.readDeadline = t
+	c.sem.Unlock()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.sem.Lock()
+	c.writeDeadline = t
+	c.sem.Unlock()
+	return nil
+}
+
+// line schedules when data sent in one direction arrives.
+type line struct {
+	sem  sync.Mutex
+	link Link
+	rnd  *rand.Rand
+	// free is when the previous chunk finished transmitting.
+	free time.Time
+	// last is when the previous chunk arrives, later chunks never arrive
+	// before it.
+	last  time.Time
+	stall time.Time
+}
+
+func newLine(l Link) *line {
+	n := &line{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	n.set(l)
+	return n
+}
+
+func (l *line) set(link Link) {
+	l.sem.Lock()
+	defer l.sem.Unlock()
+	l.link = link
+	l.stall = time.Time{}
+	if link.StallEvery > 0 {
+		l.stall = time.Now().Add(l.between())
+	}
+}
+
+// between must be called with l.sem held.
+func (l *line) between() time.Duration {
+	return l.link.StallEvery/2 + time.Duration(l.rnd.Int63n(int64(l.link.StallEvery)+1))
+}
+
+// chunkSize is the largest amount of data scheduled at once, so a slow link
+// spreads data out instead of delivering it in bursts.
+func (l *line) chunkSize() int {
+	l.sem.Lock()
+	defer l.sem.Unlock()
+	n := 32 * 1024
+	if l.link.Bandwidth > 0 {
+		if n = l.link.Bandwidth / 20; n < 512 {
+			n = 512
+		} else if n > 32*1024 {
+			n = 32 * 1024
+		}
+	}
+	return n
+}
+
+// schedule returns when n bytes sent at now arrive.
+func (l *line) schedule(n int, now time.Time) time.Time {
+	l.sem.Lock()
+	defer l.sem.Unlock()
+
+	start := now
+	if l.free.After(start) {
+		start = l.free
+	}
+	if l.link.Bandwidth > 0 {
+		start = start.Add(time.Duration(float64(n) / float64(l.link.Bandwidth) * float64(time.Second)))
+	}
+	l.free = start
+
+	at := start.Add(l.link.Latency)
+	if l.link.Jitter > 0 {
+		at = at.Add(time.Duration(l.rnd.Int63n(int64(l.link.Jitter) + 1)))
+	}
+
+	for l.link.StallEvery > 0 && !at.Before(l.stall) {
+		end := l.stall.Add(l.link.StallFor)
+		if at.Before(end) {
+			at = end
+		}
+		l.stall = end.Add(l.between())
+	}
+
+	if at.Before(l.last) {
+		at = l.last
+	}
+	l.last = at
+	return at
+}
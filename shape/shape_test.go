@@ -0,0 +1,240 @@
+package shape
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// pair returns a shaped client connection and the unshaped server side of
+// a loopback TCP connection, the caller closes both.
+func pair(t *testing.T, l Link) (*Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(c, l), <-accepted
+}
+
+func within(t *testing.T, what string, d, min, max time.Duration) {
+	t.Helper()
+	if d < min || d > max {
+		t.Errorf("%s took %s, want %s-%s", what, d, min, max)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	const latency = time.Millisecond * 100
+	c, server := pair(t, Link{Latency: latency})
+	defer c.Close()
+	defer server.Close()
+	buf := make([]byte, 5)
+
+	start := time.Now()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	within(t, "write", time.Since(start), latency, latency*2)
+
+	start = time.Now()
+	if _, err := server.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	within(t, "read", time.Since(start), latency, latency*2)
+	if string(buf) != "world" {
+		t.Errorf("read %q", buf)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	const bandwidth = 200 * 1024
+	const size = bandwidth / 2
+	expect := time.Second * size / bandwidth
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+
+	c, server := pair(t, Link{Bandwidth: bandwidth})
+	defer c.Close()
+	defer server.Close()
+
+	start := time.Now()
+	go c.Write(data)
+	got, err := ioutil.ReadAll(io.LimitReader(server, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	within(t, "upload", time.Since(start), expect*9/10, expect*3/2)
+	if !bytes.Equal(got, data) {
+		t.Error("upload corrupted")
+	}
+
+	start = time.Now()
+	go server.Write(data)
+	got, err = ioutil.ReadAll(io.LimitReader(c, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	within(t, "download", time.Since(start), expect*9/10, expect*3/2)
+	if !bytes.Equal(got, data) {
+		t.Error("download corrupted")
+	}
+}
+
+func timeout(t *testing.T, err error) {
+	t.Helper()
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	c, server := pair(t, Link{Latency: time.Millisecond * 300})
+	defer c.Close()
+	defer server.Close()
+	buf := make([]byte, 5)
+
+	c.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	start := time.Now()
+	_, err := c.Read(buf)
+	timeout(t, err)
+	within(t, "read without data", time.Since(start), time.Millisecond*50, time.Millisecond*150)
+
+	// Data that is in flight past the deadline times out but is not lost.
+	if _, err := server.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err = c.Read(buf)
+	timeout(t, err)
+
+	c.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q after a timeout", buf)
+	}
+
+	c.SetDeadline(time.Now().Add(-time.Second))
+	_, err = c.Read(buf)
+	timeout(t, err)
+}
+
+func TestWriteDeadline(t *testing.T) {
+	c, server := pair(t, Link{Bandwidth: 1024})
+	defer c.Close()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	c.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+	start := time.Now()
+	data := make([]byte, 64*1024)
+	n, err := c.Write(data)
+	timeout(t, err)
+	within(t, "write", time.Since(start), time.Millisecond*100, time.Millisecond*200)
+	if n == 0 || n >= len(data) {
+		t.Errorf("wrote %dB of %dB before the deadline", n, len(data))
+	}
+
+	c.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := c.Write([]byte{1}); err == nil {
+		t.Error("write after the deadline")
+	}
+}
+
+func TestClose(t *testing.T) {
+	c, server := pair(t, Link{Latency: time.Second})
+	defer c.Close()
+	defer server.Close()
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	time.Sleep(time.Millisecond * 20)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Error("read on a closed connection")
+		}
+	case <-time.After(time.Second / 2):
+		t.Error("Close did not unblock Read")
+	}
+
+	if err := c.Close(); err == nil {
+		t.Error("second Close did not fail")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	now := time.Now()
+	l := newLine(Link{Bandwidth: 1000, Latency: time.Millisecond * 10})
+	if at := l.schedule(500, now); at.Sub(now) != time.Millisecond*510 {
+		t.Errorf("first chunk arrives after %s", at.Sub(now))
+	}
+	// The link is busy with the first chunk until +500ms.
+	if at := l.schedule(500, now); at.Sub(now) != time.Millisecond*1010 {
+		t.Errorf("second chunk arrives after %s", at.Sub(now))
+	}
+
+	l = newLine(Link{Latency: time.Millisecond * 150, StallEvery: time.Hour, StallFor: time.Second})
+	l.stall = now.Add(time.Millisecond * 100)
+	if at := l.schedule(1, now); at.Sub(now) != time.Millisecond*1100 {
+		t.Errorf("chunk during a stall arrives after %s", at.Sub(now))
+	}
+	if !l.stall.After(now.Add(time.Minute * 30)) {
+		t.Errorf("next stall at %s", l.stall.Sub(now))
+	}
+
+	l = newLine(Link{Latency: time.Millisecond, Jitter: time.Second})
+	var last time.Time
+	for i := 0; i < 1000; i++ {
+		at := l.schedule(1, now.Add(time.Duration(i)*time.Microsecond))
+		if at.Before(last) {
+			t.Fatalf("chunk %d reordered", i)
+		}
+		last = at
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	tests := []struct{ bandwidth, want int }{
+		{0, 32 * 1024},
+		{1000, 512},
+		{200 * 1024, 10 * 1024},
+		{100 * 1024 * 1024, 32 * 1024},
+	}
+	for _, test := range tests {
+		if n := newLine(Link{Bandwidth: test.bandwidth}).chunkSize(); n != test.want {
+			t.Errorf("%dB/s: chunk of %dB, want %dB", test.bandwidth, n, test.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// secret is the RFC 6238 SHA1 test key "12345678901234567890".
+const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// vectors are the RFC 6238 appendix B SHA1 values truncated to 6 digits.
+var vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, v := range vectors {
+		c, err := Code(secret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != v.code {
+			t.Errorf("%d: got %s, want %s", v.unix, c, v.code)
+		}
+	}
+
+	c, err := Code(strings.ToLower(secret[:16])+" "+secret[16:], time.Unix(59, 0))
+	if err != nil || c != "287082" {
+		t.Errorf("lowercase spaced secret: got %s, %v", c, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, v := range vectors {
+		at := time.Unix(v.unix, 0)
+		counter, ok, err := Verify(secret, v.code, at, 0)
+		if err != nil || !ok || counter != Counter(at) {
+			t.Errorf("%d: got %d, %t, %v", v.unix, counter, ok, err)
+		}
+
+		next := at.Add(Period)
+		if _, ok, _ := Verify(secret, v.code, next, 0); ok {
+			t.Errorf("%d: accepted a code of the previous step without skew", v.unix)
+		}
+		if counter2, ok, _ := Verify(secret, v.code, next, 1); !ok || counter2 != counter {
+			t.Errorf("%d: rejected a code of the previous step with skew", v.unix)
+		}
+		if _, ok, _ := Verify(secret, v.code, at.Add(2*Period), 1); ok {
+			t.Errorf("%d: accepted a code two steps old with a skew of 1", v.unix)
+		}
+	}
+
+	if _, ok, err := Verify(secret, "28708", time.Unix(59, 0), 1); ok || err != nil {
+		t.Errorf("short code: got %t, %v", ok, err)
+	}
+	if _, _, err := Verify("not base32!", "287082", time.Unix(59, 0), 1); err == nil {
+		t.Error("invalid secret: no error")
+	}
+	if _, _, err := Verify("", "287082", time.Unix(59, 0), 1); err == nil {
+		t.Error("empty secret: no error")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	s, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := decode(s)
+	if err != nil || len(key) != 20 {
+		t.Errorf("got %d byte key, %v", len(key), err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI(secret, "home cam", "me")
+	want := "otpauth://totp/home%20cam:me?digits=6&issuer=home+cam&period=30&secret=" + secret
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
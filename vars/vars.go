@@ -1,5 +1,7 @@
 package vars
 
+import "time"
+
 var CommonSecret = []byte("HelloThereCamServer")
 
 const (
@@ -7,4 +9,10 @@ const (
 	HandshakeCost    = 15
 	HandshakeLen     = 128
 	HandshakeHashLen = 256
+	MaxFrameSize     = 8 << 20
+)
+
+const (
+	KeepaliveInterval = time.Second
+	KeepaliveTimeout  = time.Second * 5
 )
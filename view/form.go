@@ -0,0 +1,375 @@
+package view
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+
+	"golang.org/x/mobile/event/key"
+	"golang.org/x/mobile/event/size"
+	"golang.org/x/mobile/event/touch"
+	"golang.org/x/mobile/exp/gl/glutil"
+	"golang.org/x/mobile/geom"
+)
+
+type FieldKind int
+
+const (
+	FieldText FieldKind = iota
+	FieldSecret
+	FieldNumber
+	// FieldToggle holds "yes" or "no" and flips when tapped.
+	FieldToggle
+	// FieldButton submits the form when tapped.
+	FieldButton
+)
+
+const (
+	Yes = "yes"
+	No  = "no"
+)
+
+type Field struct {
+	Label string
+	Value string
+	Kind  FieldKind
+}
+
+func (f Field) text() bool { return f.Kind <= FieldNumber }
+
+// FormResult is sent when a button of the form is tapped.
+type FormResult struct {
+	Fields []Field
+	// Button is the index in Fields of the button that was tapped.
+	Button int
+}
+
+var keyboardLayouts = [][]string{
+	{"1234567890", "qwertyuiop", "asdfghjkl:", "zxcvbnm.-/"},
+	{"1234567890", "QWERTYUIOP", "ASDFGHJKL:", "ZXCVBNM,_?"},
+	{"!@#$%^&*()", "`~-_=+[]{}", "\\|;:'\"<>,.", "/?"},
+}
+
+const (
+	keyShift   = "Aa"
+	keySymbols = "#+"
+	keyLetters = "abc"
+	keySpace   = "space"
+	keyBack    = "<"
+	keyNext    = "OK"
+)
+
+type formKey struct {
+	label string
+	r     image.Rectangle
+}
+
+// form is an entry screen for text fields with an on-screen keyboard, used
+// for the first-run setup since no soft keyboard can be requested.
+type form struct {
+	active bool
+	fields []Field
+	focus  int
+	layout int
+	submit chan<- FormResult
+
+	writer *TextWriter
+	img    *glutil.Image
+	sz     size.Event
+	dirty  bool
+}
+
+// RequestForm shows fields and sends the result on submit once one of its
+// buttons is tapped.
+func (v *View) RequestForm(fields []Field, submit chan<- FormResult) {
+	f := make([]Field, len(fields))
+	copy(f, fields)
+	v.do(func() {
+		v.form.fields = f
+		v.form.submit = submit
+		v.form.layout = 0
+		v.form.focus = -1
+		v.form.next()
+		v.form.dirty = true
+		v.form.active = true
+	})
+}
+
+func (f *form) hasText() bool {
+	for i := range f.fields {
+		if f.fields[i].text() {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *form) layoutKeys() [][]string {
+	l := keyboardLayouts[f.layout]
+	rows := make([][]string, 0, len(l)+1)
+	for _, row := range l {
+		keys := make([]string, 0, len(row))
+		for _, r := range row {
+			keys = append(keys, string(r))
+		}
+		rows = append(rows, keys)
+	}
+
+	symbols := keySymbols
+	if f.layout == 2 {
+		symbols = keyLetters
+	}
+
+	return append(rows, []string{keyShift, symbols, keySpace, keyBack, keyNext})
+}
+
+func (f *form) layoutRects(sz size.Event) (rows []image.Rectangle, keys []formKey) {
+	w, h := sz.WidthPx, sz.HeightPx
+	top := h / 12
+	bottom := h
+	if f.hasText() {
+		bottom = h * 11 / 20
+	}
+
+	rowH := (bottom - top) / (len(f.fields) + 1)
+	if rowH > h/10 {
+		rowH = h / 10
+	}
+
+	rows = make([]image.Rectangle, len(f.fields))
+	for i := range f.fields {
+		y := top + i*rowH
+		rows[i] = image.Rect(0, y, w, y+rowH).Inset(rowH / 20)
+	}
+
+	if bottom == h {
+		return
+	}
+
+	layout := f.layoutKeys()
+	kh := (h - bottom) / len(layout)
+	for i, row := range layout {
+		kw := w / len(row)
+		y := bottom + i*kh
+		for j := range row {
+			keys = append(keys, formKey{row[j], image.Rect(j*kw, y, (j+1)*kw, y+kh).Inset(kh / 20)})
+		}
+	}
+
+	return
+}
+
+func (f *form) render(images *glutil.Images, sz size.Event) error {
+	if f.img != nil {
+		f.img.Release()
+	}
+
+	f.sz = sz
+	f.dirty = false
+	f.img = images.NewImage(sz.WidthPx, sz.HeightPx)
+	dst := f.img.RGBA
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.Gray{40}), image.Point{}, draw.Src)
+
+	rows, keys := f.layoutRects(sz)
+	f.writer.SetColor(color.Gray{255})
+	for i, r := range rows {
+		field := f.fields[i]
+		bg := color.Gray{60}
+		switch {
+		case field.Kind == FieldButton:
+			bg = color.Gray{100}
+		case i == f.focus:
+			bg = color.Gray{85}
+		}
+		draw.Draw(dst, r, image.NewUniform(bg), image.Point{}, draw.Src)
+
+		px := float64(r.Dy()) / 2
+		if field.Kind == FieldButton {
+			if err := centerText(f.writer, dst, r, field.Label, px); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value := field.Value
+		if field.Kind == FieldSecret {
+			value = strings.Repeat("*", len(value))
+		}
+		if i == f.focus {
+			value += "_"
+		}
+
+		pad := r.Dy() / 4
+		f.writer.SetFontSize(px, 72)
+		if _, err := f.writer.Write(dst, field.Label, image.Pt(r.Min.X+pad, r.Min.Y+pad)); err != nil {
+			return err
+		}
+
+		p, err := f.writer.Write(nil, value, image.Point{})
+		if err != nil {
+			return err
+		}
+		if _, err := f.writer.Write(dst, value, image.Pt(r.Max.X-pad-p.X, r.Min.Y+pad)); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range keys {
+		draw.Draw(dst, k.r, image.NewUniform(color.Gray{70}), image.Point{}, draw.Src)
+		if err := centerText(f.writer, dst, k.r, k.label, float64(k.r.Dy())/2); err != nil {
+			return err
+		}
+	}
+
+	f.img.Upload()
+	return nil
+}
+
+func (f *form) draw(images *glutil.Images, sz size.Event) error {
+	if f.img == nil || f.dirty || sz != f.sz {
+		if err := f.render(images, sz); err != nil {
+			return err
+		}
+	}
+
+	b := f.img.RGBA.Bounds()
+	f.img.Draw(
+		sz,
+		geom.Point{0, 0},
+		geom.Point{sz.WidthPt, 0},
+		geom.Point{0, sz.HeightPt},
+		b,
+	)
+
+	return nil
+}
+
+// next focuses the next text field, it returns false if there is none.
+func (f *form) next() bool {
+	for i := f.focus + 1; i < len(f.fields); i++ {
+		if f.fields[i].text() {
+			f.focus = i
+			return true
+		}
+	}
+	return false
+}
+
+func (f *form) submitButton(ix int) {
+	f.active = false
+	fields := make([]Field, len(f.fields))
+	copy(fields, f.fields)
+	go func() { f.submit <- FormResult{fields, ix} }()
+}
+
+// enter focuses the next text field or taps the first button.
+func (f *form) enter() {
+	if f.next() {
+		return
+	}
+
+	for i := range f.fields {
+		if f.fields[i].Kind == FieldButton {
+			f.submitButton(i)
+			return
+		}
+	}
+}
+
+func (f *form) input(s string) {
+	if f.focus < 0 {
+		return
+	}
+
+	field := &f.fields[f.focus]
+	if field.Kind == FieldNumber && (s < "0" || s > "9") {
+		return
+	}
+	field.Value += s
+}
+
+func (f *form) press(label string) {
+	switch label {
+	case keyShift:
+		f.layout = 1 - f.layout%2
+	case keySymbols:
+		f.layout = 2
+	case keyLetters:
+		f.layout = 0
+	case keySpace:
+		f.input(" ")
+	case keyBack:
+		if f.focus >= 0 {
+			v := f.fields[f.focus].Value
+			if len(v) > 0 {
+				f.fields[f.focus].Value = v[:len(v)-1]
+			}
+		}
+	case keyNext:
+		f.enter()
+	default:
+		f.input(label)
+	}
+
+	f.dirty = true
+}
+
+func (f *form) handleTouch(e touch.Event, sz size.Event) {
+	if e.Type != touch.TypeBegin || e.Sequence != 0 {
+		return
+	}
+
+	rows, keys := f.layoutRects(sz)
+	pt := image.Pt(int(e.X), int(e.Y))
+	for i := range rows {
+		if !pt.In(rows[i]) {
+			continue
+		}
+
+		switch f.fields[i].Kind {
+		case FieldButton:
+			f.submitButton(i)
+		case FieldToggle:
+			if f.fields[i].Value == Yes {
+				f.fields[i].Value = No
+			} else {
+				f.fields[i].Value = Yes
+			}
+		default:
+			f.focus = i
+		}
+		f.dirty = true
+		return
+	}
+
+	for _, k := range keys {
+		if pt.In(k.r) {
+			f.press(k.label)
+			return
+		}
+	}
+}
+
+func (f *form) handleKey(e key.Event) {
+	if e.Direction != key.DirPress {
+		return
+	}
+
+	switch {
+	case e.Code == key.CodeDeleteBackspace:
+		f.press(keyBack)
+	case e.Code == key.CodeReturnEnter || e.Code == key.CodeKeypadEnter || e.Code == key.CodeTab:
+		f.press(keyNext)
+	case e.Rune >= ' ' && e.Rune <= '~':
+		f.input(string(e.Rune))
+		f.dirty = true
+	}
+}
+
+func (f *form) release() {
+	if f.img != nil {
+		f.img.Release()
+		f.img = nil
+	}
+}
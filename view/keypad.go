@@ -0,0 +1,186 @@
+package view
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+
+	"golang.org/x/mobile/event/key"
+	"golang.org/x/mobile/event/size"
+	"golang.org/x/mobile/event/touch"
+	"golang.org/x/mobile/exp/gl/glutil"
+	"golang.org/x/mobile/geom"
+)
+
+var keypadKeys = []string{
+	"1", "2", "3",
+	"4", "5", "6",
+	"7", "8", "9",
+	"<", "0", "OK",
+}
+
+// keypad is a numeric entry screen, used for one-time passwords.
+type keypad struct {
+	active bool
+	digits int
+	code   []byte
+	codes  chan<- string
+
+	writer *TextWriter
+	img    *glutil.Image
+	sz     size.Event
+	dirty  bool
+}
+
+// RequestCode shows a numeric keypad and sends the entered code of
+// the given length on codes.
+func (v *View) RequestCode(digits int, codes chan<- string) {
+	v.do(func() {
+		v.keypad.active = true
+		v.keypad.digits = digits
+		v.keypad.code = make([]byte, 0, digits)
+		v.keypad.codes = codes
+		v.keypad.dirty = true
+	})
+}
+
+func (k *keypad) layout(sz size.Event) (display image.Rectangle, keys []image.Rectangle) {
+	w, h := sz.WidthPx, sz.HeightPx
+	top := h / 4
+	display = image.Rect(0, 0, w, top)
+
+	cw, ch := w/3, (h-top)/4
+	keys = make([]image.Rectangle, len(keypadKeys))
+	for i := range keypadKeys {
+		x, y := (i%3)*cw, top+(i/3)*ch
+		keys[i] = image.Rect(x, y, x+cw, y+ch).Inset(ch / 20)
+	}
+
+	return
+}
+
+func (k *keypad) render(images *glutil.Images, sz size.Event) error {
+	if k.img != nil {
+		k.img.Release()
+	}
+
+	k.sz = sz
+	k.dirty = false
+	k.img = images.NewImage(sz.WidthPx, sz.HeightPx)
+	dst := k.img.RGBA
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.Gray{40}), image.Point{}, draw.Src)
+
+	display, keys := k.layout(sz)
+	k.writer.SetColor(color.Gray{255})
+	code := string(k.code) + strings.Repeat("_", k.digits-len(k.code))
+	if err := k.center(dst, display, code, float64(display.Dy())/3); err != nil {
+		return err
+	}
+
+	for i := range keys {
+		draw.Draw(dst, keys[i], image.NewUniform(color.Gray{70}), image.Point{}, draw.Src)
+		if err := k.center(dst, keys[i], keypadKeys[i], float64(keys[i].Dy())/2); err != nil {
+			return err
+		}
+	}
+
+	k.img.Upload()
+	return nil
+}
+
+func (k *keypad) center(dst draw.Image, r image.Rectangle, text string, px float64) error {
+	return centerText(k.writer, dst, r, text, px)
+}
+
+// centerText writes text centered in r at the given pixel size.
+func centerText(w *TextWriter, dst draw.Image, r image.Rectangle, text string, px float64) error {
+	w.SetFontSize(px, 72)
+	p, err := w.Write(nil, text, image.Point{})
+	if err != nil {
+		return err
+	}
+
+	pt := r.Min.Add(r.Size().Sub(p).Div(2))
+	_, err = w.Write(dst, text, pt)
+	return err
+}
+
+func (k *keypad) draw(images *glutil.Images, sz size.Event) error {
+	if k.img == nil || k.dirty || sz != k.sz {
+		if err := k.render(images, sz); err != nil {
+			return err
+		}
+	}
+
+	b := k.img.RGBA.Bounds()
+	k.img.Draw(
+		sz,
+		geom.Point{0, 0},
+		geom.Point{sz.WidthPt, 0},
+		geom.Point{0, sz.HeightPt},
+		b,
+	)
+
+	return nil
+}
+
+func (k *keypad) press(label string) {
+	switch label {
+	case "<":
+		if len(k.code) > 0 {
+			k.code = k.code[:len(k.code)-1]
+		}
+	case "OK":
+		if len(k.code) != k.digits {
+			return
+		}
+		k.active = false
+		code := string(k.code)
+		k.code = k.code[:0]
+		go func() { k.codes <- code }()
+	default:
+		if len(k.code) < k.digits {
+			k.code = append(k.code, label[0])
+		}
+	}
+
+	k.dirty = true
+}
+
+func (k *keypad) handleTouch(e touch.Event, sz size.Event) {
+	if e.Type != touch.TypeBegin || e.Sequence != 0 {
+		return
+	}
+
+	_, keys := k.layout(sz)
+	pt := image.Pt(int(e.X), int(e.Y))
+	for i := range keys {
+		if pt.In(keys[i]) {
+			k.press(keypadKeys[i])
+			return
+		}
+	}
+}
+
+func (k *keypad) handleKey(e key.Event) {
+	if e.Direction != key.DirPress {
+		return
+	}
+
+	switch {
+	case e.Code == key.CodeDeleteBackspace:
+		k.press("<")
+	case e.Code == key.CodeReturnEnter || e.Code == key.CodeKeypadEnter:
+		k.press("OK")
+	case e.Rune >= '0' && e.Rune <= '9':
+		k.press(string(e.Rune))
+	}
+}
+
+func (k *keypad) release() {
+	if k.img != nil {
+		k.img.Release()
+		k.img = nil
+	}
+}
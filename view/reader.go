@@ -9,3 +9,12 @@ type Reader interface {
 	io.Reader
 	Created() time.Time
 }
+
+// StreamReader is a Reader that also knows about the stream its frame
+// belongs to.
+type StreamReader interface {
+	Reader
+	Received() time.Time
+	FPS() int
+	String() string
+}
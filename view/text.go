@@ -121,6 +121,15 @@ func (g *GlText) Write(text string) {
 
 }
 
+// Size returns the size in pixels of the last drawn text.
+func (g *GlText) Size() image.Point {
+	if g.frame == nil {
+		return image.Point{}
+	}
+
+	return g.frame.RGBA.Bounds().Size()
+}
+
 func (g *GlText) Clear() {
 	g.text = ""
 	if g.frame != nil {
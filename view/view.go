@@ -9,9 +9,11 @@ import (
 	"image/jpeg"
 	"image/png"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/frizinak/inbetween-go-homecam/bound"
+	"golang.org/x/mobile/event/key"
 	"golang.org/x/mobile/event/lifecycle"
 	"golang.org/x/mobile/event/paint"
 	"golang.org/x/mobile/event/size"
@@ -39,6 +41,14 @@ type View struct {
 		msg    string
 	}
 
+	details struct {
+		writer *GlText
+		msg    string
+	}
+
+	keypad keypad
+	form   form
+
 	auth struct {
 		passChan    chan<- []byte
 		pass        []byte
@@ -48,6 +58,7 @@ type View struct {
 		tap         time.Time
 		n           byte
 		fingersDown bool
+		skip        bool
 	}
 
 	framePos struct {
@@ -57,11 +68,21 @@ type View struct {
 		zoom         float64
 	}
 
-	bounds       image.Rectangle
-	frameCreated time.Time
+	bounds        image.Rectangle
+	frameReceived time.Time
+	frameStale    time.Duration
 
 	stopDecoder chan struct{}
 
+	// queue holds state changes requested from other goroutines, loop
+	// applies them before handling the next event. win is woken up once
+	// loop started.
+	queue struct {
+		sem sync.Mutex
+		fns []func()
+		win window
+	}
+
 	touch struct {
 		tap            time.Time
 		moving         bool
@@ -97,6 +118,26 @@ func (v *View) initStage(glctx gl.Context, tick chan Reader) error {
 	v.status.writer.Write(v.status.msg)
 	v.status.writer.SetColor(color.Gray{255})
 
+	v.details.writer = NewGlText(v.images)
+	err = v.details.writer.SetReadFont(bytes.NewBuffer(bound.MustAsset("inconsolata.ttf")))
+	if err != nil {
+		return err
+	}
+	v.details.writer.Write(v.details.msg)
+	v.details.writer.SetColor(color.Gray{200})
+
+	v.keypad.writer = NewTextWriter()
+	err = v.keypad.writer.SetReadFont(bytes.NewBuffer(bound.MustAsset("inconsolata.ttf")))
+	if err != nil {
+		return err
+	}
+
+	v.form.writer = NewTextWriter()
+	err = v.form.writer.SetReadFont(bytes.NewBuffer(bound.MustAsset("inconsolata.ttf")))
+	if err != nil {
+		return err
+	}
+
 	arrows := []byte{1, 2, 4, 8, 1 | 4, 1 | 8, 2 | 4, 2 | 8}
 	v.arrows = make(map[byte]*glutil.Image, len(arrows))
 	for i := range arrows {
@@ -128,7 +169,18 @@ func (v *View) initStage(glctx gl.Context, tick chan Reader) error {
 
 				b := i.Bounds()
 				v.bounds = b
-				v.frameCreated = data.Created()
+				v.frameReceived = data.Created()
+				v.frameStale = time.Second
+				if sr, ok := data.(StreamReader); ok {
+					v.frameReceived = sr.Received()
+					if fps := sr.FPS(); fps > 0 && time.Second*3/time.Duration(fps) > v.frameStale {
+						v.frameStale = time.Second * 3 / time.Duration(fps)
+					}
+					v.details.msg = sr.String()
+					if v.details.writer != nil {
+						v.details.writer.Write(v.details.msg)
+					}
+				}
 				owidth := float64(b.Dx())
 				oheight := float64(b.Dy())
 				if origBounds != b || v.frame == nil {
@@ -175,12 +227,18 @@ func (v *View) destroyStage(glctx gl.Context) {
 		v.status.writer.Release()
 		v.status.writer = nil
 	}
+	if v.details.writer != nil {
+		v.details.writer.Release()
+		v.details.writer = nil
+	}
+	v.keypad.release()
+	v.form.release()
 	v.images.Release()
 }
 
 func (v *View) paint(glctx gl.Context, sz size.Event) {
 	var r, g, b float32
-	if time.Since(v.frameCreated) > time.Second {
+	if time.Since(v.frameReceived) > v.frameStale {
 		r, g, b = 0.6, 0.2, 0.2
 	}
 
@@ -203,12 +261,35 @@ func (v *View) paint(glctx gl.Context, sz size.Event) {
 		v.framePos.previousZoom = 1
 		v.framePos.zoom = 1
 		v.status.writer.SetFontSize(10, pppt*72)
+		v.details.writer.SetFontSize(8, pppt*72)
+	}
+
+	overlay := v.form.active || v.keypad.active
+	if v.form.active {
+		if err := v.form.draw(v.images, sz); err != nil {
+			v.l.Println(err)
+		}
+	} else if v.keypad.active {
+		if err := v.keypad.draw(v.images, sz); err != nil {
+			v.l.Println(err)
+		}
 	}
 
 	if err := v.status.writer.Draw(sz, image.Pt(5, 5)); err != nil {
 		v.l.Println(err)
 	}
 
+	if overlay {
+		return
+	}
+
+	if v.auth.phase != 0 {
+		y := 10 + v.status.writer.Size().Y
+		if err := v.details.writer.Draw(sz, image.Pt(5, y)); err != nil {
+			v.l.Println(err)
+		}
+	}
+
 	szWidth := float64(sz.WidthPt)
 	szHeight := float64(sz.HeightPt)
 	if v.auth.phase == 0 {
@@ -424,22 +505,83 @@ type window interface {
 	RequiresViewportUpdate() bool
 }
 
+// wake is sent by do so loop applies queued state changes without waiting
+// for the next input event.
+type wake struct{}
+
+// do runs fn on the loop goroutine, it is safe to call from any goroutine
+// and before Start.
+func (v *View) do(fn func()) {
+	v.queue.sem.Lock()
+	v.queue.fns = append(v.queue.fns, fn)
+	w := v.queue.win
+	v.queue.sem.Unlock()
+	if w != nil {
+		w.Send(wake{})
+	}
+}
+
+func (v *View) runQueued() {
+	v.queue.sem.Lock()
+	fns := v.queue.fns
+	v.queue.fns = nil
+	v.queue.sem.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+const passStatus = "Swipe password"
+
 func (v *View) ClearPass() {
+	v.do(v.clearPass)
+	v.status.chn <- passStatus
+}
+
+// clearPass resets the touch password input, only loop may call it.
+func (v *View) clearPass() {
 	v.auth.phase = 0
 	v.auth.pass = make([]byte, 0, v.auth.passLen)
 	v.auth.last.Type = touchTypeNone
 	v.auth.n = 0
 	v.auth.fingersDown = false
+}
 
-	v.status.chn <- "Swipe password"
+// SetPassLength changes the length of the touch password, e.g. after the
+// profile was chosen. Call before ClearPass.
+func (v *View) SetPassLength(n int) {
+	v.do(func() { v.auth.passLen = n })
+}
+
+// SkipPass starts the view without asking for the touch password, e.g.
+// when the client authenticates with an enrolled device key.
+func (v *View) SkipPass() {
+	v.do(func() {
+		v.auth.skip = true
+		v.auth.phase = 1
+	})
 }
 
 func (v *View) loop(w window, events <-chan interface{}, f filter, tick chan Reader) error {
 	var glctx gl.Context
 	var sz size.Event
 	vpUpdate := w.RequiresViewportUpdate()
-	v.ClearPass()
+	v.queue.sem.Lock()
+	v.queue.win = w
+	v.queue.sem.Unlock()
+	defer func() {
+		v.queue.sem.Lock()
+		v.queue.win = nil
+		v.queue.sem.Unlock()
+	}()
+	v.runQueued()
+	if !v.auth.skip {
+		v.clearPass()
+		v.status.chn <- passStatus
+	}
 	for e := range events {
+		v.runQueued()
 		switch e := f(e).(type) {
 		case lifecycle.Event:
 			switch e.Crosses(lifecycle.StageVisible) {
@@ -454,7 +596,21 @@ func (v *View) loop(w window, events <-chan interface{}, f filter, tick chan Rea
 				v.destroyStage(glctx)
 				glctx = nil
 			}
+		case key.Event:
+			if v.form.active {
+				v.form.handleKey(e)
+			} else if v.keypad.active {
+				v.keypad.handleKey(e)
+			}
 		case touch.Event:
+			if v.form.active {
+				v.form.handleTouch(e, sz)
+				continue
+			}
+			if v.keypad.active {
+				v.keypad.handleTouch(e, sz)
+				continue
+			}
 			if v.auth.phase == 0 {
 				v.auth.pass = v.handlePassword(e, sz, v.auth.pass)
 				if len(v.auth.pass) >= v.auth.passLen {